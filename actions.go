@@ -0,0 +1,727 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/vhakulinen/push-server/auth"
+	"github.com/vhakulinen/push-server/db"
+	"github.com/vhakulinen/push-server/email"
+	"github.com/vhakulinen/push-server/notify"
+	"github.com/vhakulinen/push-server/ratelimit"
+	"github.com/vhakulinen/push-server/tcp"
+)
+
+// Actions shared by the legacy form handlers and the JSON API. Each of them
+// returns *apiError which the handlers turn into their own kind of response.
+
+// registerUser creates new user. If email verification is skipped the user is
+// activated right away, otherwise activation email is sent.
+func registerUser(semail, password string) (*db.User, *apiError) {
+	user, err := db.NewUser(semail, password)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, "%v", err)
+	}
+	if skipEmailVerification {
+		user.Activate()
+	} else {
+		email.SendRegistrationEmail(user)
+	}
+	return user, nil
+}
+
+// activateUser activates user with the key sent in activation email.
+func activateUser(semail, key string) *apiError {
+	if semail == "" || key == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Email and key required")
+	}
+	user, err := db.GetUser(semail)
+	if err != nil || user.Active == true {
+		return newAPIError(http.StatusBadRequest, codeInvalidActivation, "Invalid activation key")
+	}
+	if e := checkLockout(user); e != nil {
+		return e
+	}
+	if !user.ValidActivateToken(key) {
+		failedAttempt(user)
+		return newAPIError(http.StatusBadRequest, codeInvalidActivation, "Invalid activation key")
+	}
+	if user.ActivateExpired() {
+		return newAPIError(http.StatusBadRequest, codeActivationExpired, "Activation key has expired, request a new one")
+	}
+	user.ResetFailedAttempts()
+	user.Activate()
+	return nil
+}
+
+// resendActivation sends new activation link to user who hasn't activated
+// the account yet. Password is required, so that only whoever registered the
+// account can ask for the link again.
+func resendActivation(semail, password string) *apiError {
+	if semail == "" || password == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Email and password required")
+	}
+	user, err := db.GetUser(semail)
+	if err != nil {
+		return newAPIError(http.StatusUnauthorized, codeInvalidCredentials, "Invalid email or password")
+	}
+	if e := checkLockout(user); e != nil {
+		return e
+	}
+	if !user.ValidatePassword(password) {
+		failedAttempt(user)
+		return newAPIError(http.StatusUnauthorized, codeInvalidCredentials, "Invalid email or password")
+	}
+	user.ResetFailedAttempts()
+	if user.Active {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Account is already active")
+	}
+	if err = user.RenewActivateToken(); err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "%v", err)
+	}
+	if err = email.SendRegistrationEmail(user); err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to send email")
+	}
+	return nil
+}
+
+// retrieveToken returns user's token if password (and one-time password,
+// if two-factor authentication is enabled) is correct.
+func retrieveToken(semail, password, otp string) (string, *apiError) {
+	user, e := authenticate(semail, password, otp)
+	if e != nil {
+		return "", e
+	}
+	return user.Token, nil
+}
+
+// authenticate returns active user with email and password. Users with
+// two-factor authentication enabled must also give one-time password or
+// recovery code as otp. Passwords stored with an older hashing scheme are
+// rehashed while the plain password is at hand. After too many failed
+// attempts the user is locked out for a while.
+func authenticate(semail, password, otp string) (*db.User, *apiError) {
+	user, err := db.GetUser(semail)
+	if err != nil {
+		return nil, newAPIError(http.StatusUnauthorized, codeInvalidCredentials, "Invalid email or password")
+	}
+	if e := checkLockout(user); e != nil {
+		return nil, e
+	}
+	if !user.ValidatePassword(password) {
+		failedAttempt(user)
+		return nil, newAPIError(http.StatusUnauthorized, codeInvalidCredentials, "Invalid email or password")
+	}
+	if !user.Active {
+		return nil, newAPIError(http.StatusUnauthorized, codeInvalidCredentials, "Invalid email or password")
+	}
+	// Password is checked first, so that this doesn't tell whether the user
+	// has two-factor authentication enabled
+	if e := checkOTP(user, otp); e != nil {
+		if e.Code == codeInvalidOTP {
+			failedAttempt(user)
+		}
+		return nil, e
+	}
+	user.ResetFailedAttempts()
+	if user.NeedsRehash() {
+		if err = user.SetPassword(password); err != nil {
+			// Not fatal, the old hash still works
+			log.Printf("Failed to rehash password of %s (%v)", user.Email, err)
+		}
+	}
+	return user, nil
+}
+
+// checkLockout returns error if user is locked out after failed attempts.
+func checkLockout(user *db.User) *apiError {
+	if d := user.LockedFor(); d > 0 {
+		return newRetryError(d, codeAccountLocked, "Too many failed attempts, try again later")
+	}
+	return nil
+}
+
+// failedAttempt records failed login or activation attempt of user, and
+// locks the user out if there have been too many of them in row.
+func failedAttempt(user *db.User) {
+	n, err := user.RecordFailedAttempt()
+	if err != nil {
+		return
+	}
+	if d := ratelimit.Lockout(n); d > 0 {
+		log.Printf("Locking %s out for %v after %d failed attempts", user.Email, d, n)
+		user.LockFor(d)
+	}
+}
+
+// login starts new session for the user and returns access and refresh
+// tokens for it.
+func login(semail, password, otp string) (*auth.Tokens, *apiError) {
+	user, e := authenticate(semail, password, otp)
+	if e != nil {
+		return nil, e
+	}
+	tokens, err := auth.Login(user)
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, codeInternal, "%v", err)
+	}
+	return tokens, nil
+}
+
+// enrollTOTP starts enrolling two-factor authentication for the user.
+// Returns the secret and provisioning URI for authenticator apps.
+func enrollTOTP(user *db.User) (*totpEnrollment, *apiError) {
+	secret, uri, err := user.EnrollTOTP()
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, "%v", err)
+	}
+	return &totpEnrollment{secret, uri}, nil
+}
+
+// confirmTOTP enables two-factor authentication with code from the
+// authenticator and returns recovery codes.
+func confirmTOTP(user *db.User, code string) ([]string, *apiError) {
+	codes, err := user.ConfirmTOTP(code)
+	if err == db.ErrInvalidOTP {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidOTP, "%v", err)
+	} else if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, "%v", err)
+	}
+	return codes, nil
+}
+
+// disableTOTP turns two-factor authentication off. The caller must have
+// checked the user's second factor.
+func disableTOTP(user *db.User) *apiError {
+	if err := user.DisableTOTP(); err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "%v", err)
+	}
+	return nil
+}
+
+// checkOTP checks one-time password or recovery code of user with two-factor
+// authentication enabled.
+func checkOTP(user *db.User, otp string) *apiError {
+	switch err := user.CheckOTP(otp); err {
+	case nil:
+		return nil
+	case db.ErrOTPRequired:
+		return newAPIError(http.StatusUnauthorized, codeOTPRequired, "%v", err)
+	default:
+		return newAPIError(http.StatusUnauthorized, codeInvalidOTP, "%v", err)
+	}
+}
+
+// refreshSession returns new tokens for the session of refresh token.
+func refreshSession(refresh string) (*auth.Tokens, *apiError) {
+	tokens, err := auth.Refresh(refresh)
+	if err == db.ErrInvalidRefreshToken {
+		return nil, newAPIError(http.StatusUnauthorized, codeInvalidRefresh, "%v", err)
+	} else if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, codeInternal, "%v", err)
+	}
+	return tokens, nil
+}
+
+// logout ends session s, or every session of its user if all is true.
+func logout(s *session, all bool) *apiError {
+	if s == nil {
+		return newAPIError(http.StatusUnauthorized, codeInvalidAccessToken, "Access token required")
+	}
+	if all {
+		s.user.DeleteSessions()
+	} else {
+		s.s.Delete()
+	}
+	return nil
+}
+
+// forgotPassword emails password reset link to the user. Unknown and
+// inactive emails are silently ignored so that this can't be used to find
+// out who has an account.
+func forgotPassword(semail string) *apiError {
+	if semail == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Email required")
+	}
+	user, err := db.GetUser(semail)
+	if err != nil || !user.Active {
+		return nil
+	}
+	key, err := user.NewPasswordReset()
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "%v", err)
+	}
+	if err = email.SendPasswordResetEmail(user, key); err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to send email")
+	}
+	return nil
+}
+
+// resetPassword sets new password with key from the password reset email and
+// returns the user's token. otp is required if the user has two-factor
+// authentication enabled.
+func resetPassword(key, password, otp string) (string, *apiError) {
+	user, err := db.GetPasswordResetUser(key)
+	if err == nil {
+		// Wrong one-time passwords count as failed attempts like on login
+		if e := checkLockout(user); e != nil {
+			return "", e
+		}
+		_, err = db.ResetPassword(key, password, otp)
+	}
+	if err == db.ErrInvalidResetKey {
+		return "", newAPIError(http.StatusBadRequest, codeInvalidResetKey, "%v", err)
+	} else if err == db.ErrOTPRequired {
+		return "", newAPIError(http.StatusUnauthorized, codeOTPRequired, "%v", err)
+	} else if err == db.ErrInvalidOTP {
+		failedAttempt(user)
+		return "", newAPIError(http.StatusUnauthorized, codeInvalidOTP, "%v", err)
+	} else if err != nil {
+		return "", newAPIError(http.StatusBadRequest, codeInvalidRequest, "%v", err)
+	}
+	return user.Token, nil
+}
+
+// changeEmail sends verification link to newEmail. The user's email is
+// changed once the link is followed.
+func changeEmail(user *db.User, newEmail string) *apiError {
+	if err := user.RequestEmailChange(newEmail); err == db.ErrEmailInUse {
+		return newAPIError(http.StatusConflict, codeEmailInUse, "%v", err)
+	} else if err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "%v", err)
+	}
+	if err := email.SendEmailVerificationEmail(user); err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "Failed to send email")
+	}
+	return nil
+}
+
+// confirmEmail changes user's email to newEmail with the key sent to it.
+func confirmEmail(newEmail, key string) *apiError {
+	if newEmail == "" || key == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Email and key required")
+	}
+	_, err := db.ConfirmEmailChange(newEmail, key)
+	switch err {
+	case nil:
+		return nil
+	case db.ErrEmailInUse:
+		return newAPIError(http.StatusConflict, codeEmailInUse, "%v", err)
+	case db.ErrActivationExpired:
+		return newAPIError(http.StatusBadRequest, codeActivationExpired, "Activation key has expired, change the email again to get a new one")
+	default:
+		return newAPIError(http.StatusBadRequest, codeInvalidActivation, "Invalid activation key")
+	}
+}
+
+// deleteAccount deletes the user with everything linked to the account and
+// disconnects the user's live clients.
+func deleteAccount(user *db.User) *apiError {
+	if err := user.Delete(); err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "%v", err)
+	}
+	tcp.DisconnectFromPool(user.Token)
+	return nil
+}
+
+// exportAccount returns everything stored about the user.
+func exportAccount(user *db.User) *db.AccountExport {
+	return user.Export()
+}
+
+// maxTokenGrace is the longest time in seconds rotated token can be kept
+// working
+const maxTokenGrace = 7 * 24 * 60 * 60
+
+// rotateToken gives user new token and disconnects live clients of the old
+// one. If grace is positive, the old token keeps working for that many
+// seconds.
+func rotateToken(user *db.User, grace int64) (string, *apiError) {
+	if grace < 0 || grace > maxTokenGrace {
+		return "", newAPIError(http.StatusBadRequest, codeInvalidRequest, "Grace period must be between 0 and %d seconds", maxTokenGrace)
+	}
+	old := user.Token
+	token, err := user.RotateToken(time.Duration(grace) * time.Second)
+	if err != nil {
+		return "", newAPIError(http.StatusInternalServerError, codeInternal, "%v", err)
+	}
+	// Clients can reconnect with the old token during the grace period
+	tcp.DisconnectFromPool(old)
+	return token, nil
+}
+
+// sendPush saves the push and delivers it through the enabled notifiers.
+func sendPush(title, body, token, uri string, timestamp, priority int64) (*db.PushData, *apiError) {
+	if title == "" || token == "" {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Token and title required")
+	}
+	token, e := resolveToken(token, db.ScopePublish)
+	if e != nil {
+		return nil, e
+	}
+	pushData, err := db.SavePushData(title, body, token, uri, timestamp, priority)
+	if err != nil {
+		log.Printf("Something went wrong! (%v)", err)
+		return nil, newAPIError(http.StatusInternalServerError, codeInternal, "Failed to save push")
+	}
+	saved := deliverPush(pushData)
+	return &saved, nil
+}
+
+// sendTopicPush saves the push for every subscriber of topic and delivers
+// it to each of them. token must be the topic's owner.
+func sendTopicPush(title, body, token, topic, uri string, timestamp, priority int64) ([]db.PushData, *apiError) {
+	if title == "" || token == "" || topic == "" {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Token, topic and title required")
+	}
+	token, e := resolveToken(token, db.ScopePublish)
+	if e != nil {
+		return nil, e
+	}
+	t, token, e := topicFor(token, topic)
+	if e != nil {
+		return nil, e
+	}
+	if t.Owner != token {
+		return nil, newAPIError(http.StatusForbidden, codeForbidden, "Only owner can publish to topic")
+	}
+	var pushes []db.PushData
+	for _, subscriber := range t.Subscribers() {
+		p, err := db.SaveTopicPushData(title, body, subscriber, uri, t.Name, timestamp, priority)
+		if err != nil {
+			log.Printf("Failed to save push to topic %s for subscriber (%v)", topic, err)
+			continue
+		}
+		pushes = append(pushes, deliverPush(p))
+	}
+	return pushes, nil
+}
+
+// deliverPush delivers saved push through the enabled notifiers and returns
+// copy of it as it was saved.
+func deliverPush(p *db.PushData) db.PushData {
+	// Copy to return, since notifiers might modify p
+	saved := *p
+	notify.Deliver(p)
+	return saved
+}
+
+// poolPushes returns pushes which haven't been delivered to the device yet
+// and marks them delivered. Empty device name means the default device.
+func poolPushes(token, name string) ([]db.PushData, *apiError) {
+	token, e := resolveToken(token, db.ScopeRead)
+	if e != nil {
+		return nil, e
+	}
+	if name == "" {
+		name = db.DefaultDeviceName
+	}
+	device, err := db.RegisterDevice(name, token)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil, newAPIError(http.StatusInternalServerError, codeInternal, "Something went wrong!")
+	}
+	pushes := device.UndeliveredPushes()
+	for i := range pushes {
+		pushes[i].SetDelivered(device)
+	}
+	return pushes, nil
+}
+
+// registerGCM registers GCM client to token, optionally linking it to device.
+func registerGCM(token, gcmID, name string) *apiError {
+	if gcmID == "" || token == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Token and GCM ID required")
+	}
+	token, e := resolveToken(token, db.ScopeDevice)
+	if e != nil {
+		return e
+	}
+	err := notify.Register("fcm", token, map[string]string{"gcmid": gcmID, "device": name})
+	return notifierError(err)
+}
+
+// unregisterGCM removes GCM client if it exists.
+func unregisterGCM(gcmID string) {
+	if gcmID == "" {
+		return
+	}
+	notify.Unregister("fcm", map[string]string{"gcmid": gcmID})
+}
+
+// registerAPNS registers iOS device's APNs device token to token.
+func registerAPNS(token, deviceToken string) *apiError {
+	if token == "" || deviceToken == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Token and device token required")
+	}
+	token, e := resolveToken(token, db.ScopeDevice)
+	if e != nil {
+		return e
+	}
+	err := notify.Register("apns", token, map[string]string{"devicetoken": deviceToken})
+	if err == db.ErrInvalidDeviceToken {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "%v", err)
+	}
+	return notifierError(err)
+}
+
+// unregisterAPNS removes APNs device if it exists.
+func unregisterAPNS(deviceToken string) {
+	if deviceToken == "" {
+		return
+	}
+	notify.Unregister("apns", map[string]string{"devicetoken": deviceToken})
+}
+
+// registerDevice registers device to token.
+func registerDevice(token, name string) *apiError {
+	if name == "" || token == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Token and device required")
+	}
+	token, e := resolveToken(token, db.ScopeDevice)
+	if e != nil {
+		return e
+	}
+	if _, err := db.RegisterDevice(name, token); err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "%v", err)
+	}
+	return nil
+}
+
+// unregisterDevice removes token's device if it exists.
+func unregisterDevice(token, name string) {
+	if name == "" || token == "" {
+		return
+	}
+	token, e := resolveToken(token, db.ScopeDevice)
+	if e != nil {
+		return
+	}
+	d, err := db.GetDevice(name, token)
+	if err != nil {
+		return
+	}
+	d.Delete()
+}
+
+// subscribeWebPush registers browser's push subscription to token.
+func subscribeWebPush(token, endpoint, p256dh, auth string) *apiError {
+	if token == "" || endpoint == "" || p256dh == "" || auth == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Token, endpoint, p256dh and auth required")
+	}
+	token, e := resolveToken(token, db.ScopeDevice)
+	if e != nil {
+		return e
+	}
+	err := notify.Register("webpush", token, map[string]string{
+		"endpoint": endpoint,
+		"p256dh":   p256dh,
+		"auth":     auth,
+	})
+	if err != nil && err != notify.ErrDisabled {
+		// Only thing left to fail is the endpoint
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "%v", err)
+	}
+	return notifierError(err)
+}
+
+// unsubscribeWebPush removes push subscription if it exists.
+func unsubscribeWebPush(endpoint string) {
+	if endpoint == "" {
+		return
+	}
+	notify.Unregister("webpush", map[string]string{"endpoint": endpoint})
+}
+
+// registerWebhook registers webhook to token.
+func registerWebhook(token, url, secret string) *apiError {
+	if token == "" || url == "" || secret == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Token, URL and secret required")
+	}
+	token, e := resolveToken(token, db.ScopeDevice)
+	if e != nil {
+		return e
+	}
+	err := notify.Register("webhook", token, map[string]string{"url": url, "secret": secret})
+	if err != nil && err != notify.ErrDisabled {
+		// Only thing left to fail is the URL
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "%v", err)
+	}
+	return notifierError(err)
+}
+
+// unregisterWebhook removes token's webhook if it exists.
+func unregisterWebhook(token, url string) {
+	if token == "" || url == "" {
+		return
+	}
+	token, e := resolveToken(token, db.ScopeDevice)
+	if e != nil {
+		return
+	}
+	notify.Unregister("webhook", map[string]string{"token": token, "url": url})
+}
+
+// topicFor returns topic by name and the token credential resolves to. API
+// keys can't manage topics.
+func topicFor(credential, name string) (*db.Topic, string, *apiError) {
+	token, e := resolveToken(credential, "")
+	if e != nil {
+		return nil, "", e
+	}
+	t, err := db.GetTopic(name)
+	if err != nil {
+		return nil, "", newAPIError(http.StatusNotFound, codeTopicNotFound, "Topic not found")
+	}
+	return t, token, nil
+}
+
+// createTopic creates topic owned by token. Returns the key others need for
+// subscribing to the topic.
+func createTopic(token, name string) (string, *apiError) {
+	if token == "" || name == "" {
+		return "", newAPIError(http.StatusBadRequest, codeInvalidRequest, "Token and topic required")
+	}
+	token, e := resolveToken(token, "")
+	if e != nil {
+		return "", e
+	}
+	if _, err := db.GetTopic(name); err == nil {
+		return "", newAPIError(http.StatusConflict, codeTopicExists, "Topic exists")
+	}
+	_, key, err := db.CreateTopic(name, token)
+	if err != nil {
+		return "", newAPIError(http.StatusBadRequest, codeInvalidRequest, "%v", err)
+	}
+	return key, nil
+}
+
+// deleteTopic deletes topic. Only the owner can delete it.
+func deleteTopic(token, name string) *apiError {
+	if token == "" || name == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Token and topic required")
+	}
+	t, token, e := topicFor(token, name)
+	if e != nil {
+		return e
+	}
+	if t.Owner != token {
+		return newAPIError(http.StatusForbidden, codeForbidden, "Only owner can delete topic")
+	}
+	t.Delete()
+	return nil
+}
+
+// subscribeTopic subscribes token to topic with the key the topic's owner
+// got when creating it.
+func subscribeTopic(token, name, key string) *apiError {
+	if token == "" || name == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Token and topic required")
+	}
+	t, token, e := topicFor(token, name)
+	if e != nil {
+		return e
+	}
+	if t.Owner != token && !t.ValidSubscribeKey(key) {
+		return newAPIError(http.StatusForbidden, codeForbidden, "Invalid subscribe key")
+	}
+	if err := t.Subscribe(token); err != nil {
+		return newAPIError(http.StatusInternalServerError, codeInternal, "%v", err)
+	}
+	return nil
+}
+
+// unsubscribeTopic removes token's subscription to topic.
+func unsubscribeTopic(token, name string) *apiError {
+	if token == "" || name == "" {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Token and topic required")
+	}
+	t, token, e := topicFor(token, name)
+	if e != nil {
+		return e
+	}
+	t.Unsubscribe(token)
+	return nil
+}
+
+// createAPIKey creates API key with scopes for token. Key expires after
+// expiresIn seconds, or never if it's zero.
+func createAPIKey(token, label string, scopes []string, expiresIn int64) (*db.APIKey, string, *apiError) {
+	if token == "" || len(scopes) == 0 {
+		return nil, "", newAPIError(http.StatusBadRequest, codeInvalidRequest, "Token and scopes required")
+	}
+	if expiresIn < 0 {
+		return nil, "", newAPIError(http.StatusBadRequest, codeInvalidRequest, "Expiry can't be negative")
+	}
+	token, e := resolveToken(token, "")
+	if e != nil {
+		return nil, "", e
+	}
+	var expiresAt time.Time
+	if expiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+	k, key, err := db.NewAPIKey(token, label, scopes, expiresAt)
+	if err != nil {
+		return nil, "", newAPIError(http.StatusBadRequest, codeInvalidRequest, "%v", err)
+	}
+	return k, key, nil
+}
+
+// listAPIKeys returns API keys of token.
+func listAPIKeys(token string) ([]db.APIKey, *apiError) {
+	token, e := resolveToken(token, "")
+	if e != nil {
+		return nil, e
+	}
+	return db.GetAPIKeys(token), nil
+}
+
+// revokeAPIKey deletes token's API key and disconnects live clients using it.
+func revokeAPIKey(token string, id int64) *apiError {
+	token, e := resolveToken(token, "")
+	if e != nil {
+		return e
+	}
+	k, err := db.GetAPIKey(id, token)
+	if err != nil {
+		return newAPIError(http.StatusNotFound, codeNotFound, "API key not found")
+	}
+	k.Delete()
+	tcp.DisconnectKeyFromPool(k.Token, k.ID)
+	return nil
+}
+
+// resolveToken returns the token which credential (token or API key) grants
+// access to for action requiring scope. Empty scope requires the token
+// itself.
+func resolveToken(credential, scope string) (string, *apiError) {
+	token, err := db.ResolveToken(credential, scope)
+	switch err {
+	case nil:
+		return token, nil
+	case db.ErrTokenNotFound:
+		return "", newAPIError(http.StatusNotFound, codeTokenNotFound, "Token not found")
+	case db.ErrKeyExpired:
+		return "", newAPIError(http.StatusUnauthorized, codeKeyExpired, "API key expired")
+	default:
+		if scope == "" {
+			return "", newAPIError(http.StatusForbidden, codeInsufficientScope, "API keys can't be used for this")
+		}
+		return "", newAPIError(http.StatusForbidden, codeInsufficientScope, "API key doesn't have %s scope", scope)
+	}
+}
+
+// notifierError converts error from registering client to notifier to
+// apiError.
+func notifierError(err error) *apiError {
+	switch err {
+	case nil:
+		return nil
+	case notify.ErrDisabled:
+		return newAPIError(http.StatusNotFound, codeNotFound, "%v", err)
+	default:
+		return newAPIError(http.StatusInternalServerError, codeInternal, "%v", err)
+	}
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vhakulinen/push-server/db"
+)
+
+// Machine readable error codes returned by the JSON API
+const (
+	codeInvalidJSON        = "invalid_json"
+	codeInvalidRequest     = "invalid_request"
+	codeInvalidActivation  = "invalid_activation"
+	codeActivationExpired  = "activation_expired"
+	codeInvalidResetKey    = "invalid_reset_key"
+	codeEmailInUse         = "email_in_use"
+	codeInvalidAccessToken = "invalid_access_token"
+	codeInvalidRefresh     = "invalid_refresh_token"
+	codeOTPRequired        = "otp_required"
+	codeInvalidOTP         = "invalid_otp"
+	codeRateLimited        = "rate_limited"
+	codeAccountLocked      = "account_locked"
+	codeInvalidCredentials = "invalid_credentials"
+	codeTokenNotFound      = "token_not_found"
+	codeTopicNotFound      = "topic_not_found"
+	codeTopicExists        = "topic_exists"
+	codeForbidden          = "forbidden"
+	codeKeyExpired         = "key_expired"
+	codeInsufficientScope  = "insufficient_scope"
+	codeNotFound           = "not_found"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeInternal           = "internal_error"
+)
+
+// apiError is an error which can be returned to the client. Status is the
+// HTTP status code used in the response.
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RetryAfter is sent as Retry-After header if set
+	RetryAfter time.Duration `json:"-"`
+}
+
+func newAPIError(status int, code, format string, args ...interface{}) *apiError {
+	return &apiError{
+		Status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// newRetryError returns 429 error telling to try again after d.
+func newRetryError(d time.Duration, code, format string, args ...interface{}) *apiError {
+	e := newAPIError(http.StatusTooManyRequests, code, format, args...)
+	e.RetryAfter = d
+	return e
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// apiFunc handles JSON API request. It returns HTTP status code and value
+// to encode as response body, or error.
+type apiFunc func(r *http.Request) (int, interface{}, *apiError)
+
+// apiHandler wraps f to http.HandlerFunc which accepts only POST requests
+// and writes f's return values as JSON.
+func apiHandler(f apiFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != "POST" {
+			writeJSONError(w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed,
+				"Only POST is allowed"))
+			return
+		}
+		status, v, e := f(r)
+		if e != nil {
+			writeJSONError(w, e)
+			return
+		}
+		writeJSON(w, status, v)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, e *apiError) {
+	setRetryAfter(w, e)
+	writeJSON(w, e.Status, map[string]*apiError{"error": e})
+}
+
+// writeErrorHeader writes status of e for the legacy handlers.
+func writeErrorHeader(w http.ResponseWriter, e *apiError) {
+	setRetryAfter(w, e)
+	w.WriteHeader(e.Status)
+}
+
+func setRetryAfter(w http.ResponseWriter, e *apiError) {
+	if e.RetryAfter > 0 {
+		// Whole seconds, rounded up so that retrying right then works
+		secs := int64((e.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	}
+}
+
+// decodeJSON decodes request's body to v.
+func decodeJSON(r *http.Request, v interface{}) *apiError {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return newAPIError(http.StatusBadRequest, codeInvalidJSON, "Invalid JSON (%v)", err)
+	}
+	return nil
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+var statusOK = statusResponse{"ok"}
+
+type credentialsRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// OTP is one-time password or recovery code, required if the user has
+	// two-factor authentication enabled
+	OTP string `json:"otp"`
+}
+
+type tokenResponse struct {
+	Token string `json:"token"`
+}
+
+func apiRegister(r *http.Request) (int, interface{}, *apiError) {
+	var req credentialsRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	user, e := registerUser(req.Email, req.Password)
+	if e != nil {
+		return 0, nil, e
+	}
+	if user.Active {
+		return http.StatusCreated, tokenResponse{user.Token}, nil
+	}
+	return http.StatusCreated, statusResponse{"activation_email_sent"}, nil
+}
+
+func apiActivate(r *http.Request) (int, interface{}, *apiError) {
+	var req struct {
+		Email string `json:"email"`
+		Key   string `json:"key"`
+	}
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if e := activateUser(req.Email, req.Key); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusOK, nil
+}
+
+func apiResendActivation(r *http.Request) (int, interface{}, *apiError) {
+	var req credentialsRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if e := resendActivation(req.Email, req.Password); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusResponse{"activation_email_sent"}, nil
+}
+
+func apiRetrieve(r *http.Request) (int, interface{}, *apiError) {
+	var req credentialsRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	token, e := retrieveToken(req.Email, req.Password, req.OTP)
+	if e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, tokenResponse{token}, nil
+}
+
+func apiLogin(r *http.Request) (int, interface{}, *apiError) {
+	var req credentialsRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	tokens, e := login(req.Email, req.Password, req.OTP)
+	if e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, tokens, nil
+}
+
+func apiRefresh(r *http.Request) (int, interface{}, *apiError) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	tokens, e := refreshSession(req.RefreshToken)
+	if e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, tokens, nil
+}
+
+func apiLogout(r *http.Request) (int, interface{}, *apiError) {
+	var req struct {
+		All bool `json:"all"`
+	}
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if e := logout(sessionOf(r), req.All); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusOK, nil
+}
+
+func apiForgotPassword(r *http.Request) (int, interface{}, *apiError) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if e := forgotPassword(req.Email); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusResponse{"reset_email_sent"}, nil
+}
+
+func apiResetPassword(r *http.Request) (int, interface{}, *apiError) {
+	var req struct {
+		Key      string `json:"key"`
+		Password string `json:"password"`
+		OTP      string `json:"otp"`
+	}
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	token, e := resetPassword(req.Key, req.Password, req.OTP)
+	if e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, tokenResponse{token}, nil
+}
+
+func apiAccountEmail(r *http.Request) (int, interface{}, *apiError) {
+	var req struct {
+		NewEmail string `json:"newemail"`
+	}
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if e := changeEmail(sessionOf(r).user, req.NewEmail); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusResponse{"verification_email_sent"}, nil
+}
+
+func apiAccountEmailConfirm(r *http.Request) (int, interface{}, *apiError) {
+	var req struct {
+		Email string `json:"email"`
+		Key   string `json:"key"`
+	}
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if e := confirmEmail(req.Email, req.Key); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusResponse{"ok"}, nil
+}
+
+func apiAccountDelete(r *http.Request) (int, interface{}, *apiError) {
+	if e := deleteAccount(sessionOf(r).user); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusResponse{"ok"}, nil
+}
+
+func apiAccountExport(r *http.Request) (int, interface{}, *apiError) {
+	return http.StatusOK, exportAccount(sessionOf(r).user), nil
+}
+
+// totpEnrollment is the secret for user's authenticator app. URI can be
+// shown as QR code.
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func apiTOTPEnroll(r *http.Request) (int, interface{}, *apiError) {
+	enrollment, e := enrollTOTP(sessionOf(r).user)
+	if e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, enrollment, nil
+}
+
+func apiTOTPConfirm(r *http.Request) (int, interface{}, *apiError) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	codes, e := confirmTOTP(sessionOf(r).user, req.Code)
+	if e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, recoveryCodesResponse{codes}, nil
+}
+
+func apiTOTPDisable(r *http.Request) (int, interface{}, *apiError) {
+	var req struct {
+		OTP string `json:"otp"`
+	}
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	user := sessionOf(r).user
+	// Access token alone isn't enough to turn the second factor off
+	if e := checkOTP(user, req.OTP); e != nil {
+		return 0, nil, e
+	}
+	if e := disableTOTP(user); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusOK, nil
+}
+
+func apiRotateToken(r *http.Request) (int, interface{}, *apiError) {
+	var req struct {
+		Grace int64 `json:"grace"`
+	}
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	token, e := rotateToken(sessionOf(r).user, req.Grace)
+	if e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, tokenResponse{token}, nil
+}
+
+func apiPush(r *http.Request) (int, interface{}, *apiError) {
+	var req struct {
+		Token     string `json:"token"`
+		Topic     string `json:"topic"`
+		Title     string `json:"title"`
+		Body      string `json:"body"`
+		URL       string `json:"url"`
+		Priority  int64  `json:"priority"`
+		Timestamp int64  `json:"timestamp"`
+	}
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if req.Priority == 0 {
+		req.Priority = 1
+	} else if req.Priority < 1 || req.Priority > 3 {
+		return 0, nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Priority must be 1, 2 or 3")
+	}
+	if req.Timestamp < 0 {
+		return 0, nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, "Timestamp can't be negative")
+	}
+	if req.Topic != "" {
+		pushes, e := sendTopicPush(req.Title, req.Body, req.Token, req.Topic, req.URL, req.Timestamp, req.Priority)
+		if e != nil {
+			return 0, nil, e
+		}
+		ids := make([]int64, len(pushes))
+		for i, p := range pushes {
+			ids[i] = p.ID
+		}
+		return http.StatusCreated, struct {
+			IDs []int64 `json:"ids"`
+		}{ids}, nil
+	}
+	p, e := sendPush(req.Title, req.Body, req.Token, req.URL, req.Timestamp, req.Priority)
+	if e != nil {
+		return 0, nil, e
+	}
+	return http.StatusCreated, struct {
+		ID int64 `json:"id"`
+	}{p.ID}, nil
+}
+
+type topicRequest struct {
+	Topic string `json:"topic"`
+	// Key is the topic's subscribe key, needed for subscribing
+	Key string `json:"key"`
+}
+
+func apiTopicCreate(r *http.Request) (int, interface{}, *apiError) {
+	var req topicRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	key, e := createTopic(sessionOf(r).user.Token, req.Topic)
+	if e != nil {
+		return 0, nil, e
+	}
+	return http.StatusCreated, struct {
+		Key string `json:"key"`
+	}{key}, nil
+}
+
+func apiTopicSubscribe(r *http.Request) (int, interface{}, *apiError) {
+	var req topicRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if e := subscribeTopic(sessionOf(r).user.Token, req.Topic, req.Key); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusOK, nil
+}
+
+// apiTopic returns API handler running topic action f.
+func apiTopic(status int, f func(token, name string) *apiError) apiFunc {
+	return func(r *http.Request) (int, interface{}, *apiError) {
+		var req topicRequest
+		if e := decodeJSON(r, &req); e != nil {
+			return 0, nil, e
+		}
+		if e := f(sessionOf(r).user.Token, req.Topic); e != nil {
+			return 0, nil, e
+		}
+		return status, statusOK, nil
+	}
+}
+
+func apiPool(r *http.Request) (int, interface{}, *apiError) {
+	var req struct {
+		Token  string `json:"token"`
+		Device string `json:"device"`
+	}
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	pushes, e := poolPushes(req.Token, req.Device)
+	if e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, struct {
+		Pushes []db.PushData `json:"pushes"`
+	}{pushes}, nil
+}
+
+type gcmRequest struct {
+	Token  string `json:"token"`
+	GCMID  string `json:"gcmid"`
+	Device string `json:"device"`
+}
+
+func apiGCMRegister(r *http.Request) (int, interface{}, *apiError) {
+	var req gcmRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if e := registerGCM(tokenFromRequest(r, req.Token), req.GCMID, req.Device); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusOK, nil
+}
+
+func apiGCMUnregister(r *http.Request) (int, interface{}, *apiError) {
+	var req gcmRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	unregisterGCM(req.GCMID)
+	return http.StatusOK, statusOK, nil
+}
+
+type apnsRequest struct {
+	Token       string `json:"token"`
+	DeviceToken string `json:"devicetoken"`
+}
+
+func apiAPNSRegister(r *http.Request) (int, interface{}, *apiError) {
+	var req apnsRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if e := registerAPNS(tokenFromRequest(r, req.Token), req.DeviceToken); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusOK, nil
+}
+
+func apiAPNSUnregister(r *http.Request) (int, interface{}, *apiError) {
+	var req apnsRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	unregisterAPNS(req.DeviceToken)
+	return http.StatusOK, statusOK, nil
+}
+
+type deviceRequest struct {
+	Token  string `json:"token"`
+	Device string `json:"device"`
+}
+
+func apiDeviceRegister(r *http.Request) (int, interface{}, *apiError) {
+	var req deviceRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if e := registerDevice(tokenFromRequest(r, req.Token), req.Device); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusOK, nil
+}
+
+func apiDeviceUnregister(r *http.Request) (int, interface{}, *apiError) {
+	var req deviceRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	unregisterDevice(tokenFromRequest(r, req.Token), req.Device)
+	return http.StatusOK, statusOK, nil
+}
+
+type webPushRequest struct {
+	Token    string `json:"token"`
+	Endpoint string `json:"endpoint"`
+	// Keys is in the same format as in PushSubscription.toJSON()
+	Keys struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+func apiWebPushSubscribe(r *http.Request) (int, interface{}, *apiError) {
+	var req webPushRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if e := subscribeWebPush(tokenFromRequest(r, req.Token), req.Endpoint, req.Keys.P256dh, req.Keys.Auth); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusOK, nil
+}
+
+func apiWebPushUnsubscribe(r *http.Request) (int, interface{}, *apiError) {
+	var req webPushRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	unsubscribeWebPush(req.Endpoint)
+	return http.StatusOK, statusOK, nil
+}
+
+type webhookRequest struct {
+	Token  string `json:"token"`
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+func apiWebhookRegister(r *http.Request) (int, interface{}, *apiError) {
+	var req webhookRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if e := registerWebhook(tokenFromRequest(r, req.Token), req.URL, req.Secret); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusOK, nil
+}
+
+func apiWebhookUnregister(r *http.Request) (int, interface{}, *apiError) {
+	var req webhookRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	unregisterWebhook(tokenFromRequest(r, req.Token), req.URL)
+	return http.StatusOK, statusOK, nil
+}
+
+// apiKey is API key as it's shown in the API. Key itself is only returned
+// when the key is created.
+type apiKey struct {
+	ID        int64    `json:"id"`
+	Key       string   `json:"key,omitempty"`
+	Prefix    string   `json:"prefix"`
+	Label     string   `json:"label"`
+	Scopes    []string `json:"scopes"`
+	CreatedAt int64    `json:"created_at"`
+	// ExpiresAt is unix timestamp, zero if key doesn't expire
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+func newAPIKey(k *db.APIKey, key string) apiKey {
+	out := apiKey{
+		ID:        k.ID,
+		Key:       key,
+		Prefix:    k.Prefix,
+		Label:     k.Label,
+		Scopes:    strings.Split(k.Scopes, ","),
+		CreatedAt: k.CreatedAt.Unix(),
+	}
+	if !k.ExpiresAt.IsZero() {
+		out.ExpiresAt = k.ExpiresAt.Unix()
+	}
+	return out
+}
+
+type apiKeyRequest struct {
+	ID        int64    `json:"id"`
+	Label     string   `json:"label"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int64    `json:"expires_in"`
+}
+
+func apiKeyCreate(r *http.Request) (int, interface{}, *apiError) {
+	var req apiKeyRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	k, key, e := createAPIKey(sessionOf(r).user.Token, req.Label, req.Scopes, req.ExpiresIn)
+	if e != nil {
+		return 0, nil, e
+	}
+	return http.StatusCreated, newAPIKey(k, key), nil
+}
+
+func apiKeyList(r *http.Request) (int, interface{}, *apiError) {
+	keys, e := listAPIKeys(sessionOf(r).user.Token)
+	if e != nil {
+		return 0, nil, e
+	}
+	out := make([]apiKey, len(keys))
+	for i := range keys {
+		out[i] = newAPIKey(&keys[i], "")
+	}
+	return http.StatusOK, struct {
+		Keys []apiKey `json:"keys"`
+	}{out}, nil
+}
+
+func apiKeyRevoke(r *http.Request) (int, interface{}, *apiError) {
+	var req apiKeyRequest
+	if e := decodeJSON(r, &req); e != nil {
+		return 0, nil, e
+	}
+	if e := revokeAPIKey(sessionOf(r).user.Token, req.ID); e != nil {
+		return 0, nil, e
+	}
+	return http.StatusOK, statusOK, nil
+}
+
+func apiNotFound(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	writeJSONError(w, newAPIError(http.StatusNotFound, codeNotFound, "No such API endpoint"))
+}
+
+// registerAPIv1 registers the JSON API handlers under /api/v1/ to mux.
+func registerAPIv1(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/", apiNotFound)
+	mux.HandleFunc("/api/v1/register/", apiHandler(apiRegister))
+	mux.HandleFunc("/api/v1/activate/", apiHandler(apiActivate))
+	mux.HandleFunc("/api/v1/activate/resend/", apiHandler(apiResendActivation))
+	mux.HandleFunc("/api/v1/retrieve/", apiHandler(apiRetrieve))
+	mux.HandleFunc("/api/v1/auth/login/", apiHandler(apiLogin))
+	mux.HandleFunc("/api/v1/auth/refresh/", apiHandler(apiRefresh))
+	mux.HandleFunc("/api/v1/auth/logout/", requireSession(apiHandler(apiLogout)))
+	mux.HandleFunc("/api/v1/password/forgot/", apiHandler(apiForgotPassword))
+	mux.HandleFunc("/api/v1/password/reset/", apiHandler(apiResetPassword))
+	mux.HandleFunc("/api/v1/token/rotate/", requireSession(apiHandler(apiRotateToken)))
+	mux.HandleFunc("/api/v1/account/email/", requireSession(apiHandler(apiAccountEmail)))
+	mux.HandleFunc("/api/v1/account/email/confirm/", apiHandler(apiAccountEmailConfirm))
+	mux.HandleFunc("/api/v1/account/delete/", requireSession(apiHandler(apiAccountDelete)))
+	mux.HandleFunc("/api/v1/account/export/", requireSession(apiHandler(apiAccountExport)))
+	mux.HandleFunc("/api/v1/account/2fa/enroll/", requireSession(apiHandler(apiTOTPEnroll)))
+	mux.HandleFunc("/api/v1/account/2fa/confirm/", requireSession(apiHandler(apiTOTPConfirm)))
+	mux.HandleFunc("/api/v1/account/2fa/disable/", requireSession(apiHandler(apiTOTPDisable)))
+	mux.HandleFunc("/api/v1/push/", apiHandler(apiPush))
+	mux.HandleFunc("/api/v1/pool/", apiHandler(apiPool))
+	mux.HandleFunc("/api/v1/keys/create/", requireSession(apiHandler(apiKeyCreate)))
+	mux.HandleFunc("/api/v1/keys/list/", requireSession(apiHandler(apiKeyList)))
+	mux.HandleFunc("/api/v1/keys/revoke/", requireSession(apiHandler(apiKeyRevoke)))
+	mux.HandleFunc("/api/v1/topics/create/", requireSession(apiHandler(apiTopicCreate)))
+	mux.HandleFunc("/api/v1/topics/delete/", requireSession(apiHandler(apiTopic(http.StatusOK, deleteTopic))))
+	mux.HandleFunc("/api/v1/topics/subscribe/", requireSession(apiHandler(apiTopicSubscribe)))
+	mux.HandleFunc("/api/v1/topics/unsubscribe/", requireSession(apiHandler(apiTopic(http.StatusOK, unsubscribeTopic))))
+	mux.HandleFunc("/api/v1/gcm/", withSession(apiHandler(apiGCMRegister)))
+	mux.HandleFunc("/api/v1/ungcm/", apiHandler(apiGCMUnregister))
+	mux.HandleFunc("/api/v1/apns/", withSession(apiHandler(apiAPNSRegister)))
+	mux.HandleFunc("/api/v1/unapns/", apiHandler(apiAPNSUnregister))
+	mux.HandleFunc("/api/v1/device/", withSession(apiHandler(apiDeviceRegister)))
+	mux.HandleFunc("/api/v1/undevice/", withSession(apiHandler(apiDeviceUnregister)))
+	mux.HandleFunc("/api/v1/webpush/subscribe/", withSession(apiHandler(apiWebPushSubscribe)))
+	mux.HandleFunc("/api/v1/webpush/unsubscribe/", apiHandler(apiWebPushUnsubscribe))
+	mux.HandleFunc("/api/v1/webhook/", withSession(apiHandler(apiWebhookRegister)))
+	mux.HandleFunc("/api/v1/unwebhook/", withSession(apiHandler(apiWebhookUnregister)))
+}
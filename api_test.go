@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vhakulinen/push-server/auth"
+	"github.com/vhakulinen/push-server/db"
+)
+
+// postJSON posts v as JSON to url and decodes the response to out.
+func postJSON(t *testing.T, url string, v interface{}, out interface{}) int {
+	return postJSONAuth(t, url, "", v, out)
+}
+
+// postJSONAuth is postJSON with access token in Authorization header.
+func postJSONAuth(t *testing.T, url, access string, v interface{}, out interface{}) int {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if access != "" {
+		req.Header.Set("Authorization", "Bearer "+access)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Got Content-Type %q, want \"application/json\"", ct)
+	}
+	if out != nil {
+		if err = json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode
+}
+
+type errorResponse struct {
+	Error apiError `json:"error"`
+}
+
+func TestAPIPush(t *testing.T) {
+	ts := httptest.NewServer(apiHandler(apiPush))
+	defer ts.Close()
+
+	u, err := db.NewUser("apipush@user.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+
+	var testData = []struct {
+		req          map[string]interface{}
+		expectedCode int
+		expectedErr  string
+	}{
+		{map[string]interface{}{"token": u.Token, "title": "title"}, 201, ""},
+		{map[string]interface{}{"token": u.Token, "title": "title", "priority": 3}, 201, ""},
+		{map[string]interface{}{"token": u.Token, "title": "title", "priority": 4}, 400, codeInvalidRequest},
+		{map[string]interface{}{"token": u.Token, "title": "title", "timestamp": -1}, 400, codeInvalidRequest},
+		{map[string]interface{}{"token": u.Token, "title": "title", "priority": "high"}, 400, codeInvalidJSON},
+		{map[string]interface{}{"token": u.Token}, 400, codeInvalidRequest},
+		{map[string]interface{}{"token": "invalidtoken", "title": "title"}, 404, codeTokenNotFound},
+	}
+
+	for i, data := range testData {
+		var out struct {
+			ID    int64    `json:"id"`
+			Error apiError `json:"error"`
+		}
+		code := postJSON(t, ts.URL, data.req, &out)
+		if code != data.expectedCode {
+			t.Errorf("Got %d, want %d (run %d)", code, data.expectedCode, i)
+		}
+		if out.Error.Code != data.expectedErr {
+			t.Errorf("Got error code %q, want %q (run %d)", out.Error.Code, data.expectedErr, i)
+		}
+		if data.expectedErr == "" {
+			if _, err := db.GetPushData(out.ID, u.Token); err != nil {
+				t.Errorf("Push with returned ID %d not found (run %d)", out.ID, i)
+			}
+		}
+	}
+
+	// Only POST is allowed
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 405 {
+		t.Errorf("Got %d, want %d", res.StatusCode, 405)
+	}
+}
+
+func TestAPIRetrieveAndPool(t *testing.T) {
+	retrieve := httptest.NewServer(apiHandler(apiRetrieve))
+	defer retrieve.Close()
+	pool := httptest.NewServer(apiHandler(apiPool))
+	defer pool.Close()
+
+	u, err := db.NewUser("apipool@user.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	u.Activate()
+
+	var e errorResponse
+	code := postJSON(t, retrieve.URL, credentialsRequest{Email: u.Email, Password: "invalidpass"}, &e)
+	if code != 401 || e.Error.Code != codeInvalidCredentials {
+		t.Errorf("Got %d (%q), want %d (%q)", code, e.Error.Code, 401, codeInvalidCredentials)
+	}
+
+	var token tokenResponse
+	if code = postJSON(t, retrieve.URL, credentialsRequest{Email: u.Email, Password: "password"}, &token); code != 200 {
+		t.Fatalf("Got %d, want %d", code, 200)
+	}
+	if token.Token != u.Token {
+		t.Errorf("Got token %q, want %q", token.Token, u.Token)
+	}
+
+	p, err := db.SavePushData("title", "body", u.Token, "", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pushes struct {
+		Pushes []db.PushData `json:"pushes"`
+	}
+	req := map[string]string{"token": u.Token, "device": "apidevice"}
+	if code = postJSON(t, pool.URL, req, &pushes); code != 200 {
+		t.Fatalf("Got %d, want %d", code, 200)
+	}
+	if len(pushes.Pushes) != 1 || pushes.Pushes[0].ID != p.ID {
+		t.Errorf("Expected to get push %d, got %v", p.ID, pushes.Pushes)
+	}
+	if code = postJSON(t, pool.URL, req, &pushes); code != 200 {
+		t.Fatalf("Got %d, want %d", code, 200)
+	}
+	if len(pushes.Pushes) != 0 {
+		t.Errorf("Expected no pushes on second pool, got %v", pushes.Pushes)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	create := httptest.NewServer(requireSession(apiHandler(apiKeyCreate)))
+	defer create.Close()
+	list := httptest.NewServer(requireSession(apiHandler(apiKeyList)))
+	defer list.Close()
+	revoke := httptest.NewServer(requireSession(apiHandler(apiKeyRevoke)))
+	defer revoke.Close()
+	push := httptest.NewServer(apiHandler(apiPush))
+	defer push.Close()
+	pool := httptest.NewServer(apiHandler(apiPool))
+	defer pool.Close()
+
+	u, err := db.NewUser("apikeys@user.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+
+	u.Activate()
+	tokens, err := auth.Login(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access := tokens.AccessToken
+
+	var publish apiKey
+	req := map[string]interface{}{"label": "ci", "scopes": []string{"publish"}}
+	if code := postJSONAuth(t, create.URL, access, req, &publish); code != 201 {
+		t.Fatalf("Got %d, want %d", code, 201)
+	}
+	if len(publish.Key) != 36 || publish.Label != "ci" {
+		t.Errorf("Unexpected API key (%v)", publish)
+	}
+
+	var testData = []struct {
+		access       string
+		req          map[string]interface{}
+		expectedCode int
+		expectedErr  string
+	}{
+		{access, map[string]interface{}{}, 400, codeInvalidRequest},
+		{access, map[string]interface{}{"scopes": []string{"admin"}}, 400, codeInvalidRequest},
+		{access, map[string]interface{}{"scopes": []string{"read"}, "expires_in": -1}, 400, codeInvalidRequest},
+		// Token isn't enough for managing API keys
+		{"", map[string]interface{}{"token": u.Token, "scopes": []string{"read"}}, 401, codeInvalidAccessToken},
+		// API keys can't create API keys
+		{publish.Key, map[string]interface{}{"scopes": []string{"read"}}, 401, codeInvalidAccessToken},
+	}
+	for i, data := range testData {
+		var out errorResponse
+		if code := postJSONAuth(t, create.URL, data.access, data.req, &out); code != data.expectedCode {
+			t.Errorf("Got %d, want %d (run %d)", code, data.expectedCode, i)
+		}
+		if out.Error.Code != data.expectedErr {
+			t.Errorf("Got error code %q, want %q (run %d)", out.Error.Code, data.expectedErr, i)
+		}
+	}
+
+	// Publish key can push but not pool
+	var pushed struct {
+		ID int64 `json:"id"`
+	}
+	if code := postJSON(t, push.URL, map[string]interface{}{"token": publish.Key, "title": "title"}, &pushed); code != 201 {
+		t.Errorf("Publish key should be able to push (got %d)", code)
+	}
+	if _, err := db.GetPushData(pushed.ID, u.Token); err != nil {
+		t.Errorf("Push sent with API key should be saved to the token (%v)", err)
+	}
+	var out errorResponse
+	if code := postJSON(t, pool.URL, map[string]interface{}{"token": publish.Key}, &out); code != 403 || out.Error.Code != codeInsufficientScope {
+		t.Errorf("Publish key shouldn't be able to pool (got %d %v)", code, out.Error)
+	}
+
+	// Expired key can't be used
+	k, key, err := db.NewAPIKey(u.Token, "old", []string{db.ScopeRead}, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := postJSON(t, pool.URL, map[string]interface{}{"token": key}, &out); code != 401 || out.Error.Code != codeKeyExpired {
+		t.Errorf("Expired key shouldn't be accepted (got %d %v)", code, out.Error)
+	}
+
+	var keys struct {
+		Keys []apiKey `json:"keys"`
+	}
+	if code := postJSONAuth(t, list.URL, access, struct{}{}, &keys); code != 200 {
+		t.Fatalf("Got %d, want %d", code, 200)
+	}
+	if len(keys.Keys) != 2 || keys.Keys[0].Key != "" || keys.Keys[1].ExpiresAt != k.ExpiresAt.Unix() {
+		t.Errorf("Unexpected keys (%v)", keys.Keys)
+	}
+
+	if code := postJSONAuth(t, revoke.URL, access, map[string]interface{}{"id": publish.ID}, nil); code != 200 {
+		t.Errorf("Got %d, want %d", code, 200)
+	}
+	if code := postJSON(t, push.URL, map[string]interface{}{"token": publish.Key, "title": "title"}, &out); code != 404 {
+		t.Errorf("Revoked key shouldn't be accepted (got %d)", code)
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	mux := http.NewServeMux()
+	registerAPIv1(mux)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	u, err := db.NewUser("apiauth@user.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	u.Activate()
+
+	var out errorResponse
+	if code := postJSON(t, ts.URL+"/api/v1/auth/login/", credentialsRequest{Email: u.Email, Password: "wrongpassword"}, &out); code != 401 {
+		t.Errorf("Got %d, want %d", code, 401)
+	}
+	var tokens auth.Tokens
+	if code := postJSON(t, ts.URL+"/api/v1/auth/login/", credentialsRequest{Email: u.Email, Password: "password"}, &tokens); code != 200 {
+		t.Fatalf("Got %d, want %d", code, 200)
+	}
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" || tokens.TokenType != "Bearer" {
+		t.Fatalf("Unexpected tokens (%v)", tokens)
+	}
+
+	// Management routes need access token, device routes take either
+	out = errorResponse{}
+	if code := postJSON(t, ts.URL+"/api/v1/keys/list/", map[string]string{"token": u.Token}, &out); code != 401 || out.Error.Code != codeInvalidAccessToken {
+		t.Errorf("Got %d %q, want %d %q without access token", code, out.Error.Code, 401, codeInvalidAccessToken)
+	}
+	if code := postJSON(t, ts.URL+"/api/v1/device/", map[string]string{"token": u.Token, "device": "phone"}, nil); code != 200 {
+		t.Errorf("Got %d, want %d for device with token", code, 200)
+	}
+	if code := postJSONAuth(t, ts.URL+"/api/v1/device/", tokens.AccessToken, map[string]string{"device": "laptop"}, nil); code != 200 {
+		t.Errorf("Got %d, want %d for device with access token", code, 200)
+	}
+	var keys struct {
+		Keys []apiKey `json:"keys"`
+	}
+	if code := postJSONAuth(t, ts.URL+"/api/v1/keys/list/", tokens.AccessToken, struct{}{}, &keys); code != 200 {
+		t.Errorf("Got %d, want %d", code, 200)
+	}
+	var created apiKey
+	req := map[string]interface{}{"scopes": []string{"read"}}
+	if code := postJSONAuth(t, ts.URL+"/api/v1/keys/create/", tokens.AccessToken, req, &created); code != 201 {
+		t.Errorf("Got %d, want %d", code, 201)
+	}
+	if len(db.GetAPIKeys(u.Token)) != 1 {
+		t.Errorf("API key was not created for the logged in user")
+	}
+	// Push and pool are not management routes
+	out = errorResponse{}
+	if code := postJSONAuth(t, ts.URL+"/api/v1/pool/", tokens.AccessToken, struct{}{}, &out); code != 404 {
+		t.Errorf("Got %d, want %d", code, 404)
+	}
+
+	var testData = []struct {
+		access       string
+		expectedCode int
+	}{
+		{"invalid", 401},
+		{tokens.AccessToken + "x", 401},
+	}
+	for i, data := range testData {
+		out = errorResponse{}
+		if code := postJSONAuth(t, ts.URL+"/api/v1/keys/list/", data.access, struct{}{}, &out); code != data.expectedCode {
+			t.Errorf("Got %d, want %d (run %d)", code, data.expectedCode, i)
+		}
+		if out.Error.Code != codeInvalidAccessToken {
+			t.Errorf("Got error code %q, want %q (run %d)", out.Error.Code, codeInvalidAccessToken, i)
+		}
+	}
+
+	// Refresh token can be used once
+	var refreshed auth.Tokens
+	if code := postJSON(t, ts.URL+"/api/v1/auth/refresh/", map[string]string{"refresh_token": tokens.RefreshToken}, &refreshed); code != 200 {
+		t.Fatalf("Got %d, want %d", code, 200)
+	}
+	out = errorResponse{}
+	if code := postJSON(t, ts.URL+"/api/v1/auth/refresh/", map[string]string{"refresh_token": tokens.RefreshToken}, &out); code != 401 || out.Error.Code != codeInvalidRefresh {
+		t.Errorf("Got %d %q, want %d %q", code, out.Error.Code, 401, codeInvalidRefresh)
+	}
+
+	// Logout ends the session, so every access token issued for it stops
+	// working
+	if code := postJSONAuth(t, ts.URL+"/api/v1/auth/logout/", refreshed.AccessToken, struct{}{}, nil); code != 200 {
+		t.Errorf("Got %d, want %d", code, 200)
+	}
+	for i, access := range []string{tokens.AccessToken, refreshed.AccessToken} {
+		if code := postJSONAuth(t, ts.URL+"/api/v1/keys/list/", access, struct{}{}, nil); code != 401 {
+			t.Errorf("Got %d, want %d (run %d)", code, 401, i)
+		}
+	}
+	out = errorResponse{}
+	if code := postJSON(t, ts.URL+"/api/v1/auth/refresh/", map[string]string{"refresh_token": refreshed.RefreshToken}, &out); code != 401 {
+		t.Errorf("Refresh after logout: got %d, want %d", code, 401)
+	}
+	if code := postJSON(t, ts.URL+"/api/v1/auth/logout/", struct{}{}, &out); code != 401 {
+		t.Errorf("Logout without access token: got %d, want %d", code, 401)
+	}
+}
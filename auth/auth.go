@@ -0,0 +1,121 @@
+// Package auth issues short-lived access tokens (HS256 JWTs) and refresh
+// tokens for logged in users. Access tokens are tied to a session stored in
+// database, so they stop working as soon as the session is ended.
+package auth
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/vhakulinen/push-server/config"
+	"github.com/vhakulinen/push-server/db"
+	"github.com/vhakulinen/push-server/utils"
+)
+
+var (
+	secret     []byte
+	accessTTL  = 15 * time.Minute
+	refreshTTL = 30 * 24 * time.Hour
+)
+
+// ErrInvalidToken is returned when access token is malformed, expired or its
+// session has ended.
+var ErrInvalidToken = errors.New("Invalid or expired access token")
+
+// Tokens are returned when user logs in or refreshes the session.
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	// ExpiresIn is lifetime of the access token in seconds
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type claims struct {
+	// Subject is the user's ID
+	Subject int64 `json:"sub"`
+	// Session is the session's ID
+	Session   int64 `json:"sid"`
+	IssuedAt  int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+// Login starts new session for u and returns tokens for it.
+func Login(u *db.User) (*Tokens, error) {
+	s, refresh, err := u.NewSession(refreshTTL)
+	if err != nil {
+		return nil, err
+	}
+	return issue(s, refresh)
+}
+
+// Refresh returns new tokens for the session refresh belongs to. refresh
+// can't be used again after this.
+func Refresh(refresh string) (*Tokens, error) {
+	s, refresh, err := db.RefreshSession(refresh, refreshTTL)
+	if err != nil {
+		return nil, err
+	}
+	return issue(s, refresh)
+}
+
+// Verify returns the user and the session access token was issued for.
+func Verify(access string) (*db.User, *db.Session, error) {
+	var c claims
+	if err := utils.VerifyHS256(access, secret, &c); err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= c.ExpiresAt {
+		return nil, nil, ErrInvalidToken
+	}
+	s, err := db.GetSession(c.Session)
+	if err != nil || s.UserID != c.Subject || s.Expired() {
+		return nil, nil, ErrInvalidToken
+	}
+	u, err := db.GetUserByID(c.Subject)
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+	return u, s, nil
+}
+
+func issue(s *db.Session, refresh string) (*Tokens, error) {
+	now := time.Now()
+	access, err := utils.SignHS256(claims{
+		Subject:   s.UserID,
+		Session:   s.ID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(accessTTL).Unix(),
+	}, secret)
+	if err != nil {
+		log.Printf("Failed to sign access token (%v)", err)
+		return nil, err
+	}
+	return &Tokens{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(accessTTL / time.Second),
+	}, nil
+}
+
+// LoadConfig loads this package's configuration from config.Config package
+func LoadConfig() {
+	if s, err := config.Config.String("auth", "secret"); err == nil && s != "" {
+		secret = []byte(s)
+	} else {
+		log.Println("No [auth] secret configured, using random one. Access tokens won't survive restarts.")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Failed to generate auth secret (%v)", err)
+		}
+	}
+	if n, err := config.Config.Int("auth", "accessttl"); err == nil && n > 0 {
+		accessTTL = time.Duration(n) * time.Second
+	}
+	if n, err := config.Config.Int("auth", "refreshttl"); err == nil && n > 0 {
+		refreshTTL = time.Duration(n) * time.Second
+	}
+}
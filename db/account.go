@@ -0,0 +1,163 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// AccountExport is everything stored about user, without secrets (password,
+// token, keys). It's meant to be returned as JSON.
+type AccountExport struct {
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	Active    bool      `json:"active"`
+	// TwoFactor tells if two-factor authentication is enabled
+	TwoFactor bool `json:"two_factor"`
+
+	Pushes   []PushData       `json:"pushes"`
+	Devices  []ExportedDevice `json:"devices"`
+	Webhooks []ExportedHook   `json:"webhooks"`
+	// Topics are the names of topics the user is subscribed to
+	Topics      []string      `json:"topics"`
+	OwnedTopics []string      `json:"owned_topics"`
+	APIKeys     []ExportedKey `json:"api_keys"`
+}
+
+// ExportedDevice is device registered by user in AccountExport. Kind is one
+// of device, gcm, apns and webpush, and ID is the device's name, GCM ID, APNs
+// device token or web push endpoint respectively.
+type ExportedDevice struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+}
+
+// ExportedHook is webhook in AccountExport
+type ExportedHook struct {
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+	Disabled  bool      `json:"disabled"`
+}
+
+// ExportedKey is API key in AccountExport
+type ExportedKey struct {
+	Prefix    string    `json:"prefix"`
+	Label     string    `json:"label"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Export returns everything stored about the user.
+func (u *User) Export() *AccountExport {
+	e := &AccountExport{
+		Email:       u.Email,
+		CreatedAt:   u.CreatedAt,
+		Active:      u.Active,
+		TwoFactor:   u.TOTPEnabled,
+		Pushes:      []PushData{},
+		Devices:     []ExportedDevice{},
+		Webhooks:    []ExportedHook{},
+		Topics:      []string{},
+		OwnedTopics: []string{},
+		APIKeys:     []ExportedKey{},
+	}
+	db.Where("token = ?", u.Token).Order("id").Find(&e.Pushes)
+
+	devices := []Device{}
+	db.Where("token = ?", u.Token).Order("id").Find(&devices)
+	for _, d := range devices {
+		e.Devices = append(e.Devices, ExportedDevice{"device", d.Name})
+	}
+	for _, c := range u.GCMClients {
+		e.Devices = append(e.Devices, ExportedDevice{"gcm", c.GCMId})
+	}
+	for _, c := range u.APNSClients {
+		e.Devices = append(e.Devices, ExportedDevice{"apns", c.DeviceToken})
+	}
+	subs := []WebPushSubscription{}
+	db.Where("token = ?", u.Token).Order("id").Find(&subs)
+	for _, s := range subs {
+		e.Devices = append(e.Devices, ExportedDevice{"webpush", s.Endpoint})
+	}
+
+	// Disabled webhooks too, unlike GetWebhooks
+	hooks := []Webhook{}
+	db.Where("token = ?", u.Token).Order("id").Find(&hooks)
+	for _, w := range hooks {
+		e.Webhooks = append(e.Webhooks, ExportedHook{w.URL, w.CreatedAt, w.Disabled})
+	}
+
+	topics := []Topic{}
+	db.Where("id IN (SELECT topic_id FROM topic_subscriptions WHERE token = ?)", u.Token).Order("name").Find(&topics)
+	for _, t := range topics {
+		e.Topics = append(e.Topics, t.Name)
+	}
+	topics = []Topic{}
+	db.Where("owner = ?", u.Token).Order("name").Find(&topics)
+	for _, t := range topics {
+		e.OwnedTopics = append(e.OwnedTopics, t.Name)
+	}
+
+	for _, k := range GetAPIKeys(u.Token) {
+		e.APIKeys = append(e.APIKeys, ExportedKey{
+			Prefix:    k.Prefix,
+			Label:     k.Label,
+			Scopes:    strings.Split(k.Scopes, ","),
+			CreatedAt: k.CreatedAt,
+			ExpiresAt: k.ExpiresAt,
+		})
+	}
+	return e
+}
+
+// Delete deletes the user for good, along with everything linked to the
+// user's token. Live clients aren't disconnected here.
+func (u *User) Delete() error {
+	const pushes = "SELECT id FROM push_datas WHERE token = ?"
+	const devices = "SELECT id FROM devices WHERE token = ?"
+	const hooks = "SELECT id FROM webhooks WHERE token = ?"
+	const topics = "SELECT id FROM topics WHERE owner = ?"
+
+	// Rows referring to other rows go first
+	deletes := []struct {
+		where string
+		value interface{}
+		model interface{}
+	}{
+		{"push_data_id IN (" + pushes + ")", u.Token, Job{}},
+		{"push_data_id IN (" + pushes + ")", u.Token, Delivery{}},
+		{"device_id IN (" + devices + ")", u.Token, Delivery{}},
+		{"webhook_id IN (" + hooks + ")", u.Token, WebhookDelivery{}},
+		{"topic_id IN (" + topics + ")", u.Token, TopicSubscription{}},
+		{"owner = ?", u.Token, Topic{}},
+		{"token = ?", u.Token, TopicSubscription{}},
+		{"token = ?", u.Token, PushData{}},
+		{"token = ?", u.Token, GCMClient{}},
+		{"token = ?", u.Token, APNSClient{}},
+		{"token = ?", u.Token, Device{}},
+		{"token = ?", u.Token, WebPushSubscription{}},
+		{"token = ?", u.Token, Webhook{}},
+		{"token = ?", u.Token, APIKey{}},
+		{"new_token = ?", u.Token, OldToken{}},
+		{"user_id = ?", u.ID, PasswordReset{}},
+		{"user_id = ?", u.ID, Session{}},
+		{"user_id = ?", u.ID, RecoveryCode{}},
+		{"id = ?", u.ID, User{}},
+	}
+
+	tx := db.Begin()
+	for _, d := range deletes {
+		if err := tx.Unscoped().Where(d.where, d.value).Delete(d.model).Error; err != nil {
+			tx.Rollback()
+			log.Printf("Error in User.Delete() (%v)", err)
+			return fmt.Errorf("Something went wrong!")
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Error in User.Delete() (%v)", err)
+		return fmt.Errorf("Something went wrong!")
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	// Load postgres
@@ -14,16 +15,44 @@ import (
 
 // For testing
 const (
-	userTableTemp   = "user_temp"
-	pushTableTemp   = "push_temp"
-	clientTableTemp = "client_temp"
+	userTableTemp     = "user_temp"
+	pushTableTemp     = "push_temp"
+	clientTableTemp   = "client_temp"
+	deviceTableTemp   = "device_temp"
+	deliveryTableTemp = "delivery_temp"
+	webPushTableTemp  = "webpush_temp"
+	apnsTableTemp     = "apns_temp"
+	webhookTableTemp  = "webhook_temp"
+	whDeliveryTemp    = "webhook_delivery_temp"
+	jobTableTemp      = "job_temp"
+	topicTableTemp    = "topic_temp"
+	topicSubTableTemp = "topic_subscription_temp"
+	apiKeyTableTemp   = "api_key_temp"
+	oldTokenTableTemp = "old_token_temp"
+	resetTableTemp    = "password_reset_temp"
+	sessionTableTemp  = "session_temp"
+	recoveryTableTemp = "recovery_code_temp"
 )
 
 // For testing
 var (
-	restoreUser   = false
-	restorePush   = false
-	restoreClient = false
+	restoreUser     = false
+	restorePush     = false
+	restoreClient   = false
+	restoreDevice   = false
+	restoreDelivery = false
+	restoreWebPush  = false
+	restoreAPNS     = false
+	restoreWebhook  = false
+	restoreHookLog  = false
+	restoreJob      = false
+	restoreTopic    = false
+	restoreTopicSub = false
+	restoreAPIKey   = false
+	restoreOldToken = false
+	restoreReset    = false
+	restoreSession  = false
+	restoreRecovery = false
 )
 
 var db gorm.DB
@@ -44,6 +73,119 @@ func GetGCMClient(id string) (*GCMClient, error) {
 	return g, nil
 }
 
+// GetAPNSClient returns APNSClient object if found with specified device token.
+func GetAPNSClient(deviceToken string) (*APNSClient, error) {
+	a := new(APNSClient)
+	if db.Where("device_token = ?", deviceToken).First(a).RecordNotFound() {
+		return nil, fmt.Errorf("Client not found")
+	}
+	return a, nil
+}
+
+// GetPushData returns PushData object if found with specified id and token.
+func GetPushData(id int64, token string) (*PushData, error) {
+	p := new(PushData)
+	if db.Where("id = ? AND token = ?", id, token).First(p).RecordNotFound() {
+		return nil, fmt.Errorf("Push data not found")
+	}
+	return p, nil
+}
+
+// GetPushDataByID returns PushData object if found with specified id.
+func GetPushDataByID(id int64) (*PushData, error) {
+	p := new(PushData)
+	if db.Where("id = ?", id).First(p).RecordNotFound() {
+		return nil, fmt.Errorf("Push data not found")
+	}
+	return p, nil
+}
+
+// GetWebPushSubscription returns WebPushSubscription object if found with
+// specified endpoint.
+func GetWebPushSubscription(endpoint string) (*WebPushSubscription, error) {
+	s := new(WebPushSubscription)
+	if db.Where("endpoint = ?", endpoint).First(s).RecordNotFound() {
+		return nil, fmt.Errorf("Subscription not found")
+	}
+	return s, nil
+}
+
+// GetWebPushSubscriptions returns WebPushSubscription objects linked to
+// specified token.
+func GetWebPushSubscriptions(token string) []WebPushSubscription {
+	out := []WebPushSubscription{}
+	db.Where("token = ?", token).Find(&out)
+	return out
+}
+
+// GetWebhook returns Webhook object if found with specified token and URL.
+func GetWebhook(token, url string) (*Webhook, error) {
+	w := new(Webhook)
+	if db.Where("token = ? AND url = ?", token, url).First(w).RecordNotFound() {
+		return nil, fmt.Errorf("Webhook not found")
+	}
+	return w, nil
+}
+
+// GetWebhookByID returns Webhook object if found with specified id.
+func GetWebhookByID(id int64) (*Webhook, error) {
+	w := new(Webhook)
+	if db.Where("id = ?", id).First(w).RecordNotFound() {
+		return nil, fmt.Errorf("Webhook not found")
+	}
+	return w, nil
+}
+
+// GetWebhooks returns enabled webhooks of the token.
+func GetWebhooks(token string) []Webhook {
+	out := []Webhook{}
+	db.Where("token = ? AND disabled = ?", token, false).Find(&out)
+	return out
+}
+
+// GetTopic returns Topic object if found with specified name.
+func GetTopic(name string) (*Topic, error) {
+	t := new(Topic)
+	if db.Where("name = ?", name).First(t).RecordNotFound() {
+		return nil, fmt.Errorf("Topic not found")
+	}
+	return t, nil
+}
+
+// GetAPIKey returns APIKey object if found with specified id and token.
+func GetAPIKey(id int64, token string) (*APIKey, error) {
+	k := new(APIKey)
+	if db.Where("id = ? AND token = ?", id, token).First(k).RecordNotFound() {
+		return nil, fmt.Errorf("API key not found")
+	}
+	return k, nil
+}
+
+// GetAPIKeys returns API keys of the token.
+func GetAPIKeys(token string) []APIKey {
+	out := []APIKey{}
+	db.Where("token = ?", token).Order("id").Find(&out)
+	return out
+}
+
+// GetUserByID returns User object if found with specified id.
+func GetUserByID(id int64) (*User, error) {
+	u := new(User)
+	if db.Where("id = ?", id).First(u).RecordNotFound() {
+		return nil, fmt.Errorf("User not found")
+	}
+	return u, nil
+}
+
+// GetSession returns Session object if found with specified id.
+func GetSession(id int64) (*Session, error) {
+	s := new(Session)
+	if db.Where("id = ?", id).First(s).RecordNotFound() {
+		return nil, fmt.Errorf("Session not found")
+	}
+	return s, nil
+}
+
 // GetUser returns User object if found with specified email.
 func GetUser(email string) (*User, error) {
 	u := new(User)
@@ -81,6 +223,22 @@ func GetPushesForToken(token string) []PushData {
 	return out
 }
 
+// GetPushesSinceID returns PushData objects linked to specified token which
+// were saved after the push with specified id.
+func GetPushesSinceID(token string, id int64) []PushData {
+	out := []PushData{}
+	db.Where("token = ? AND id > ?", token, id).Order("id").Find(&out)
+	return out
+}
+
+// GetPushesSinceTime returns PushData objects linked to specified token which
+// were saved after t.
+func GetPushesSinceTime(token string, t time.Time) []PushData {
+	out := []PushData{}
+	db.Where("token = ? AND created_at > ?", token, t).Order("id").Find(&out)
+	return out
+}
+
 // SetupDatabase is just for testing purposes
 func SetupDatabase() gorm.DB {
 	var err error
@@ -108,11 +266,70 @@ func SetupDatabase() gorm.DB {
 		log.Fatal(err)
 	}
 	db.AutoMigrate(&User{})
+	migrateActivateExpires()
 	db.AutoMigrate(&PushData{})
 	db.AutoMigrate(&GCMClient{})
+	db.AutoMigrate(&Device{})
+	migrateDeliveries := !db.HasTable(&Delivery{})
+	db.AutoMigrate(&Delivery{})
+	if migrateDeliveries {
+		migrateAccessedToDeliveries()
+	}
+	db.AutoMigrate(&WebPushSubscription{})
+	db.AutoMigrate(&APNSClient{})
+	db.AutoMigrate(&Webhook{})
+	db.AutoMigrate(&WebhookDelivery{})
+	db.AutoMigrate(&Job{})
+	db.AutoMigrate(&Topic{})
+	db.AutoMigrate(&TopicSubscription{})
+	db.AutoMigrate(&APIKey{})
+	db.AutoMigrate(&OldToken{})
+	db.AutoMigrate(&PasswordReset{})
+	db.AutoMigrate(&Session{})
+	db.AutoMigrate(&RecoveryCode{})
 	return db
 }
 
+// migrateActivateExpires gives activation keys which were issued before
+// they had expiration time ActivateTokenTTL from now, so that users who
+// haven't activated yet can still use the link they got.
+func migrateActivateExpires() {
+	res := db.Model(User{}).Where("active = ? AND activate_token != ? AND activate_expires IS NULL", false, "").
+		UpdateColumn("activate_expires", time.Now().Add(ActivateTokenTTL))
+	if res.Error != nil {
+		log.Printf("Failed to migrate activation keys (%v)", res.Error)
+	} else if res.RowsAffected > 0 {
+		log.Printf("Gave %d old activation keys expiration time", res.RowsAffected)
+	}
+}
+
+// migrateAccessedToDeliveries converts the old PushData.Accessed flags to
+// deliveries of the token's default device.
+func migrateAccessedToDeliveries() {
+	pushes := []PushData{}
+	db.Where("accessed = ?", true).Find(&pushes)
+	devices := make(map[string]*Device)
+	for i := range pushes {
+		p := &pushes[i]
+		d, ok := devices[p.Token]
+		if !ok {
+			var err error
+			d, err = RegisterDevice(DefaultDeviceName, p.Token)
+			if err != nil {
+				log.Printf("Failed to migrate deliveries for push %d (%v)", p.ID, err)
+				continue
+			}
+			devices[p.Token] = d
+		}
+		if err := p.SetDelivered(d); err != nil {
+			log.Printf("Failed to migrate deliveries for push %d (%v)", p.ID, err)
+		}
+	}
+	if len(pushes) > 0 {
+		log.Printf("Migrated %d accessed pushes to deliveries", len(pushes))
+	}
+}
+
 // BackupForTesting creates backup of current database before running tests.
 func BackupForTesting() {
 	if ok := db.HasTable(&User{}); ok {
@@ -130,6 +347,76 @@ func BackupForTesting() {
 		renameTable("gcm_clients", clientTableTemp)
 		db.CreateTable(&GCMClient{})
 	}
+	if ok := db.HasTable(&Device{}); ok {
+		restoreDevice = true
+		renameTable("devices", deviceTableTemp)
+		db.CreateTable(&Device{})
+	}
+	if ok := db.HasTable(&Delivery{}); ok {
+		restoreDelivery = true
+		renameTable("deliveries", deliveryTableTemp)
+		db.CreateTable(&Delivery{})
+	}
+	if ok := db.HasTable(&WebPushSubscription{}); ok {
+		restoreWebPush = true
+		renameTable("web_push_subscriptions", webPushTableTemp)
+		db.CreateTable(&WebPushSubscription{})
+	}
+	if ok := db.HasTable(&APNSClient{}); ok {
+		restoreAPNS = true
+		renameTable("apns_clients", apnsTableTemp)
+		db.CreateTable(&APNSClient{})
+	}
+	if ok := db.HasTable(&Webhook{}); ok {
+		restoreWebhook = true
+		renameTable("webhooks", webhookTableTemp)
+		db.CreateTable(&Webhook{})
+	}
+	if ok := db.HasTable(&WebhookDelivery{}); ok {
+		restoreHookLog = true
+		renameTable("webhook_deliveries", whDeliveryTemp)
+		db.CreateTable(&WebhookDelivery{})
+	}
+	if ok := db.HasTable(&Job{}); ok {
+		restoreJob = true
+		renameTable("jobs", jobTableTemp)
+		db.CreateTable(&Job{})
+	}
+	if ok := db.HasTable(&Topic{}); ok {
+		restoreTopic = true
+		renameTable("topics", topicTableTemp)
+		db.CreateTable(&Topic{})
+	}
+	if ok := db.HasTable(&TopicSubscription{}); ok {
+		restoreTopicSub = true
+		renameTable("topic_subscriptions", topicSubTableTemp)
+		db.CreateTable(&TopicSubscription{})
+	}
+	if ok := db.HasTable(&APIKey{}); ok {
+		restoreAPIKey = true
+		renameTable("api_keys", apiKeyTableTemp)
+		db.CreateTable(&APIKey{})
+	}
+	if ok := db.HasTable(&OldToken{}); ok {
+		restoreOldToken = true
+		renameTable("old_tokens", oldTokenTableTemp)
+		db.CreateTable(&OldToken{})
+	}
+	if ok := db.HasTable(&PasswordReset{}); ok {
+		restoreReset = true
+		renameTable("password_resets", resetTableTemp)
+		db.CreateTable(&PasswordReset{})
+	}
+	if ok := db.HasTable(&Session{}); ok {
+		restoreSession = true
+		renameTable("sessions", sessionTableTemp)
+		db.CreateTable(&Session{})
+	}
+	if ok := db.HasTable(&RecoveryCode{}); ok {
+		restoreRecovery = true
+		renameTable("recovery_codes", recoveryTableTemp)
+		db.CreateTable(&RecoveryCode{})
+	}
 }
 
 // RestoreFromTesting restores the database which was backedup before running tests.
@@ -146,6 +433,62 @@ func RestoreFromTesting() {
 		dropTable("gcm_clients")
 		renameTable(clientTableTemp, "gcm_clients")
 	}
+	if restoreDevice {
+		dropTable("devices")
+		renameTable(deviceTableTemp, "devices")
+	}
+	if restoreDelivery {
+		dropTable("deliveries")
+		renameTable(deliveryTableTemp, "deliveries")
+	}
+	if restoreWebPush {
+		dropTable("web_push_subscriptions")
+		renameTable(webPushTableTemp, "web_push_subscriptions")
+	}
+	if restoreAPNS {
+		dropTable("apns_clients")
+		renameTable(apnsTableTemp, "apns_clients")
+	}
+	if restoreWebhook {
+		dropTable("webhooks")
+		renameTable(webhookTableTemp, "webhooks")
+	}
+	if restoreHookLog {
+		dropTable("webhook_deliveries")
+		renameTable(whDeliveryTemp, "webhook_deliveries")
+	}
+	if restoreJob {
+		dropTable("jobs")
+		renameTable(jobTableTemp, "jobs")
+	}
+	if restoreTopic {
+		dropTable("topics")
+		renameTable(topicTableTemp, "topics")
+	}
+	if restoreTopicSub {
+		dropTable("topic_subscriptions")
+		renameTable(topicSubTableTemp, "topic_subscriptions")
+	}
+	if restoreAPIKey {
+		dropTable("api_keys")
+		renameTable(apiKeyTableTemp, "api_keys")
+	}
+	if restoreOldToken {
+		dropTable("old_tokens")
+		renameTable(oldTokenTableTemp, "old_tokens")
+	}
+	if restoreReset {
+		dropTable("password_resets")
+		renameTable(resetTableTemp, "password_resets")
+	}
+	if restoreSession {
+		dropTable("sessions")
+		renameTable(sessionTableTemp, "sessions")
+	}
+	if restoreRecovery {
+		dropTable("recovery_codes")
+		renameTable(recoveryTableTemp, "recovery_codes")
+	}
 }
 
 func renameTable(from, to string) {
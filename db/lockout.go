@@ -0,0 +1,62 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// LockedFor returns how long the user is still locked out, 0 if not.
+func (u *User) LockedFor() time.Duration {
+	if d := u.LockedUntil.Sub(now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// RecordFailedAttempt counts failed login or activation attempt of the user
+// and returns the number of them in row.
+func (u *User) RecordFailedAttempt() (int64, error) {
+	// Incremented in database, so that parallel attempts are all counted
+	res := db.Exec("UPDATE users SET failed_attempts = failed_attempts + 1 WHERE id = ?", u.ID)
+	if res.Error != nil {
+		log.Printf("Error in RecordFailedAttempt() (%v)", res.Error)
+		return 0, fmt.Errorf("Something went wrong!")
+	}
+	fresh := new(User)
+	if err := db.Where("id = ?", u.ID).First(fresh).Error; err != nil {
+		log.Printf("Error in RecordFailedAttempt() (%v)", err)
+		return 0, fmt.Errorf("Something went wrong!")
+	}
+	u.FailedAttempts = fresh.FailedAttempts
+	return u.FailedAttempts, nil
+}
+
+// LockFor locks the user out for d.
+func (u *User) LockFor(d time.Duration) error {
+	until := now().Add(d)
+	if err := db.Model(User{}).Where("id = ?", u.ID).UpdateColumn("locked_until", until).Error; err != nil {
+		log.Printf("Error in LockFor() (%v)", err)
+		return fmt.Errorf("Something went wrong!")
+	}
+	u.LockedUntil = until
+	return nil
+}
+
+// ResetFailedAttempts clears the user's failed attempts after successful
+// login or activation.
+func (u *User) ResetFailedAttempts() {
+	if u.FailedAttempts == 0 {
+		return
+	}
+	err := db.Model(User{}).Where("id = ?", u.ID).UpdateColumns(map[string]interface{}{
+		"failed_attempts": 0,
+		"locked_until":    time.Time{},
+	}).Error
+	if err != nil {
+		log.Printf("Error in ResetFailedAttempts() (%v)", err)
+		return
+	}
+	u.FailedAttempts = 0
+	u.LockedUntil = time.Time{}
+}
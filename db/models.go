@@ -1,11 +1,16 @@
 package db
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/vhakulinen/push-server/utils"
@@ -18,11 +23,18 @@ import (
 const (
 	// MinPasswordLength specifies the minimiun password length
 	MinPasswordLength = 6
-	// PasswordSaltLength specifies the length of salt used with hashing passwords
+	// PasswordSaltLength specifies the length of salt used with legacy
+	// (SHA-256) password hashes
 	PasswordSaltLength  = 16
-	activateTokenLength = 6
+	activateTokenLength = 32
+	topicKeyLength      = 32
+	// ActivateTokenTTL is how long activation key is valid after it's sent
+	ActivateTokenTTL = 48 * time.Hour
 
 	emailRegexStr = "(\\w[-._\\w]*\\w@\\w[-._\\w]*\\w\\.\\w{2,3})"
+	topicRegexStr = "^[a-z0-9][a-z0-9._-]{0,63}$"
+	// APNs device tokens are 32 bytes, which clients send hex encoded
+	apnsDeviceTokenRegexStr = "^[0-9a-fA-F]{64}$"
 )
 
 // User is the user object mapped in database. Contains all relevant information about user.
@@ -43,15 +55,38 @@ type User struct {
 	// ActivateToken is used to securely activate the user with email. It is added
 	// to the link sent in the activation email
 	ActivateToken string
+	// ActivateExpires is the time after which ActivateToken can't be used
+	ActivateExpires time.Time
 
 	// Email is the email user provoided when he/she registered to this service
 	Email string `sql:"not null;unique"`
+	// PendingEmail is the new email the user has asked to change to. Email is
+	// changed once the link sent to PendingEmail is followed.
+	PendingEmail string
+
+	// TOTPSecret is base32 encoded secret of the user's authenticator. Set
+	// when two-factor authentication is enrolled.
+	TOTPSecret string `gorm:"column:totp_secret"`
+	// TOTPEnabled tells if one-time password is required to log in
+	TOTPEnabled bool `gorm:"column:totp_enabled"`
+	// TOTPLastStep is the time step of the last one-time password used, so
+	// that codes can't be used twice
+	TOTPLastStep int64 `gorm:"column:totp_last_step"`
+	// FailedAttempts is the number of failed logins or activation attempts
+	// in row
+	FailedAttempts int64
+	// LockedUntil is the time until which logging in is refused after too
+	// many failed attempts
+	LockedUntil time.Time
 	// Password is the user's password
 	Password string
 	// Token is the token which is used to push/pool data
 	Token string `sql:"unique"`
 	// GCMClients are the clients registered with GoogleCloudMessaging service to this user
 	GCMClients []GCMClient
+	// APNSClients are the iOS devices registered with Apple Push Notification
+	// service to this user
+	APNSClients []APNSClient
 }
 
 // NewUser creates new user and saves it to database
@@ -62,12 +97,8 @@ func NewUser(email, password string) (*User, error) {
 	} else if len(password) < MinPasswordLength {
 		return nil, fmt.Errorf("Min. password length is %d", MinPasswordLength)
 	}
-	ok, err := regexp.Match(emailRegexStr, []byte(email))
-	if err != nil {
-		log.Printf("Failed to create regex string for email matching! (%v)", err)
-		return nil, fmt.Errorf("Invalid email address")
-	} else if ok == false {
-		return nil, fmt.Errorf("Invalid email address")
+	if err := validateEmail(email); err != nil {
+		return nil, err
 	}
 	if db.Where("email = ?", email).First(u).RecordNotFound() {
 		u = &User{
@@ -84,27 +115,75 @@ func NewUser(email, password string) (*User, error) {
 	return nil, fmt.Errorf("User exists")
 }
 
+func validateEmail(email string) error {
+	ok, err := regexp.Match(emailRegexStr, []byte(email))
+	if err != nil {
+		log.Printf("Failed to create regex string for email matching! (%v)", err)
+		return fmt.Errorf("Invalid email address")
+	} else if ok == false {
+		return fmt.Errorf("Invalid email address")
+	}
+	return nil
+}
+
 // BeforeCreate is function ran by gorm library before the user is created.
 func (u *User) BeforeCreate() error {
 	// Password hashing and salting
 	if len(u.Password) < MinPasswordLength {
 		return errors.New("Password is too short")
 	}
-	salt := utils.RandomString(PasswordSaltLength)
-	b := sha256.Sum256([]byte(u.Password + salt))
-	u.Password = salt + fmt.Sprintf("%x", string(b[:]))
+	hash, err := hashPassword(u.Password)
+	if err != nil {
+		log.Printf("Error in BeforeCreate() (%v)", err)
+		return fmt.Errorf("Something went wrong!")
+	}
+	u.Password = hash
+
+	u.newActivateToken()
+	return nil
+}
+
+// newActivateToken gives the user new activation key valid for
+// ActivateTokenTTL. Doesn't save the user.
+func (u *User) newActivateToken() {
+	u.ActivateToken = utils.RandomStringFrom(utils.Alphanumeric, activateTokenLength)
+	u.ActivateExpires = time.Now().Add(ActivateTokenTTL)
+}
 
-	// Activate token
-	u.ActivateToken = utils.RandomString(activateTokenLength)
+// RenewActivateToken gives the user new activation key valid for
+// ActivateTokenTTL and saves the user.
+func (u *User) RenewActivateToken() error {
+	u.newActivateToken()
+	if err := db.Save(u).Error; err != nil {
+		log.Printf("Error in RenewActivateToken() (%v)", err)
+		return fmt.Errorf("Something went wrong!")
+	}
 	return nil
 }
 
+// ValidActivateToken tells if key is the user's activation key. Expiration
+// is checked separately with ActivateExpired.
+func (u *User) ValidActivateToken(key string) bool {
+	return u.ActivateToken != "" &&
+		subtle.ConstantTimeCompare([]byte(u.ActivateToken), []byte(key)) == 1
+}
+
+// ActivateExpired tells if the user's activation key has expired. Keys
+// issued before expiration was tracked get ActivateTokenTTL from the first
+// start with expiration (see migrateActivateExpires).
+func (u *User) ActivateExpired() bool {
+	return !time.Now().Before(u.ActivateExpires)
+}
+
 // AfterFind is function rab by gorm library after database query is ran
 // agains User table. In this case its used to load data to User object.
 func (u *User) AfterFind() {
 	gcmClients := []GCMClient{}
 	db.Where("token = ?", u.Token).Find(&gcmClients)
 	u.GCMClients = gcmClients
+	apnsClients := []APNSClient{}
+	db.Where("token = ?", u.Token).Find(&apnsClients)
+	u.APNSClients = apnsClients
 }
 
 // Activate activates the user (sets User.Active to true and saves it to database)
@@ -113,36 +192,172 @@ func (u *User) Activate() {
 	db.Save(u)
 }
 
+var (
+	// ErrEmailInUse is returned when changing email to one which another
+	// user already has
+	ErrEmailInUse = errors.New("Email is already in use")
+	// ErrInvalidActivation is returned when activation key is wrong
+	ErrInvalidActivation = errors.New("Invalid activation key")
+	// ErrActivationExpired is returned when activation key has expired
+	ErrActivationExpired = errors.New("Activation key has expired")
+)
+
+// RequestEmailChange sets newEmail as the user's pending email and gives the
+// user new activation key for confirming it. The key is sent to newEmail.
+func (u *User) RequestEmailChange(newEmail string) error {
+	if err := validateEmail(newEmail); err != nil {
+		return err
+	}
+	if !db.Where("email = ?", newEmail).First(new(User)).RecordNotFound() {
+		return ErrEmailInUse
+	}
+	u.PendingEmail = newEmail
+	u.newActivateToken()
+	if err := db.Save(u).Error; err != nil {
+		log.Printf("Error in RequestEmailChange() (%v)", err)
+		return fmt.Errorf("Something went wrong!")
+	}
+	return nil
+}
+
+// ConfirmEmailChange changes email of the user who asked to change to
+// newEmail and was sent key.
+func ConfirmEmailChange(newEmail, key string) (*User, error) {
+	users := []User{}
+	if newEmail != "" {
+		db.Where("pending_email = ?", newEmail).Find(&users)
+	}
+	for i := range users {
+		u := &users[i]
+		if !u.ValidActivateToken(key) {
+			continue
+		}
+		if u.ActivateExpired() {
+			return nil, ErrActivationExpired
+		}
+		if !db.Where("email = ?", newEmail).First(new(User)).RecordNotFound() {
+			return nil, ErrEmailInUse
+		}
+		u.Email = newEmail
+		u.PendingEmail = ""
+		u.ActivateToken = ""
+		// Unique constraint catches the email being taken since the check
+		if err := db.Save(u).Error; err != nil {
+			log.Printf("Error in ConfirmEmailChange() (%v)", err)
+			return nil, ErrEmailInUse
+		}
+		return u, nil
+	}
+	return nil, ErrInvalidActivation
+}
+
 // Save is shortcut to save object to database
 func (u *User) Save() {
 	db.Save(u)
 }
 
+// RotateToken gives the user new token and moves everything linked to the
+// old token to it. If grace is positive, the old token keeps working for
+// that long.
+func (u *User) RotateToken(grace time.Duration) (string, error) {
+	old := u.Token
+	token := uuid.NewRandom().String()
+
+	tx := db.Begin()
+	rollback := func(err error) (string, error) {
+		tx.Rollback()
+		log.Printf("Error in RotateToken() (%v)", err)
+		return "", fmt.Errorf("Something went wrong!")
+	}
+	models := []interface{}{
+		PushData{},
+		GCMClient{},
+		APNSClient{},
+		Device{},
+		WebPushSubscription{},
+		Webhook{},
+		TopicSubscription{},
+		APIKey{},
+	}
+	for _, m := range models {
+		if err := tx.Unscoped().Model(m).Where("token = ?", old).UpdateColumn("token", token).Error; err != nil {
+			return rollback(err)
+		}
+	}
+	if err := tx.Model(Topic{}).Where("owner = ?", old).UpdateColumn("owner", token).Error; err != nil {
+		return rollback(err)
+	}
+	// Tokens rotated before still in their grace period lead to the new one
+	if err := tx.Model(OldToken{}).Where("new_token = ?", old).UpdateColumn("new_token", token).Error; err != nil {
+		return rollback(err)
+	}
+	// Not saving whole user, since that would save the associated clients
+	// with the old token
+	if err := tx.Model(User{}).Where("id = ?", u.ID).UpdateColumn("token", token).Error; err != nil {
+		return rollback(err)
+	}
+	if grace > 0 {
+		err := tx.Save(&OldToken{
+			Token:     old,
+			NewToken:  token,
+			ExpiresAt: time.Now().Add(grace),
+		}).Error
+		if err != nil {
+			return rollback(err)
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Error in RotateToken() (%v)", err)
+		return "", fmt.Errorf("Something went wrong!")
+	}
+	u.Token = token
+	u.AfterFind()
+	return token, nil
+}
+
 // ValidatePassword checks if specified password is the correct password for the user
 func (u *User) ValidatePassword(password string) bool {
-	// TODO: Check that slice is not out of bounds
-	hash := sha256.Sum256([]byte(password + u.Password[:PasswordSaltLength]))
-	if len(u.Password) > PasswordSaltLength+MinPasswordLength {
-		if fmt.Sprintf("%x", hash[:]) == u.Password[PasswordSaltLength:] {
-			return true
-		}
-	} else {
-		log.Println("Invalid password in database (password length is too short)")
+	return checkPassword(password, u.Password)
+}
+
+// NeedsRehash tells if the user's password is stored with an older hashing
+// scheme and should be rehashed with SetPassword on next successful login.
+func (u *User) NeedsRehash() bool {
+	return !strings.HasPrefix(u.Password, argon2Prefix)
+}
+
+// SetPassword hashes password and saves it as the user's new password.
+func (u *User) SetPassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("Min. password length is %d", MinPasswordLength)
 	}
-	return false
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Error in SetPassword() (%v)", err)
+		return fmt.Errorf("Something went wrong!")
+	}
+	if err = db.Model(User{}).Where("id = ?", u.ID).UpdateColumn("password", hash).Error; err != nil {
+		log.Printf("Error in SetPassword() (%v)", err)
+		return fmt.Errorf("Something went wrong!")
+	}
+	u.Password = hash
+	return nil
 }
 
 // PushData is the object mapped on database. This is the object containing
 // the data user may push through to other devices using this service.
 type PushData struct {
-	// ID is the primary key used in databse
-	ID int64 `json:"-"`
+	// ID is the primary key used in databse. Clients use it to acknowledge
+	// pushes
+	ID int64 `json:"id"`
 	// CreatedAt is the date when this user was created in database level
 	CreatedAt time.Time `json:"-"`
 	// DeletedAt is the date when user was /soft/ deleted in database level
 	DeletedAt time.Time `json:"-"`
 
-	// Accessed indicates if this data has already pooled by client (the one user design flaw lies in here)
+	// Accessed indicates if this data has been delivered to the token's
+	// default device. Deliveries are tracked per device with Delivery objects,
+	// this is only kept up to date for backwards compatibility.
 	Accessed bool `json:"-"`
 
 	// UinxTimeStamp is the timestamp which client can specify when sending data
@@ -166,10 +381,19 @@ type PushData struct {
 	// Invalid value defaults to 1
 	Priority int64 `json:"-"`
 	Sound    bool
+	// Topic is the name of the topic the push was published to, empty if it
+	// was sent to the token directly
+	Topic string `json:"topic,omitempty"`
 }
 
 // SavePushData saves push data to the database
 func SavePushData(title, body, token, strurl string, timestamp, priority int64) (p *PushData, err error) {
+	return SaveTopicPushData(title, body, token, strurl, "", timestamp, priority)
+}
+
+// SaveTopicPushData is SavePushData for push sent to topic. The push is saved
+// with the topic's name.
+func SaveTopicPushData(title, body, token, strurl, topic string, timestamp, priority int64) (p *PushData, err error) {
 	if timestamp < 0 {
 		timestamp = 0
 	}
@@ -194,18 +418,27 @@ func SavePushData(title, body, token, strurl string, timestamp, priority int64)
 		Priority:      priority,
 		Sound:         true,
 		URL:           strurl,
+		Topic:         topic,
 	}
 	if err = db.Save(p).Error; err != nil {
-		fmt.Printf("%v", err)
+		log.Printf("Error in SavePushData() (%v)", err)
 		return nil, err
 	}
 	return p, nil
 }
 
-// SetAccessed sets Accessed property to true and saves it to database
+// SetAccessed sets Accessed property to true and saves it to database. Only
+// the flag is written, since p may be a stale copy of the row.
 func (p *PushData) SetAccessed() {
 	p.Accessed = true
-	p.Save()
+	db.Model(p).UpdateColumn("accessed", true)
+}
+
+// SetSilent sets Sound property to false and saves only that column to
+// database, so that flags set meanwhile by other clients are kept.
+func (p *PushData) SetSilent() {
+	p.Sound = false
+	db.Model(p).UpdateColumn("sound", false)
 }
 
 // Save is shortcut to save data to database
@@ -234,6 +467,9 @@ type GCMClient struct {
 
 	GCMId string `sql:"not null;unique" gorm:"column:gcm_id"`
 	Token string `sql:"not null"`
+	// DeviceID is the device which this GCM client pools data as. Zero if
+	// the client isn't linked to any device
+	DeviceID int64
 }
 
 // RegisterGCMClient registers new GoogleCloudMessaging client associating with user
@@ -256,7 +492,7 @@ func RegisterGCMClient(gcmID, token string) (*GCMClient, error) {
 		return g, nil
 	} else if g.Token == u.Token {
 		// Same token as before, so let it be
-		return nil, nil
+		return g, nil
 	} else {
 		// If the client has already registered, update the token
 		// But before that, delete the GCMClient from the old token's client list
@@ -275,6 +511,8 @@ func RegisterGCMClient(gcmID, token string) (*GCMClient, error) {
 			}
 		}
 		g.Token = token
+		// Device belongs to the old token
+		g.DeviceID = 0
 		g.Save()
 		u.GCMClients = append(u.GCMClients, *g)
 		u.Save()
@@ -292,7 +530,959 @@ func (g *GCMClient) Save() {
 	db.Save(g)
 }
 
+// SetDevice links the GCM client to device d
+func (g *GCMClient) SetDevice(d *Device) error {
+	if d.Token != g.Token {
+		return fmt.Errorf("Device doesn't belong to GCM client's token")
+	}
+	g.DeviceID = d.ID
+	g.Save()
+	return nil
+}
+
+// Device returns the device which the GCM client is linked to.
+func (g *GCMClient) Device() (*Device, error) {
+	d := new(Device)
+	if g.DeviceID == 0 || db.Where("id = ?", g.DeviceID).First(d).RecordNotFound() {
+		return nil, fmt.Errorf("Device not found")
+	}
+	return d, nil
+}
+
 // Delete is shortcut to delete object from database
 func (g *GCMClient) Delete() {
 	db.Delete(g)
 }
+
+// APNSClient is object mapped in database. Holds device tokens of iOS devices
+// registered with Apple Push Notification service by user
+type APNSClient struct {
+	ID int64
+
+	DeviceToken string `sql:"not null;unique"`
+	Token       string `sql:"not null"`
+}
+
+// ErrInvalidDeviceToken is returned when APNs device token isn't hex
+// encoded 32 bytes
+var ErrInvalidDeviceToken = errors.New("Invalid device token")
+
+// RegisterAPNSClient registers new APNs device associating it with user
+// through specified token. If the device was registered to another token
+// before, it's moved to this one.
+func RegisterAPNSClient(deviceToken, token string) (*APNSClient, error) {
+	if ok, _ := regexp.MatchString(apnsDeviceTokenRegexStr, deviceToken); !ok {
+		return nil, ErrInvalidDeviceToken
+	}
+	if !TokenExists(token) {
+		return nil, fmt.Errorf("Token not found")
+	}
+	a := new(APNSClient)
+	db.Where("device_token = ?", deviceToken).First(a)
+	a.DeviceToken = deviceToken
+	a.Token = token
+	if err := db.Save(a).Error; err != nil {
+		log.Printf("Error in RegisterAPNSClient() (%v)", err)
+		return nil, fmt.Errorf("Something went wrong!")
+	}
+	return a, nil
+}
+
+// TableName is function used with gorm library
+func (a APNSClient) TableName() string {
+	return "apns_clients"
+}
+
+// Delete is shortcut to delete object from database
+func (a *APNSClient) Delete() {
+	db.Delete(a)
+}
+
+// DefaultDeviceName is the name of the device used when client doesn't
+// identify itself with a device name. Deliveries tracked with the old
+// PushData.Accessed flag are migrated to this device.
+const DefaultDeviceName = "default"
+
+// Device is object mapped in database. Each client of the user (e.g. laptop,
+// phone) should use its own device, so that every one of them receives every
+// push once.
+type Device struct {
+	ID        int64
+	CreatedAt time.Time
+
+	Name  string `sql:"not null"`
+	Token string `sql:"not null"`
+}
+
+// RegisterDevice returns device with name under specified token. The device
+// is created if it doesn't exist yet.
+func RegisterDevice(name, token string) (*Device, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Device name required")
+	}
+	if !TokenExists(token) {
+		return nil, fmt.Errorf("Token not found")
+	}
+	d := new(Device)
+	if db.Where("token = ? AND name = ?", token, name).First(d).RecordNotFound() {
+		d = &Device{
+			Name:  name,
+			Token: token,
+		}
+		if err := db.Save(d).Error; err != nil {
+			log.Printf("Error in RegisterDevice() (%v)", err)
+			return nil, fmt.Errorf("Something went wrong!")
+		}
+	}
+	return d, nil
+}
+
+// GetDevice returns Device object if found with specified name and token.
+func GetDevice(name, token string) (*Device, error) {
+	d := new(Device)
+	if db.Where("token = ? AND name = ?", token, name).First(d).RecordNotFound() {
+		return nil, fmt.Errorf("Device not found")
+	}
+	return d, nil
+}
+
+// UndeliveredPushes returns PushData objects of the device's token which
+// haven't been delivered to the device yet. Pushes which have been sent but
+// not acknowledged are considered undelivered.
+//
+// Pushes sent before the device was registered are included on purpose.
+// Devices are registered implicitly when client first pools or connects with
+// them, so new device catches up on the token's stored pushes like a client
+// pooling for the first time always has.
+func (d *Device) UndeliveredPushes() []PushData {
+	out := []PushData{}
+	db.Where("token = ? AND id NOT IN (SELECT push_data_id FROM deliveries WHERE device_id = ? AND pending = ?)",
+		d.Token, d.ID, false).Order("id").Find(&out)
+	return out
+}
+
+// UnackedPushes returns PushData objects which have been sent to the device
+// but which the device hasn't acknowledged.
+func (d *Device) UnackedPushes() []PushData {
+	out := []PushData{}
+	db.Where("token = ? AND id IN (SELECT push_data_id FROM deliveries WHERE device_id = ? AND pending = ?)",
+		d.Token, d.ID, true).Order("id").Find(&out)
+	return out
+}
+
+// Delete deletes the device, its deliveries and GCM clients linked to it
+func (d *Device) Delete() {
+	db.Where("device_id = ?", d.ID).Delete(Delivery{})
+	db.Where("device_id = ?", d.ID).Delete(GCMClient{})
+	db.Delete(d)
+}
+
+// Delivery is object mapped in database. It records that PushData has been
+// delivered to Device.
+type Delivery struct {
+	ID        int64
+	CreatedAt time.Time
+
+	PushDataID int64 `sql:"not null"`
+	DeviceID   int64 `sql:"not null"`
+	// Pending is true when the push has been sent to the device but the
+	// device hasn't acknowledged it yet
+	Pending bool
+}
+
+// TableName is function used with gorm library
+func (d Delivery) TableName() string {
+	return "deliveries"
+}
+
+// SetDelivered records that the push data has been delivered to device d
+// (and acknowledged by it, if the channel supports acknowledging).
+func (p *PushData) SetDelivered(d *Device) error {
+	if d.Token != p.Token {
+		return fmt.Errorf("Device doesn't belong to push data's token")
+	}
+	if d.Name == DefaultDeviceName && !p.Accessed {
+		// Keep the old flag in sync for anyone still looking at it
+		p.SetAccessed()
+	}
+	delivery := new(Delivery)
+	if db.Where("push_data_id = ? AND device_id = ?", p.ID, d.ID).First(delivery).RecordNotFound() {
+		delivery = &Delivery{
+			PushDataID: p.ID,
+			DeviceID:   d.ID,
+		}
+		return db.Save(delivery).Error
+	} else if delivery.Pending {
+		delivery.Pending = false
+		return db.Save(delivery).Error
+	}
+	return nil
+}
+
+// SetSent records that the push data has been sent to device d, but it
+// hasn't acknowledged it yet. Does nothing if the push was already delivered.
+func (p *PushData) SetSent(d *Device) error {
+	if d.Token != p.Token {
+		return fmt.Errorf("Device doesn't belong to push data's token")
+	}
+	delivery := new(Delivery)
+	if db.Where("push_data_id = ? AND device_id = ?", p.ID, d.ID).First(delivery).RecordNotFound() {
+		delivery = &Delivery{
+			PushDataID: p.ID,
+			DeviceID:   d.ID,
+			Pending:    true,
+		}
+		return db.Save(delivery).Error
+	}
+	return nil
+}
+
+// DeliveredTo returns boolean indicating if the push data has been delivered
+// to device d.
+func (p *PushData) DeliveredTo(d *Device) bool {
+	return !db.Where("push_data_id = ? AND device_id = ? AND pending = ?",
+		p.ID, d.ID, false).First(&Delivery{}).RecordNotFound()
+}
+
+// WebPushSubscription is object mapped in database. Holds push subscriptions
+// of browsers registered by user.
+type WebPushSubscription struct {
+	ID int64
+
+	Endpoint string `sql:"not null;unique"`
+	// P256dh is browser's public key, base64url encoded
+	P256dh string `sql:"not null"`
+	// Auth is authentication secret, base64url encoded
+	Auth  string `sql:"not null"`
+	Token string `sql:"not null"`
+}
+
+// RegisterWebPushSubscription registers new web push subscription associating
+// it with user through specified token. Existing subscription with the same
+// endpoint is updated.
+func RegisterWebPushSubscription(endpoint, p256dh, auth, token string) (*WebPushSubscription, error) {
+	if endpoint == "" || p256dh == "" || auth == "" {
+		return nil, fmt.Errorf("Endpoint, p256dh and auth required")
+	}
+	// Push services are always behind https
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return nil, fmt.Errorf("Endpoint must be https URL")
+	}
+	if !utils.WebhookHostAllowed(u.Hostname()) {
+		return nil, utils.ErrWebPushAddress
+	}
+	if !TokenExists(token) {
+		return nil, fmt.Errorf("Token not found")
+	}
+	s := new(WebPushSubscription)
+	db.Where("endpoint = ?", endpoint).First(s)
+	s.Endpoint = endpoint
+	s.P256dh = p256dh
+	s.Auth = auth
+	s.Token = token
+	if err := db.Save(s).Error; err != nil {
+		log.Printf("Error in RegisterWebPushSubscription() (%v)", err)
+		return nil, fmt.Errorf("Something went wrong!")
+	}
+	return s, nil
+}
+
+// TableName is function used with gorm library
+func (s WebPushSubscription) TableName() string {
+	return "web_push_subscriptions"
+}
+
+// Delete is shortcut to delete object from database
+func (s *WebPushSubscription) Delete() {
+	db.Delete(s)
+}
+
+// Webhook is object mapped in database. Pushes of the token are POSTed to URL
+// signed with Secret.
+type Webhook struct {
+	ID        int64
+	CreatedAt time.Time
+
+	URL    string `sql:"not null"`
+	Secret string `sql:"not null"`
+	Token  string `sql:"not null"`
+	// Failures is the number of consecutive pushes which couldn't be
+	// delivered to the webhook
+	Failures int64
+	// Disabled webhooks don't get pushes. Webhook is disabled after too many
+	// failures and enabled again by registering it again.
+	Disabled bool
+}
+
+// RegisterWebhook registers new webhook associating it with user through
+// specified token. Registering existing webhook updates its secret and
+// enables it again.
+func RegisterWebhook(rawurl, secret, token string) (*Webhook, error) {
+	if rawurl == "" || secret == "" {
+		return nil, fmt.Errorf("URL and secret required")
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, fmt.Errorf("Invalid URL")
+	}
+	if !utils.WebhookHostAllowed(u.Hostname()) {
+		return nil, utils.ErrWebhookAddress
+	}
+	if !TokenExists(token) {
+		return nil, fmt.Errorf("Token not found")
+	}
+	w := new(Webhook)
+	db.Where("token = ? AND url = ?", token, rawurl).First(w)
+	w.URL = rawurl
+	w.Secret = secret
+	w.Token = token
+	w.Failures = 0
+	w.Disabled = false
+	if err := db.Save(w).Error; err != nil {
+		log.Printf("Error in RegisterWebhook() (%v)", err)
+		return nil, fmt.Errorf("Something went wrong!")
+	}
+	return w, nil
+}
+
+// TableName is function used with gorm library
+func (w Webhook) TableName() string {
+	return "webhooks"
+}
+
+// Delete deletes the webhook and its delivery log
+func (w *Webhook) Delete() {
+	db.Where("webhook_id = ?", w.ID).Delete(WebhookDelivery{})
+	db.Delete(w)
+}
+
+// LogDelivery records attempt to deliver push to the webhook. statusCode is
+// zero if no response was received.
+func (w *Webhook) LogDelivery(p *PushData, attempt, statusCode int64, deliveryErr error) *WebhookDelivery {
+	d := &WebhookDelivery{
+		WebhookID:  w.ID,
+		PushDataID: p.ID,
+		Attempt:    attempt,
+		StatusCode: statusCode,
+		Success:    deliveryErr == nil,
+	}
+	if deliveryErr != nil {
+		d.Error = deliveryErr.Error()
+	}
+	db.Save(d)
+	return d
+}
+
+// Delivered resets the webhook's failure count.
+func (w *Webhook) Delivered() {
+	if w.Failures != 0 {
+		w.Failures = 0
+		db.Save(w)
+	}
+}
+
+// Failed increases the webhook's failure count and disables it once it
+// reaches maxFailures. Returns true if the webhook got disabled.
+func (w *Webhook) Failed(maxFailures int64) bool {
+	w.Failures++
+	if w.Failures >= maxFailures {
+		w.Disabled = true
+	}
+	db.Save(w)
+	return w.Disabled
+}
+
+// Deliveries returns the delivery log of the webhook, newest first.
+func (w *Webhook) Deliveries() []WebhookDelivery {
+	out := []WebhookDelivery{}
+	db.Where("webhook_id = ?", w.ID).Order("id desc").Find(&out)
+	return out
+}
+
+// WebhookDelivery is object mapped in database. It records an attempt to
+// deliver PushData to Webhook.
+type WebhookDelivery struct {
+	ID        int64
+	CreatedAt time.Time
+
+	WebhookID  int64 `sql:"not null"`
+	PushDataID int64 `sql:"not null"`
+	// Attempt is the number of the try, starting from 1
+	Attempt    int64
+	StatusCode int64
+	Success    bool
+	Error      string
+}
+
+// TableName is function used with gorm library
+func (d WebhookDelivery) TableName() string {
+	return "webhook_deliveries"
+}
+
+// Job states
+const (
+	// JobPending jobs are waiting to be run at RunAt
+	JobPending = "pending"
+	// JobRunning jobs are being run by a worker
+	JobRunning = "running"
+	// JobDead jobs failed too many times and won't be retried
+	JobDead = "dead"
+)
+
+// Job is object mapped in database. It's a queued delivery of PushData to
+// one client (Target) of a delivery channel (Channel). Jobs are deleted once
+// they are done.
+type Job struct {
+	ID        int64
+	CreatedAt time.Time
+
+	Channel    string `sql:"not null"`
+	PushDataID int64  `sql:"not null"`
+	// Target identifies the client in the channel, e.g. FCM registration token
+	Target string
+	State  string `sql:"not null"`
+	// Attempts is the number of times the job has been run
+	Attempts int64
+	// RunAt is the earliest time the job should be run
+	RunAt     time.Time
+	LastError string
+}
+
+// EnqueueJob saves new pending job which is run right away.
+func EnqueueJob(channel string, pushID int64, target string) (*Job, error) {
+	j := &Job{
+		Channel:    channel,
+		PushDataID: pushID,
+		Target:     target,
+		State:      JobPending,
+		RunAt:      time.Now(),
+	}
+	if err := db.Save(j).Error; err != nil {
+		log.Printf("Error in EnqueueJob() (%v)", err)
+		return nil, fmt.Errorf("Something went wrong!")
+	}
+	return j, nil
+}
+
+// ClaimJob returns the oldest pending job which is due and marks it running.
+// Returns nil if there is no such job. Jobs must be claimed from only one
+// goroutine at the time.
+func ClaimJob() *Job {
+	j := new(Job)
+	if db.Where("state = ? AND run_at <= ?", JobPending, time.Now()).Order("id").First(j).RecordNotFound() {
+		return nil
+	}
+	j.State = JobRunning
+	j.Attempts++
+	db.Save(j)
+	return j
+}
+
+// ResetRunningJobs marks running jobs pending again. Used on startup, since
+// any job left running was interrupted.
+func ResetRunningJobs() {
+	db.Model(Job{}).Where("state = ?", JobRunning).Update("state", JobPending)
+}
+
+// GetJobs returns jobs which are in specified state.
+func GetJobs(state string) []Job {
+	out := []Job{}
+	db.Where("state = ?", state).Order("id").Find(&out)
+	return out
+}
+
+// TableName is function used with gorm library
+func (j Job) TableName() string {
+	return "jobs"
+}
+
+// Done deletes the job.
+func (j *Job) Done() {
+	db.Delete(j)
+}
+
+// Retry marks the job to be run again at time at.
+func (j *Job) Retry(err error, at time.Time) {
+	j.State = JobPending
+	j.LastError = err.Error()
+	j.RunAt = at
+	db.Save(j)
+}
+
+// Dead marks the job dead, so it isn't run anymore.
+func (j *Job) Dead(err error) {
+	j.State = JobDead
+	j.LastError = err.Error()
+	db.Save(j)
+}
+
+// Topic is object mapped in database. Pushes published to topic are sent to
+// every token subscribed to it.
+type Topic struct {
+	ID        int64
+	CreatedAt time.Time
+
+	Name string `sql:"not null;unique"`
+	// Owner is the token which created the topic. Only the owner can push
+	// to the topic.
+	Owner string `sql:"not null"`
+	// SubscribeKeyHash is SHA-256 of the key the owner hands out to let
+	// others subscribe to the topic
+	SubscribeKeyHash string `sql:"not null"`
+}
+
+// CreateTopic creates new topic owned by token. The owner is subscribed to
+// the topic. Returns the topic and the key needed for subscribing to it,
+// which is only available here.
+func CreateTopic(name, token string) (*Topic, string, error) {
+	if ok, _ := regexp.MatchString(topicRegexStr, name); !ok {
+		return nil, "", fmt.Errorf("Invalid topic name")
+	}
+	if !TokenExists(token) {
+		return nil, "", fmt.Errorf("Token not found")
+	}
+	t := new(Topic)
+	if !db.Where("name = ?", name).First(t).RecordNotFound() {
+		return nil, "", fmt.Errorf("Topic exists")
+	}
+	key := utils.RandomStringFrom(utils.Alphanumeric, topicKeyLength)
+	t = &Topic{
+		Name:             name,
+		Owner:            token,
+		SubscribeKeyHash: hashSecret(key),
+	}
+	if err := db.Save(t).Error; err != nil {
+		log.Printf("Error in CreateTopic() (%v)", err)
+		return nil, "", fmt.Errorf("Something went wrong!")
+	}
+	if err := t.Subscribe(token); err != nil {
+		return nil, "", err
+	}
+	return t, key, nil
+}
+
+// ValidSubscribeKey tells if key is the topic's subscribe key.
+func (t *Topic) ValidSubscribeKey(key string) bool {
+	return key != "" && subtle.ConstantTimeCompare([]byte(hashSecret(key)), []byte(t.SubscribeKeyHash)) == 1
+}
+
+// TableName is function used with gorm library
+func (t Topic) TableName() string {
+	return "topics"
+}
+
+// Delete deletes the topic and its subscriptions
+func (t *Topic) Delete() {
+	db.Where("topic_id = ?", t.ID).Delete(TopicSubscription{})
+	db.Delete(t)
+}
+
+// Subscribe subscribes token to the topic.
+func (t *Topic) Subscribe(token string) error {
+	if !TokenExists(token) {
+		return fmt.Errorf("Token not found")
+	}
+	if t.IsSubscribed(token) {
+		return nil
+	}
+	s := &TopicSubscription{
+		TopicID: t.ID,
+		Token:   token,
+	}
+	if err := db.Save(s).Error; err != nil {
+		log.Printf("Error in Topic.Subscribe() (%v)", err)
+		return fmt.Errorf("Something went wrong!")
+	}
+	return nil
+}
+
+// Unsubscribe removes token's subscription to the topic.
+func (t *Topic) Unsubscribe(token string) {
+	db.Where("topic_id = ? AND token = ?", t.ID, token).Delete(TopicSubscription{})
+}
+
+// IsSubscribed tells whether token is subscribed to the topic.
+func (t *Topic) IsSubscribed(token string) bool {
+	return !db.Where("topic_id = ? AND token = ?", t.ID, token).First(&TopicSubscription{}).RecordNotFound()
+}
+
+// Subscribers returns tokens subscribed to the topic.
+func (t *Topic) Subscribers() []string {
+	subs := []TopicSubscription{}
+	db.Where("topic_id = ?", t.ID).Order("id").Find(&subs)
+	tokens := make([]string, len(subs))
+	for i, s := range subs {
+		tokens[i] = s.Token
+	}
+	return tokens
+}
+
+// TopicSubscription is object mapped in database. It subscribes token to
+// Topic.
+type TopicSubscription struct {
+	ID        int64
+	CreatedAt time.Time
+
+	TopicID int64  `sql:"not null"`
+	Token   string `sql:"not null"`
+}
+
+// TableName is function used with gorm library
+func (s TopicSubscription) TableName() string {
+	return "topic_subscriptions"
+}
+
+// API key scopes
+const (
+	// ScopePublish allows sending pushes
+	ScopePublish = "publish"
+	// ScopeRead allows reading pushes (pool and live clients)
+	ScopeRead = "read"
+	// ScopeDevice allows registering devices and push clients
+	ScopeDevice = "device"
+
+	// API keys are as long as tokens so that TCP clients can use them too
+	apiKeyPrefix = "key_"
+)
+
+var (
+	// ErrTokenNotFound is returned when credential is neither token nor
+	// API key
+	ErrTokenNotFound = errors.New("Token not found")
+	// ErrKeyExpired is returned when API key has expired
+	ErrKeyExpired = errors.New("API key expired")
+	// ErrInsufficientScope is returned when API key doesn't have the scope
+	// required for the action
+	ErrInsufficientScope = errors.New("API key doesn't have required scope")
+)
+
+// APIKey is object mapped in database. API keys can be used in place of the
+// user's token, but only for the actions their scopes allow.
+type APIKey struct {
+	ID        int64
+	CreatedAt time.Time
+
+	// KeyHash is SHA-256 of the key. The key itself is only shown when it's
+	// created.
+	KeyHash string `sql:"not null;unique"`
+	// Prefix is the beginning of the key, for telling keys apart
+	Prefix string
+	Token  string `sql:"not null"`
+	Label  string
+	// Scopes is comma separated list of scopes
+	Scopes string
+	// ExpiresAt is the time the key expires, zero if it doesn't
+	ExpiresAt time.Time
+}
+
+// NewAPIKey creates new API key for token and returns it along with the key.
+func NewAPIKey(token, label string, scopes []string, expiresAt time.Time) (*APIKey, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("Scopes required")
+	}
+	for _, scope := range scopes {
+		if scope != ScopePublish && scope != ScopeRead && scope != ScopeDevice {
+			return nil, "", fmt.Errorf("Invalid scope %q", scope)
+		}
+	}
+	if !TokenExists(token) {
+		return nil, "", ErrTokenNotFound
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Error in NewAPIKey() (%v)", err)
+		return nil, "", fmt.Errorf("Something went wrong!")
+	}
+	key := apiKeyPrefix + hex.EncodeToString(b)
+	k := &APIKey{
+		KeyHash:   hashSecret(key),
+		Prefix:    key[:len(apiKeyPrefix)+6],
+		Token:     token,
+		Label:     label,
+		Scopes:    strings.Join(scopes, ","),
+		ExpiresAt: expiresAt,
+	}
+	if err := db.Save(k).Error; err != nil {
+		log.Printf("Error in NewAPIKey() (%v)", err)
+		return nil, "", fmt.Errorf("Something went wrong!")
+	}
+	return k, key, nil
+}
+
+func hashSecret(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// TableName is function used with gorm library
+func (k APIKey) TableName() string {
+	return "api_keys"
+}
+
+// HasScope tells whether the key has scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range strings.Split(k.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired tells whether the key has expired.
+func (k *APIKey) Expired() bool {
+	return !k.ExpiresAt.IsZero() && time.Now().After(k.ExpiresAt)
+}
+
+// Delete is shortcut to delete object from database
+func (k *APIKey) Delete() {
+	db.Delete(k)
+}
+
+// ResolveToken returns the user token which credential grants access to
+// for action requiring scope. Credential can be the token itself (or rotated
+// token in its grace period), which has every scope, or API key. Empty scope means only the token is accepted.
+func ResolveToken(credential, scope string) (string, error) {
+	token, _, _, err := ResolveCredential(credential, scope)
+	return token, err
+}
+
+// ResolveCredential is ResolveToken which also returns the API key or the
+// rotated token, if credential was one.
+func ResolveCredential(credential, scope string) (string, *APIKey, *OldToken, error) {
+	if credential == "" {
+		return "", nil, nil, ErrTokenNotFound
+	}
+	if TokenExists(credential) {
+		return credential, nil, nil, nil
+	}
+	o := new(OldToken)
+	if !db.Where("token = ? AND expires_at > ?", credential, time.Now()).First(o).RecordNotFound() {
+		return o.NewToken, nil, o, nil
+	}
+	if !strings.HasPrefix(credential, apiKeyPrefix) {
+		return "", nil, nil, ErrTokenNotFound
+	}
+	k := new(APIKey)
+	if db.Where("key_hash = ?", hashSecret(credential)).First(k).RecordNotFound() {
+		return "", nil, nil, ErrTokenNotFound
+	}
+	if k.Expired() {
+		return "", nil, nil, ErrKeyExpired
+	}
+	if scope == "" || !k.HasScope(scope) {
+		return "", nil, nil, ErrInsufficientScope
+	}
+	return k.Token, k, nil, nil
+}
+
+// OldToken is object mapped in database. It keeps rotated token working
+// until ExpiresAt.
+type OldToken struct {
+	ID        int64
+	CreatedAt time.Time
+
+	Token     string `sql:"not null;unique"`
+	NewToken  string `sql:"not null"`
+	ExpiresAt time.Time
+}
+
+// TableName is function used with gorm library
+func (o OldToken) TableName() string {
+	return "old_tokens"
+}
+
+// ErrInvalidResetKey is returned when password reset key doesn't exist, has
+// been used already or has expired.
+var ErrInvalidResetKey = errors.New("Invalid or expired reset key")
+
+// PasswordResetTTL is how long password reset key is valid after it's sent
+const PasswordResetTTL = time.Hour
+
+// PasswordResetMaxOTPFailures is how many wrong one-time passwords can be
+// given with password reset key before the key is deleted
+const PasswordResetMaxOTPFailures = 3
+
+// PasswordReset is object mapped in database. It's created when user asks to
+// reset forgotten password, and deleted once the password is reset.
+type PasswordReset struct {
+	ID        int64
+	CreatedAt time.Time
+
+	// KeyHash is SHA-256 of the key sent by email
+	KeyHash   string `sql:"not null;unique"`
+	UserID    int64  `sql:"not null"`
+	ExpiresAt time.Time
+	// OTPFailures is how many wrong one-time passwords were given with the
+	// key
+	OTPFailures int64
+}
+
+// TableName is function used with gorm library
+func (r PasswordReset) TableName() string {
+	return "password_resets"
+}
+
+// NewPasswordReset creates new password reset for the user and returns the
+// key to be sent to the user.
+func (u *User) NewPasswordReset() (string, error) {
+	key := utils.RandomStringFrom(utils.Alphanumeric, 32)
+	r := &PasswordReset{
+		KeyHash:   hashSecret(key),
+		UserID:    u.ID,
+		ExpiresAt: time.Now().Add(PasswordResetTTL),
+	}
+	if err := db.Save(r).Error; err != nil {
+		log.Printf("Error in NewPasswordReset() (%v)", err)
+		return "", fmt.Errorf("Something went wrong!")
+	}
+	return key, nil
+}
+
+// getPasswordReset returns unexpired password reset of key and the user it
+// was issued to.
+func getPasswordReset(key string) (*PasswordReset, *User, error) {
+	r := new(PasswordReset)
+	if key == "" || db.Where("key_hash = ?", hashSecret(key)).First(r).RecordNotFound() {
+		return nil, nil, ErrInvalidResetKey
+	}
+	if !time.Now().Before(r.ExpiresAt) {
+		return nil, nil, ErrInvalidResetKey
+	}
+	u := new(User)
+	if db.Where("id = ?", r.UserID).First(u).RecordNotFound() {
+		return nil, nil, ErrInvalidResetKey
+	}
+	return r, u, nil
+}
+
+// GetPasswordResetUser returns the user password reset key was issued to.
+func GetPasswordResetUser(key string) (*User, error) {
+	_, u, err := getPasswordReset(key)
+	return u, err
+}
+
+// ResetPassword sets password of the user key was issued to. Users with
+// two-factor authentication must give otp too. The key, and any other reset
+// keys of the user, can't be used after this. The key is also deleted after
+// PasswordResetMaxOTPFailures wrong one-time passwords.
+func ResetPassword(key, password, otp string) (*User, error) {
+	if len(password) < MinPasswordLength {
+		return nil, fmt.Errorf("Min. password length is %d", MinPasswordLength)
+	}
+	r, u, err := getPasswordReset(key)
+	if err != nil {
+		return nil, err
+	}
+	// Email alone isn't enough to take over account with second factor
+	if err := u.CheckOTP(otp); err == ErrInvalidOTP {
+		r.otpFailed()
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	// The key is consumed before anything else, so that only one of
+	// concurrent requests with it gets through
+	if res := db.Where("key_hash = ?", r.KeyHash).Delete(PasswordReset{}); res.Error != nil || res.RowsAffected != 1 {
+		return nil, ErrInvalidResetKey
+	}
+	if err := u.SetPassword(password); err != nil {
+		return nil, err
+	}
+	db.Where("user_id = ?", u.ID).Delete(PasswordReset{})
+	// Whoever knew the old password shouldn't stay logged in, and the
+	// user shouldn't stay locked out by their failed attempts
+	u.DeleteSessions()
+	u.ResetFailedAttempts()
+	return u, nil
+}
+
+// otpFailed counts wrong one-time password given with the reset, and deletes
+// the reset after too many of them.
+func (r *PasswordReset) otpFailed() {
+	// Incremented in database, so that parallel attempts are all counted
+	res := db.Exec("UPDATE password_resets SET otp_failures = otp_failures + 1 WHERE id = ?", r.ID)
+	if res.Error != nil {
+		log.Printf("Error in otpFailed() (%v)", res.Error)
+		return
+	}
+	res = db.Where("id = ? AND otp_failures >= ?", r.ID, PasswordResetMaxOTPFailures).Delete(PasswordReset{})
+	if res.Error != nil {
+		log.Printf("Error in otpFailed() (%v)", res.Error)
+	}
+}
+
+// ErrInvalidRefreshToken is returned when refresh token doesn't exist or has
+// expired.
+var ErrInvalidRefreshToken = errors.New("Invalid or expired refresh token")
+
+// Session is object mapped in database. It's created when user logs in, and
+// access tokens issued for it work until it's deleted (logout) or expires.
+type Session struct {
+	ID        int64
+	CreatedAt time.Time
+
+	UserID int64 `sql:"not null"`
+	// RefreshHash is SHA-256 of the session's current refresh token. Refresh
+	// token is replaced every time it's used.
+	RefreshHash string `sql:"not null;unique"`
+	ExpiresAt   time.Time
+}
+
+// TableName is function used with gorm library
+func (s Session) TableName() string {
+	return "sessions"
+}
+
+// NewSession creates new session for the user valid for ttl and returns it
+// along with its refresh token.
+func (u *User) NewSession(ttl time.Duration) (*Session, string, error) {
+	refresh := utils.RandomStringFrom(utils.Alphanumeric, 43)
+	s := &Session{
+		UserID:      u.ID,
+		RefreshHash: hashSecret(refresh),
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+	if err := db.Save(s).Error; err != nil {
+		log.Printf("Error in NewSession() (%v)", err)
+		return nil, "", fmt.Errorf("Something went wrong!")
+	}
+	return s, refresh, nil
+}
+
+// RefreshSession replaces refresh token of the session it belongs to and
+// extends the session by ttl. Returns the session and its new refresh token.
+func RefreshSession(refresh string, ttl time.Duration) (*Session, string, error) {
+	s := new(Session)
+	if refresh == "" || db.Where("refresh_hash = ?", hashSecret(refresh)).First(s).RecordNotFound() {
+		return nil, "", ErrInvalidRefreshToken
+	}
+	if s.Expired() {
+		s.Delete()
+		return nil, "", ErrInvalidRefreshToken
+	}
+	refresh = utils.RandomStringFrom(utils.Alphanumeric, 43)
+	s.RefreshHash = hashSecret(refresh)
+	s.ExpiresAt = time.Now().Add(ttl)
+	if err := db.Save(s).Error; err != nil {
+		log.Printf("Error in RefreshSession() (%v)", err)
+		return nil, "", fmt.Errorf("Something went wrong!")
+	}
+	return s, refresh, nil
+}
+
+// Expired tells if the session has expired
+func (s *Session) Expired() bool {
+	return !time.Now().Before(s.ExpiresAt)
+}
+
+// Delete deletes the session, ending it
+func (s *Session) Delete() {
+	db.Delete(s)
+}
+
+// DeleteSessions ends every session of the user
+func (u *User) DeleteSessions() {
+	db.Where("user_id = ?", u.ID).Delete(Session{})
+}
@@ -1,11 +1,16 @@
 package db
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/vhakulinen/push-server/config"
+	"github.com/vhakulinen/push-server/utils"
 )
 
 func TestMain(m *testing.M) {
@@ -70,6 +75,25 @@ func TestNewUser(t *testing.T) {
 	}
 }
 
+func TestMigrateActivateExpires(t *testing.T) {
+	u, err := NewUser("legacyactivation@domain.com", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Activation keys issued by older versions have no expiration time
+	if err = db.Model(User{}).Where("id = ?", u.ID).UpdateColumn("activate_expires", nil).Error; err != nil {
+		t.Fatal(err)
+	}
+	migrateActivateExpires()
+	u, err = GetUser(u.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ActivateExpired() {
+		t.Errorf("Old activation key should get grace period")
+	}
+}
+
 func TestValidatePassword(t *testing.T) {
 	// Use these values to create the user
 	const email = "user@domain.com"
@@ -91,6 +115,48 @@ func TestValidatePassword(t *testing.T) {
 	db.Unscoped().Delete(u)
 }
 
+func TestLegacyPassword(t *testing.T) {
+	const pass = "legacyPassword"
+
+	u, err := NewUser("legacypass@domain.com", pass)
+	if err != nil {
+		t.Fatalf("Couldn't create user! (%v)", err)
+	}
+	if !strings.HasPrefix(u.Password, "$argon2id$") || u.NeedsRehash() {
+		t.Errorf("New password should be hashed with argon2id, got %s", u.Password)
+	}
+
+	// salt + sha256(password + salt), the way passwords used to be stored
+	salt := "0123456789abcdef"
+	sum := sha256.Sum256([]byte(pass + salt))
+	u.Password = salt + hex.EncodeToString(sum[:])
+	if !u.NeedsRehash() {
+		t.Errorf("Legacy password should need rehash")
+	}
+	if !u.ValidatePassword(pass) {
+		t.Errorf("Legacy password should validate")
+	}
+	if u.ValidatePassword("wrongPassword") {
+		t.Errorf("Wrong password validated against legacy hash")
+	}
+
+	if err = u.SetPassword(pass); err != nil {
+		t.Fatalf("Failed to set password! (%v)", err)
+	}
+	u, _ = GetUser("legacypass@domain.com")
+	if u.NeedsRehash() || !u.ValidatePassword(pass) {
+		t.Errorf("Password was not rehashed (%s)", u.Password)
+	}
+
+	// Malformed hashes must not validate (or panic)
+	for _, hash := range []string{"", "short", "$argon2id$", "$argon2id$v=19$m=1,t=1,p=1$!!$!!"} {
+		u.Password = hash
+		if u.ValidatePassword(pass) {
+			t.Errorf("Malformed hash %q validated", hash)
+		}
+	}
+}
+
 func TestSavePushData(t *testing.T) {
 	u, err := NewUser("save@pushdata.com", "password")
 	if err != nil {
@@ -205,6 +271,525 @@ func TestToJson(t *testing.T) {
 	if v.URL != uri {
 		t.Errorf("Urls didn't match! (%v != %v)", uri, v.URL)
 	}
+	fields := map[string]interface{}{}
+	json.Unmarshal(b, &fields)
+	if fields["id"] != float64(pushdata.ID) {
+		t.Errorf("Expected id %d, got %v", pushdata.ID, fields["id"])
+	}
+	if _, ok := fields["topic"]; ok {
+		t.Errorf("Topic shouldn't be sent for push without topic")
+	}
 
 	db.Unscoped().Delete(pushdata)
 }
+
+func TestDeliveries(t *testing.T) {
+	u, err := NewUser("deliveries@domain.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user! (%v)", err)
+	}
+	p, err := SavePushData("title", "body", u.Token, "", 0, 1)
+	if err != nil {
+		t.Fatalf("Failed to create push data! (%v)", err)
+	}
+
+	laptop, err := RegisterDevice("laptop", u.Token)
+	if err != nil {
+		t.Fatalf("Failed to register device! (%v)", err)
+	}
+	phone, err := RegisterDevice("phone", u.Token)
+	if err != nil {
+		t.Fatalf("Failed to register device! (%v)", err)
+	}
+	if again, _ := RegisterDevice("laptop", u.Token); again == nil || again.ID != laptop.ID {
+		t.Errorf("Registering same device twice should return the existing device")
+	}
+	if _, err = RegisterDevice("laptop", "invalidtoken"); err == nil {
+		t.Errorf("Was expecting error with invalid token and didn't get one")
+	}
+
+	if n := len(laptop.UndeliveredPushes()); n != 1 {
+		t.Errorf("Expected 1 undelivered push, got %d", n)
+	}
+	if err = p.SetDelivered(laptop); err != nil {
+		t.Fatal(err)
+	}
+	if !p.DeliveredTo(laptop) || p.DeliveredTo(phone) {
+		t.Errorf("Push should be delivered only to laptop")
+	}
+	if n := len(laptop.UndeliveredPushes()); n != 0 {
+		t.Errorf("Expected 0 undelivered pushes for laptop, got %d", n)
+	}
+	if n := len(phone.UndeliveredPushes()); n != 1 {
+		t.Errorf("Expected 1 undelivered push for phone, got %d", n)
+	}
+	if p.Accessed {
+		t.Errorf("Only delivery to default device should set Accessed")
+	}
+
+	// Sent but unacknowledged push is still undelivered
+	if err = p.SetSent(phone); err != nil {
+		t.Fatal(err)
+	}
+	if p.DeliveredTo(phone) {
+		t.Errorf("Push shouldn't be delivered to phone before it's acknowledged")
+	}
+	if n := len(phone.UnackedPushes()); n != 1 {
+		t.Errorf("Expected 1 unacknowledged push for phone, got %d", n)
+	}
+	if err = p.SetDelivered(phone); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(phone.UnackedPushes()); n != 0 {
+		t.Errorf("Expected 0 unacknowledged pushes for phone, got %d", n)
+	}
+	if n := len(phone.UndeliveredPushes()); n != 0 {
+		t.Errorf("Expected 0 undelivered pushes for phone, got %d", n)
+	}
+
+	// Delivering stale copy to the default device doesn't undo changes
+	// made to the push after the copy was taken
+	stale := *p
+	p.Sound = false
+	p.Save()
+	def, err := RegisterDevice(DefaultDeviceName, u.Token)
+	if err != nil {
+		t.Fatalf("Failed to register device! (%v)", err)
+	}
+	if err = stale.SetDelivered(def); err != nil {
+		t.Fatal(err)
+	}
+	saved := new(PushData)
+	db.Where("id = ?", p.ID).First(saved)
+	if !saved.Accessed || saved.Sound {
+		t.Errorf("Got Accessed %v and Sound %v, want true and false", saved.Accessed, saved.Sound)
+	}
+
+	laptop.Delete()
+	phone.Delete()
+	def.Delete()
+	db.Unscoped().Delete(p)
+	db.Unscoped().Delete(u)
+}
+
+func TestTopics(t *testing.T) {
+	owner, err := NewUser("topicowner@domain.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user! (%v)", err)
+	}
+	other, err := NewUser("topicother@domain.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user! (%v)", err)
+	}
+
+	var testData = []struct {
+		name         string
+		token        string
+		expectingErr bool
+	}{
+		{"ci-builds", owner.Token, false},
+		{"ci-builds", other.Token, true}, // Exists
+		{"alerts.prod_1", owner.Token, false},
+		{"Alerts", owner.Token, true},
+		{"", owner.Token, true},
+		{"-alerts", owner.Token, true},
+		{"alerts prod", owner.Token, true},
+		{"topic", "invalidtoken", true},
+	}
+	for _, data := range testData {
+		_, _, err := CreateTopic(data.name, data.token)
+		if data.expectingErr && err == nil {
+			t.Errorf("Was expecting error with topic %q and didn't get one", data.name)
+		} else if !data.expectingErr && err != nil {
+			t.Errorf("Wasn't expecting error with topic %q but got one (%v)", data.name, err)
+		}
+	}
+
+	topic, err := GetTopic("ci-builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !topic.IsSubscribed(owner.Token) || topic.IsSubscribed(other.Token) {
+		t.Errorf("Only owner should be subscribed to new topic")
+	}
+	if err = topic.Subscribe(other.Token); err != nil {
+		t.Fatal(err)
+	}
+	// Subscribing twice doesn't duplicate the subscription
+	topic.Subscribe(other.Token)
+	if subs := topic.Subscribers(); len(subs) != 2 || subs[0] != owner.Token || subs[1] != other.Token {
+		t.Errorf("Unexpected subscribers (%v)", subs)
+	}
+	if err = topic.Subscribe("invalidtoken"); err == nil {
+		t.Errorf("Was expecting error with invalid token and didn't get one")
+	}
+
+	topic.Unsubscribe(owner.Token)
+	if subs := topic.Subscribers(); len(subs) != 1 || subs[0] != other.Token {
+		t.Errorf("Unexpected subscribers after unsubscribing (%v)", subs)
+	}
+
+	keyed, key, err := CreateTopic("keyed", owner.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keyed.ValidSubscribeKey(key) || keyed.ValidSubscribeKey("") || keyed.ValidSubscribeKey("wrongkey") {
+		t.Errorf("Only the key from CreateTopic should be valid")
+	}
+	keyed.Delete()
+
+	p, err := SaveTopicPushData("title", "body", other.Token, "", "ci-builds", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := new(PushData)
+	db.Where("id = ?", p.ID).First(saved)
+	if saved.Topic != "ci-builds" {
+		t.Errorf("Got topic %q, want %q", saved.Topic, "ci-builds")
+	}
+	db.Unscoped().Delete(p)
+
+	topic.Delete()
+	if _, err = GetTopic("ci-builds"); err == nil {
+		t.Errorf("Topic should be deleted")
+	}
+	if topic.IsSubscribed(other.Token) {
+		t.Errorf("Subscriptions should be deleted with the topic")
+	}
+}
+
+func TestResolveToken(t *testing.T) {
+	u, err := NewUser("resolvetoken@domain.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user! (%v)", err)
+	}
+	_, key, err := NewAPIKey(u.Token, "", []string{ScopePublish, ScopeDevice}, time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to create API key! (%v)", err)
+	}
+	_, expired, err := NewAPIKey(u.Token, "", []string{ScopeRead}, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("Failed to create API key! (%v)", err)
+	}
+
+	var testData = []struct {
+		credential  string
+		scope       string
+		expectedErr error
+	}{
+		{u.Token, ScopeRead, nil},
+		{u.Token, "", nil},
+		{key, ScopePublish, nil},
+		{key, ScopeDevice, nil},
+		{key, ScopeRead, ErrInsufficientScope},
+		{key, "", ErrInsufficientScope},
+		{expired, ScopeRead, ErrKeyExpired},
+		{"key_doesntexist", ScopeRead, ErrTokenNotFound},
+		{"", ScopeRead, ErrTokenNotFound},
+	}
+	for i, data := range testData {
+		token, err := ResolveToken(data.credential, data.scope)
+		if err != data.expectedErr {
+			t.Errorf("Got error %v, want %v (run %d)", err, data.expectedErr, i)
+		}
+		if err == nil && token != u.Token {
+			t.Errorf("Got token %s, want %s (run %d)", token, u.Token, i)
+		}
+	}
+}
+
+func TestRotateToken(t *testing.T) {
+	u, err := NewUser("rotatetoken@domain.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user! (%v)", err)
+	}
+	old := u.Token
+	p, err := SavePushData("title", "body", old, "", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = RegisterGCMClient("rotatetokengcm", old); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := u.RotateToken(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to rotate token! (%v)", err)
+	}
+	if token == old || u.Token != token {
+		t.Fatalf("Token was not rotated (old %s, new %s, user %s)", old, token, u.Token)
+	}
+	if _, err = GetPushData(p.ID, token); err != nil {
+		t.Errorf("Push data was not moved to new token (%v)", err)
+	}
+	if c, err := GetGCMClient("rotatetokengcm"); err != nil || c.Token != token {
+		t.Errorf("GCM client was not moved to new token (%v)", err)
+	}
+	if resolved, err := ResolveToken(old, ScopeRead); err != nil || resolved != token {
+		t.Errorf("Old token should resolve during grace period (got %s, %v)", resolved, err)
+	}
+
+	// Without grace the previous token stops working right away
+	prev := token
+	if token, err = u.RotateToken(0); err != nil {
+		t.Fatalf("Failed to rotate token! (%v)", err)
+	}
+	if _, err = ResolveToken(prev, ScopeRead); err != ErrTokenNotFound {
+		t.Errorf("Got error %v, want %v", err, ErrTokenNotFound)
+	}
+	// Old token from the first rotation follows the user to the newest token
+	if resolved, err := ResolveToken(old, ScopeRead); err != nil || resolved != token {
+		t.Errorf("Old token should resolve to newest token (got %s, %v)", resolved, err)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	u, err := NewUser("passwordreset@domain.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user! (%v)", err)
+	}
+	expired, err := u.NewPasswordReset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Model(PasswordReset{}).Where("key_hash = ?", hashSecret(expired)).UpdateColumn("expires_at", time.Now().Add(-time.Second))
+	other, err := u.NewPasswordReset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := u.NewPasswordReset()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ResetPassword(expired, "newpassword", ""); err != ErrInvalidResetKey {
+		t.Errorf("Got error %v, want %v", err, ErrInvalidResetKey)
+	}
+	reset, err := ResetPassword(key, "newpassword", "")
+	if err != nil {
+		t.Fatalf("Failed to reset password (%v)", err)
+	}
+	if reset.ID != u.ID || !reset.ValidatePassword("newpassword") {
+		t.Errorf("Password of the wrong user was reset")
+	}
+	// Resetting removes every other key of the user too
+	if _, err = ResetPassword(other, "otherpassword", ""); err != ErrInvalidResetKey {
+		t.Errorf("Got error %v, want %v", err, ErrInvalidResetKey)
+	}
+
+	// Key works only once even if it's used concurrently, and reset clears
+	// the lockout
+	u.RecordFailedAttempt()
+	u.LockFor(time.Hour)
+	key, err = u.NewPasswordReset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan error)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := ResetPassword(key, "concurrentpassword", "")
+			results <- err
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < 5; i++ {
+		if err := <-results; err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("Key was used %d times, want 1", succeeded)
+	}
+	reset, _ = GetUser(u.Email)
+	if reset.FailedAttempts != 0 || reset.LockedFor() != 0 {
+		t.Errorf("Reset didn't clear failed attempts")
+	}
+}
+
+func TestConfirmEmailChange(t *testing.T) {
+	u, err := NewUser("confirmchange@domain.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user! (%v)", err)
+	}
+	if err = u.RequestEmailChange("changed@domain.com"); err != nil {
+		t.Fatalf("Failed to request email change (%v)", err)
+	}
+	key := u.ActivateToken
+
+	// Address gets taken before the change is confirmed
+	taken, err := NewUser("changed@domain.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ConfirmEmailChange("changed@domain.com", key); err != ErrEmailInUse {
+		t.Errorf("Got error %v, want %v", err, ErrEmailInUse)
+	}
+	db.Unscoped().Delete(taken)
+
+	db.Model(User{}).Where("id = ?", u.ID).UpdateColumn("activate_expires", time.Now().Add(-time.Second))
+	if _, err = ConfirmEmailChange("changed@domain.com", key); err != ErrActivationExpired {
+		t.Errorf("Got error %v, want %v", err, ErrActivationExpired)
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	fixed := time.Unix(1500000000, 0)
+	now = func() time.Time { return fixed }
+	defer func() { now = time.Now }()
+
+	u, err := NewUser("totp@domain.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user! (%v)", err)
+	}
+	// Without two-factor authentication any code passes
+	if err = u.CheckOTP(""); err != nil {
+		t.Errorf("Got error %v, want nil", err)
+	}
+
+	secret, uri, err := u.EnrollTOTP()
+	if err != nil {
+		t.Fatalf("Failed to enroll (%v)", err)
+	}
+	if !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("URI %s doesn't have the secret", uri)
+	}
+	if _, err = u.ConfirmTOTP("000000"); err != ErrInvalidOTP {
+		t.Errorf("Got error %v, want %v", err, ErrInvalidOTP)
+	}
+	code, _ := utils.TOTP(secret, utils.TOTPStep(fixed))
+	codes, err := u.ConfirmTOTP(code)
+	if err != nil {
+		t.Fatalf("Failed to confirm (%v)", err)
+	}
+	if len(codes) != recoveryCodeCount || u.RecoveryCodesLeft() != recoveryCodeCount {
+		t.Errorf("Got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	u, _ = GetUser(u.Email)
+	if !u.TOTPEnabled {
+		t.Fatalf("Two-factor authentication wasn't enabled")
+	}
+	if err = u.CheckOTP(""); err != ErrOTPRequired {
+		t.Errorf("Got error %v, want %v", err, ErrOTPRequired)
+	}
+	// Code used for confirming can't be used again
+	if err = u.CheckOTP(code); err != ErrInvalidOTP {
+		t.Errorf("Got error %v, want %v", err, ErrInvalidOTP)
+	}
+
+	fixed = fixed.Add(utils.TOTPPeriod * time.Second)
+	code, _ = utils.TOTP(secret, utils.TOTPStep(fixed))
+	if err = u.CheckOTP(code); err != nil {
+		t.Errorf("Got error %v, want nil", err)
+	}
+	if err = u.CheckOTP(code); err != ErrInvalidOTP {
+		t.Errorf("Got error %v, want %v", err, ErrInvalidOTP)
+	}
+
+	if err = u.CheckOTP(strings.ToUpper(codes[0])); err != nil {
+		t.Errorf("Got error %v, want nil", err)
+	}
+	if err = u.CheckOTP(codes[0]); err != ErrInvalidOTP {
+		t.Errorf("Got error %v, want %v", err, ErrInvalidOTP)
+	}
+	if n := u.RecoveryCodesLeft(); n != recoveryCodeCount-1 {
+		t.Errorf("Got %d recovery codes left, want %d", n, recoveryCodeCount-1)
+	}
+
+	// Password reset needs the second factor too, and the key survives
+	// attempt without it
+	key, err := u.NewPasswordReset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ResetPassword(key, "newpassword", ""); err != ErrOTPRequired {
+		t.Errorf("Got error %v, want %v", err, ErrOTPRequired)
+	}
+	if _, err = ResetPassword(key, "newpassword", codes[1]); err != nil {
+		t.Errorf("Failed to reset password (%v)", err)
+	}
+	// Key is deleted after too many wrong one-time passwords
+	key, err = u.NewPasswordReset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < PasswordResetMaxOTPFailures; i++ {
+		if _, err = ResetPassword(key, "newpassword", "wrongcode"); err != ErrInvalidOTP {
+			t.Errorf("Got error %v, want %v (attempt %d)", err, ErrInvalidOTP, i)
+		}
+	}
+	if _, err = ResetPassword(key, "newpassword", codes[2]); err != ErrInvalidResetKey {
+		t.Errorf("Got error %v, want %v after wrong one-time passwords", err, ErrInvalidResetKey)
+	}
+
+	if err = u.DisableTOTP(); err != nil {
+		t.Fatalf("Failed to disable (%v)", err)
+	}
+	u, _ = GetUser(u.Email)
+	if u.TOTPEnabled || u.TOTPSecret != "" || u.RecoveryCodesLeft() != 0 {
+		t.Errorf("Two-factor authentication wasn't disabled")
+	}
+}
+
+func TestFailedAttempts(t *testing.T) {
+	fixed := time.Unix(1500000000, 0)
+	now = func() time.Time { return fixed }
+	defer func() { now = time.Now }()
+
+	u, err := NewUser("failedattempts@domain.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user! (%v)", err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		n, err := u.RecordFailedAttempt()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != i {
+			t.Errorf("Got %d failed attempts, want %d", n, i)
+		}
+	}
+	if d := u.LockedFor(); d != 0 {
+		t.Errorf("Got %v, want 0 before locking", d)
+	}
+
+	if err = u.LockFor(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	u, _ = GetUser(u.Email)
+	if d := u.LockedFor(); d != time.Minute {
+		t.Errorf("Got %v, want %v", d, time.Minute)
+	}
+	fixed = fixed.Add(time.Minute)
+	if d := u.LockedFor(); d != 0 {
+		t.Errorf("Got %v, want 0 after lockout", d)
+	}
+
+	u.ResetFailedAttempts()
+	u, _ = GetUser(u.Email)
+	if u.FailedAttempts != 0 || !u.LockedUntil.IsZero() {
+		t.Errorf("Failed attempts weren't reset")
+	}
+}
+
+func TestRegisterWebhookPrivate(t *testing.T) {
+	u, err := NewUser("webhookprivate@domain.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user! (%v)", err)
+	}
+	for _, rawurl := range []string{
+		"http://localhost/hook",
+		"http://127.0.0.1:8080/hook",
+		"http://10.0.0.1/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/hook",
+	} {
+		if _, err = RegisterWebhook(rawurl, "secret", u.Token); err != utils.ErrWebhookAddress {
+			t.Errorf("Got error %v, want %v for %s", err, utils.ErrWebhookAddress, rawurl)
+		}
+	}
+	if _, err = RegisterWebhook("https://example.com/hook", "secret", u.Token); err != nil {
+		t.Errorf("Didn't expect error and got one! (%v)", err)
+	}
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters used for new password hashes. Hashes store the
+// parameters they were made with, so these can be changed without breaking
+// existing passwords.
+const (
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+
+	argon2Prefix = "$argon2id$"
+)
+
+// hashPassword returns password hashed with argon2id, encoded as
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version,
+		argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches the encoded hash. Besides
+// argon2id hashes, it understands the legacy salt + sha256(password + salt)
+// format.
+func checkPassword(password, encoded string) bool {
+	if !strings.HasPrefix(encoded, argon2Prefix) {
+		return checkLegacyPassword(password, encoded)
+	}
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	// argon2 panics with zero rounds or threads
+	if time < 1 || threads < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(hash) == 0 {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(key, hash) == 1
+}
+
+func checkLegacyPassword(password, encoded string) bool {
+	if len(encoded) != PasswordSaltLength+sha256.Size*2 {
+		return false
+	}
+	salt := encoded[:PasswordSaltLength]
+	hash := sha256.Sum256([]byte(password + salt))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(encoded[PasswordSaltLength:])) == 1
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/vhakulinen/push-server/utils"
+)
+
+const (
+	totpIssuer = "push-serv"
+	// recoveryCodeCount is how many recovery codes user gets when enabling
+	// two-factor authentication
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+// now is the clock used for one-time passwords and lockouts, replaced in
+// tests
+var now = time.Now
+
+var (
+	// ErrOTPRequired is returned when user has two-factor authentication
+	// enabled and no one-time password was given
+	ErrOTPRequired = errors.New("One-time password required")
+	// ErrInvalidOTP is returned when one-time password is wrong or has been
+	// used already
+	ErrInvalidOTP = errors.New("Invalid one-time password")
+)
+
+// RecoveryCode is object mapped in database. Recovery codes can be used once
+// in place of one-time password, e.g. when the authenticator is lost.
+type RecoveryCode struct {
+	ID     int64
+	UserID int64 `sql:"not null"`
+	// CodeHash is SHA-256 of the code
+	CodeHash string `sql:"not null"`
+}
+
+// TableName is function used with gorm library
+func (c RecoveryCode) TableName() string {
+	return "recovery_codes"
+}
+
+// EnrollTOTP gives the user new TOTP secret and returns it along with
+// provisioning URI for authenticator apps. Two-factor authentication is
+// enabled once ConfirmTOTP is called with code from the authenticator.
+func (u *User) EnrollTOTP() (string, string, error) {
+	if u.TOTPEnabled {
+		return "", "", fmt.Errorf("Two-factor authentication is already enabled")
+	}
+	secret, err := utils.NewTOTPSecret()
+	if err != nil {
+		log.Printf("Error in EnrollTOTP() (%v)", err)
+		return "", "", fmt.Errorf("Something went wrong!")
+	}
+	if err = db.Model(User{}).Where("id = ?", u.ID).UpdateColumn("totp_secret", secret).Error; err != nil {
+		log.Printf("Error in EnrollTOTP() (%v)", err)
+		return "", "", fmt.Errorf("Something went wrong!")
+	}
+	u.TOTPSecret = secret
+	return secret, utils.TOTPURI(secret, u.Email, totpIssuer), nil
+}
+
+// ConfirmTOTP enables two-factor authentication if code is valid for the
+// secret from EnrollTOTP. Returns recovery codes, which are only shown here.
+func (u *User) ConfirmTOTP(code string) ([]string, error) {
+	if u.TOTPEnabled {
+		return nil, fmt.Errorf("Two-factor authentication is already enabled")
+	}
+	if u.TOTPSecret == "" {
+		return nil, fmt.Errorf("Two-factor authentication is not enrolled")
+	}
+	step, ok := utils.ValidateTOTP(u.TOTPSecret, code, now())
+	if !ok {
+		return nil, ErrInvalidOTP
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	tx := db.Begin()
+	rollback := func(err error) ([]string, error) {
+		tx.Rollback()
+		log.Printf("Error in ConfirmTOTP() (%v)", err)
+		return nil, fmt.Errorf("Something went wrong!")
+	}
+	if err := tx.Where("user_id = ?", u.ID).Delete(RecoveryCode{}).Error; err != nil {
+		return rollback(err)
+	}
+	for i := range codes {
+		codes[i] = strings.ToLower(utils.RandomStringFrom(utils.Alphanumeric, recoveryCodeLength))
+		if err := tx.Save(&RecoveryCode{UserID: u.ID, CodeHash: hashSecret(codes[i])}).Error; err != nil {
+			return rollback(err)
+		}
+	}
+	err := tx.Model(User{}).Where("id = ?", u.ID).UpdateColumns(map[string]interface{}{
+		"totp_enabled":   true,
+		"totp_last_step": step,
+	}).Error
+	if err != nil {
+		return rollback(err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Error in ConfirmTOTP() (%v)", err)
+		return nil, fmt.Errorf("Something went wrong!")
+	}
+	u.TOTPEnabled = true
+	u.TOTPLastStep = step
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off and removes the user's
+// recovery codes.
+func (u *User) DisableTOTP() error {
+	if !u.TOTPEnabled {
+		return fmt.Errorf("Two-factor authentication is not enabled")
+	}
+	db.Where("user_id = ?", u.ID).Delete(RecoveryCode{})
+	err := db.Model(User{}).Where("id = ?", u.ID).UpdateColumns(map[string]interface{}{
+		"totp_enabled":   false,
+		"totp_secret":    "",
+		"totp_last_step": 0,
+	}).Error
+	if err != nil {
+		log.Printf("Error in DisableTOTP() (%v)", err)
+		return fmt.Errorf("Something went wrong!")
+	}
+	u.TOTPEnabled = false
+	u.TOTPSecret = ""
+	return nil
+}
+
+// CheckOTP checks the second factor of user logging in. It always passes if
+// the user doesn't have two-factor authentication enabled. code can be
+// one-time password from the authenticator or unused recovery code. Neither
+// can be used twice.
+func (u *User) CheckOTP(code string) error {
+	if !u.TOTPEnabled {
+		return nil
+	}
+	if code == "" {
+		return ErrOTPRequired
+	}
+	if len(code) == utils.TOTPDigits {
+		step, ok := utils.ValidateTOTP(u.TOTPSecret, code, now())
+		if !ok || step <= u.TOTPLastStep {
+			return ErrInvalidOTP
+		}
+		// Only one login can claim the step
+		res := db.Model(User{}).Where("id = ? AND totp_last_step < ?", u.ID, step).UpdateColumn("totp_last_step", step)
+		if res.Error != nil || res.RowsAffected != 1 {
+			return ErrInvalidOTP
+		}
+		u.TOTPLastStep = step
+		return nil
+	}
+	c := new(RecoveryCode)
+	hash := hashSecret(strings.ToLower(strings.TrimSpace(code)))
+	if db.Where("user_id = ? AND code_hash = ?", u.ID, hash).First(c).RecordNotFound() {
+		return ErrInvalidOTP
+	}
+	if res := db.Delete(c); res.Error != nil || res.RowsAffected != 1 {
+		return ErrInvalidOTP
+	}
+	return nil
+}
+
+// RecoveryCodesLeft returns the number of unused recovery codes of the user
+func (u *User) RecoveryCodesLeft() int {
+	var n int
+	db.Model(RecoveryCode{}).Where("user_id = ?", u.ID).Count(&n)
+	return n
+}
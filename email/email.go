@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/smtp"
+	"net/url"
 
 	"github.com/sendgrid/sendgrid-go"
 	"github.com/vhakulinen/push-server/config"
@@ -26,28 +27,38 @@ const regMessageRaw = "This email address was used while registering to push-ser
 	"To complite this regitration process, follow this link:\n\nhttps://%s\n\n" +
 	"If you did not register to this service, ignore this message\n\nDo not reply to this message"
 
-var sendMail func(m, email string) error
+const resetMessageRaw = "Password reset was requested for your push-serv account\n" +
+	"To set new password, POST it as password parameter to this link:\n\nhttps://%s\n\n" +
+	"The link is valid for %v and can be used once.\n\n" +
+	"If you did not ask for this, ignore this message\n\nDo not reply to this message"
 
-var sendSMTP = func(m, email string) error {
+const verifyMessageRaw = "This email address was given as the new address of a push-serv account\n" +
+	"To confirm the change, follow this link:\n\nhttps://%s\n\n" +
+	"If you did not ask for this, ignore this message\n\nDo not reply to this message"
+
+var sendMail func(subject, m, email string) error
+
+var sendSMTP = func(subject, m, email string) error {
 	auth := smtp.PlainAuth("", username, password, host)
+	msg := fmt.Sprintf("Subject: %s\r\n\r\n%s", subject, m)
 	// NOTE: This will block
-	err := smtp.SendMail(addr, auth, from, []string{email}, []byte(m))
+	err := smtp.SendMail(addr, auth, from, []string{email}, []byte(msg))
 	if err != nil {
-		log.Printf("Error while sending registration email! (%v)", err)
+		log.Printf("Error while sending email! (%v)", err)
 	}
 	return err
 }
 
-var sendGRID = func(m, email string) error {
+var sendGRID = func(subject, m, email string) error {
 	sg := sendgrid.NewSendGridClient(username, password)
 	message := sendgrid.NewMail()
 	message.AddTo(email)
-	message.SetSubject("Push registeration")
+	message.SetSubject(subject)
 	message.SetText(m)
 	message.SetFrom(from)
 	err := sg.Send(message)
 	if err != nil {
-		log.Printf("Error while sending registration email! (%v)", err)
+		log.Printf("Error while sending email! (%v)", err)
 	}
 	return err
 }
@@ -59,7 +70,29 @@ var SendRegistrationEmail = func(u *db.User) error {
 	}
 	uri := fmt.Sprintf("%s/activate/?email=%s&key=%s", domain, u.Email, u.ActivateToken)
 	regMessage := fmt.Sprintf(regMessageRaw, uri)
-	return sendMail(regMessage, u.Email)
+	return sendMail("Push registeration", regMessage, u.Email)
+}
+
+// SendEmailVerificationEmail sends email to u.PendingEmail with link to
+// confirm changing the User's email to it
+var SendEmailVerificationEmail = func(u *db.User) error {
+	if !configLoaded {
+		LoadConfig()
+	}
+	uri := fmt.Sprintf("%s/account/email/confirm/?email=%s&key=%s", domain, url.QueryEscape(u.PendingEmail), u.ActivateToken)
+	verifyMessage := fmt.Sprintf(verifyMessageRaw, uri)
+	return sendMail("Push email change", verifyMessage, u.PendingEmail)
+}
+
+// SendPasswordResetEmail sends email to u.Email with key to reset the User's
+// password
+var SendPasswordResetEmail = func(u *db.User, key string) error {
+	if !configLoaded {
+		LoadConfig()
+	}
+	uri := fmt.Sprintf("%s/password/reset/?key=%s", domain, key)
+	resetMessage := fmt.Sprintf(resetMessageRaw, uri, db.PasswordResetTTL)
+	return sendMail("Push password reset", resetMessage, u.Email)
 }
 
 // LoadConfig loads this package's configuration fron config.Config package
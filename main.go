@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -9,11 +10,17 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/vhakulinen/push-server/auth"
 	"github.com/vhakulinen/push-server/config"
 	"github.com/vhakulinen/push-server/db"
 	"github.com/vhakulinen/push-server/email"
+	"github.com/vhakulinen/push-server/notify"
+	"github.com/vhakulinen/push-server/queue"
+	"github.com/vhakulinen/push-server/ratelimit"
+	"github.com/vhakulinen/push-server/sse"
 	"github.com/vhakulinen/push-server/tcp"
 	"github.com/vhakulinen/push-server/utils"
+	"github.com/vhakulinen/push-server/ws"
 )
 
 var configFile = flag.String("config", "push-serv.conf", "Path to config file")
@@ -22,54 +29,50 @@ var httpHostPort string
 var skipEmailVerification bool
 
 func activateUserHandler(w http.ResponseWriter, r *http.Request) {
-	var writeBadRequest = func() {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(http.StatusText(http.StatusBadRequest)))
-	}
 	defer r.Body.Close()
 	err := r.ParseForm()
-	if err != nil {
-		writeBadRequest()
-		return
-	}
-	semail := r.Form.Get("email")
-	key := r.Form.Get("key")
-	if semail == "" || key == "" {
-		writeBadRequest()
-		return
+	if err == nil {
+		e := activateUser(r.Form.Get("email"), r.Form.Get("key"))
+		if e == nil {
+			w.Write([]byte(http.StatusText(http.StatusOK)))
+			return
+		} else if e.Code == codeAccountLocked {
+			writeErrorHeader(w, e)
+			w.Write([]byte(e.Message))
+			return
+		}
 	}
-	user, err := db.GetUser(semail)
-	if err != nil || user.Active == true || user.ActivateToken != key {
-		writeBadRequest()
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+}
+
+func resendActivationHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if e := resendActivation(r.FormValue("email"), r.FormValue("password")); e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(e.Message))
 		return
 	}
-	user.Activate()
-	w.Write([]byte(http.StatusText(http.StatusOK)))
+	w.Write([]byte("Activation link was sent by email"))
 }
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	semail := r.FormValue("email")
-	password := r.FormValue("password")
-	user, err := db.NewUser(semail, password)
-	if err != nil {
+	user, e := registerUser(r.FormValue("email"), r.FormValue("password"))
+	if e != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("%v", err)))
+		w.Write([]byte(e.Message))
 		return
 	}
-	if skipEmailVerification {
-		user.Activate()
-		w.WriteHeader(http.StatusOK)
+	w.WriteHeader(http.StatusOK)
+	if user.Active {
 		w.Write([]byte(user.Token))
 	} else {
-		email.SendRegistrationEmail(user)
-		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Activation link was sent by email"))
 	}
 }
 
 func pushHandler(w http.ResponseWriter, r *http.Request) {
-	var pushData *db.PushData
 	var err error
 	var priority int
 	var timestamp int64
@@ -97,118 +100,308 @@ func pushHandler(w http.ResponseWriter, r *http.Request) {
 		timestamp = 0
 	}
 
-	pushData, err = db.SavePushData(title, body, token, uri, timestamp, int64(priority))
-	if err != nil {
-		log.Printf("Something went wrong! (%v)", err)
-		return
+	// Legacy clients don't get to know whether the push went through
+	if topic := r.FormValue("topic"); topic != "" {
+		if _, e := sendTopicPush(title, body, token, topic, uri, timestamp, int64(priority)); e != nil {
+			log.Printf("Push to topic failed (%v)", e)
+		}
+	} else if _, e := sendPush(title, body, token, uri, timestamp, int64(priority)); e != nil {
+		log.Printf("Push failed (%v)", e)
 	}
+}
 
-	if pushData.Priority != 3 {
-		// Send this to TCP client if any
-		if send, ok := tcp.ClientFromPool(token); ok {
-			data, err := pushData.ToJSON()
-			if err != nil {
-				// TODO: something went really wrong
-			} else {
-				select {
-				case send <- string(data):
-					if pushData.Priority == 2 {
-						pushData.Sound = false
-						pushData.Save()
-					}
-				default:
-					// Buffer is full and tcp client is hanging on ping
-					// message
-				}
-			}
+func poolHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	data := ""
+	pushes, e := poolPushes(r.FormValue("token"), r.FormValue("device"))
+	if e != nil && e.Status == http.StatusInternalServerError {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(e.Message))
+		return
+	}
+	for _, push := range pushes {
+		tmp, err := push.ToJSON()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Something went wrong!"))
+			log.Printf("%v", err)
+			return
 		}
+		data += string(tmp)
+	}
+	w.Write([]byte(data))
+}
+
+func retrieveHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	token, e := retrieveToken(r.FormValue("email"), r.FormValue("password"), r.FormValue("otp"))
+	if e != nil && e.Code == codeInvalidCredentials {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(http.StatusText(http.StatusNotFound)))
+	} else if e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(e.Message))
+	} else {
+		w.Write([]byte(token))
+	}
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	tokens, e := login(r.FormValue("email"), r.FormValue("password"), r.FormValue("otp"))
+	writeJSONResponse(w, tokens, e)
+}
+
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	tokens, e := refreshSession(r.FormValue("refresh_token"))
+	writeJSONResponse(w, tokens, e)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if e := logout(sessionOf(r), r.FormValue("all") == "true"); e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(http.StatusText(e.Status)))
+		return
+	}
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if e := forgotPassword(r.FormValue("email")); e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(http.StatusText(e.Status)))
+		return
+	}
+	w.Write([]byte("Reset link was sent by email"))
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	token, e := resetPassword(r.FormValue("key"), r.FormValue("password"), r.FormValue("otp"))
+	if e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(e.Message))
+		return
 	}
-	// NOTE: if we need pushData after this, we should reload it since it
-	// might have been modified
+	w.Write([]byte(token))
+}
 
-	// If we made it here, push data was saved so lets notify GCM clients about that
-	u, err := db.GetUserByToken(token)
+func emailHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if e := changeEmail(sessionOf(r).user, r.FormValue("newemail")); e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(e.Message))
+		return
+	}
+	w.Write([]byte("Verification link was sent by email"))
+}
+
+func emailConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if e := confirmEmail(r.FormValue("email"), r.FormValue("key")); e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(http.StatusText(e.Status)))
+		return
+	}
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+// writeJSONResponse writes v as JSON, or status of e if it's not nil.
+func writeJSONResponse(w http.ResponseWriter, v interface{}, e *apiError) {
+	if e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(http.StatusText(e.Status)))
+		return
+	}
+	data, err := json.Marshal(v)
 	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Something went wrong!"))
+		log.Printf("%v", err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func totpEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	enrollment, e := enrollTOTP(sessionOf(r).user)
+	writeJSONResponse(w, enrollment, e)
+}
+
+func totpConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	codes, e := confirmTOTP(sessionOf(r).user, r.FormValue("code"))
+	writeJSONResponse(w, recoveryCodesResponse{codes}, e)
+}
 
-	var regIds []string
-	for _, c := range u.GCMClients {
-		regIds = append(regIds, c.GCMId)
+func totpDisableHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	user := sessionOf(r).user
+	// Access token alone isn't enough to turn the second factor off
+	e := checkOTP(user, r.FormValue("otp"))
+	if e == nil {
+		e = disableTOTP(user)
+	}
+	if e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(e.Message))
+		return
 	}
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
 
-	// If we dont have any GCM clients, don't even try to send data to them
-	if len(regIds) > 0 {
-		go utils.SendGcmPing(regIds)
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if e := deleteAccount(sessionOf(r).user); e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(http.StatusText(e.Status)))
+		return
 	}
+	w.Write([]byte(http.StatusText(http.StatusOK)))
 }
 
-func poolHandler(w http.ResponseWriter, r *http.Request) {
+func exportAccountHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	data := ""
-	token := r.FormValue("token")
-	if db.TokenExists(token) {
-		for _, push := range db.GetPushesForToken(token) {
-			if push.Accessed {
-				continue
-			}
-			tmp, err := push.ToJSON()
-			push.SetAccessed()
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte("Something went wrong!"))
-				log.Printf("%v", err)
-				return
-			}
-			data += string(tmp)
-		}
+	writeJSONResponse(w, exportAccount(sessionOf(r).user), nil)
+}
+
+func rotateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	grace, _ := strconv.ParseInt(r.FormValue("grace"), 10, 64)
+	token, e := rotateToken(sessionOf(r).user, grace)
+	if e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(http.StatusText(e.Status)))
+		return
 	}
-	w.Write([]byte(data))
+	w.Write([]byte(token))
 }
 
-func retrieveHandler(w http.ResponseWriter, r *http.Request) {
+func gcmRegisterHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	semail := r.FormValue("email")
-	password := r.FormValue("password")
-	user, err := db.GetUser(semail)
-	if err != nil || !user.ValidatePassword(password) || !user.Active {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(http.StatusText(http.StatusNotFound)))
+	e := registerGCM(tokenFromRequest(r, r.FormValue("token")), r.FormValue("gcmid"), r.FormValue("device"))
+	if e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(http.StatusText(e.Status)))
 	} else {
-		w.Write([]byte(user.Token))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(http.StatusText(http.StatusOK)))
 	}
 }
 
-func gcmRegisterHandler(w http.ResponseWriter, r *http.Request) {
+func gcmUnregisterHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	token := r.FormValue("token")
-	gcmID := r.FormValue("gcmid")
-	if gcmID == "" || token == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+	unregisterGCM(r.FormValue("gcmid"))
+}
+
+func apnsRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	e := registerAPNS(tokenFromRequest(r, r.FormValue("token")), r.FormValue("devicetoken"))
+	if e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(http.StatusText(e.Status)))
 	} else {
-		_, err := db.RegisterGCMClient(gcmID, token)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
-		} else {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(http.StatusText(http.StatusOK)))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(http.StatusText(http.StatusOK)))
+	}
+}
+
+func apnsUnregisterHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	unregisterAPNS(r.FormValue("devicetoken"))
+}
+
+// createTopicHandler creates topic and writes its subscribe key.
+func createTopicHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	key, e := createTopic(sessionOf(r).user.Token, r.FormValue("topic"))
+	if e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(e.Message))
+		return
+	}
+	w.Write([]byte(key))
+}
+
+func subscribeTopicHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if e := subscribeTopic(sessionOf(r).user.Token, r.FormValue("topic"), r.FormValue("key")); e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(e.Message))
+		return
+	}
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+// topicHandler returns form handler running topic action f.
+func topicHandler(f func(token, name string) *apiError) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if e := f(sessionOf(r).user.Token, r.FormValue("topic")); e != nil {
+			writeErrorHeader(w, e)
+			w.Write([]byte(e.Message))
+			return
 		}
+		w.Write([]byte(http.StatusText(http.StatusOK)))
 	}
 }
 
-func gcmUnregisterHandler(w http.ResponseWriter, r *http.Request) {
+func deviceRegisterHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	gcmID := r.FormValue("gcmid")
-	if gcmID == "" {
+	if e := registerDevice(tokenFromRequest(r, r.FormValue("token")), r.FormValue("device")); e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(e.Message))
 		return
 	}
-	g, err := db.GetGCMClient(gcmID)
-	if err != nil {
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func deviceUnregisterHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	unregisterDevice(tokenFromRequest(r, r.FormValue("token")), r.FormValue("device"))
+}
+
+func webPushSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	e := subscribeWebPush(tokenFromRequest(r, r.FormValue("token")), r.FormValue("endpoint"),
+		r.FormValue("p256dh"), r.FormValue("auth"))
+	if e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(http.StatusText(e.Status)))
 		return
 	}
-	g.Delete()
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func webPushUnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	unsubscribeWebPush(r.FormValue("endpoint"))
+}
+
+func webhookRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	e := registerWebhook(tokenFromRequest(r, r.FormValue("token")), r.FormValue("url"), r.FormValue("secret"))
+	if e != nil {
+		writeErrorHeader(w, e)
+		w.Write([]byte(e.Message))
+		return
+	}
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
+
+func webhookUnregisterHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	unregisterWebhook(tokenFromRequest(r, r.FormValue("token")), r.FormValue("url"))
+}
+
+func webPushKeyHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	w.Write([]byte(utils.VAPIDPublicKey()))
 }
 
 func startTCP(addr string, config *tls.Config) {
@@ -237,6 +430,12 @@ func main() {
 	db.SetupDatabase()
 	email.LoadConfig()
 	utils.LoadConfig()
+	notify.LoadConfig()
+	queue.LoadConfig()
+	auth.LoadConfig()
+	ratelimit.LoadConfig()
+	ws.LoadConfig()
+	queue.Start()
 
 	logToTty, err := config.Config.Bool("log", "totty")
 	logFile, err := config.Config.String("log", "file")
@@ -247,6 +446,11 @@ func main() {
 	skipEmailVerification, err = config.Config.Bool("registration", "skipEmailVerification")
 	tcpHost, err := config.Config.String("tcp", "host")
 	tcpPort, err := config.Config.Int("tcp", "port")
+	// Optional, only set when behind reverse proxy
+	realIPHeader, _ = config.Config.String("ratelimit", "realipheader")
+	if n, err := config.Config.Int("ratelimit", "trustedhops"); err == nil && n > 0 {
+		trustedHops = n
+	}
 
 	if err != nil {
 		log.Fatal(err)
@@ -276,13 +480,44 @@ func main() {
 
 	http.HandleFunc("/register/", registerHandler)
 	http.HandleFunc("/activate/", activateUserHandler)
+	http.HandleFunc("/activate/resend/", resendActivationHandler)
 	http.HandleFunc("/push/", pushHandler)
 	http.HandleFunc("/pool/", poolHandler)
+	http.HandleFunc("/auth/login/", loginHandler)
+	http.HandleFunc("/auth/refresh/", refreshHandler)
+	http.HandleFunc("/auth/logout/", requireSession(logoutHandler))
+	http.HandleFunc("/password/forgot/", forgotPasswordHandler)
+	http.HandleFunc("/password/reset/", resetPasswordHandler)
+	http.HandleFunc("/token/rotate/", requireSession(rotateTokenHandler))
+	http.HandleFunc("/account/email/", requireSession(emailHandler))
+	http.HandleFunc("/account/email/confirm/", emailConfirmHandler)
+	http.HandleFunc("/account/delete/", requireSession(deleteAccountHandler))
+	http.HandleFunc("/account/2fa/enroll/", requireSession(totpEnrollHandler))
+	http.HandleFunc("/account/2fa/confirm/", requireSession(totpConfirmHandler))
+	http.HandleFunc("/account/2fa/disable/", requireSession(totpDisableHandler))
+	http.HandleFunc("/account/export/", requireSession(exportAccountHandler))
+	http.HandleFunc("/topics/create/", requireSession(createTopicHandler))
+	http.HandleFunc("/topics/delete/", requireSession(topicHandler(deleteTopic)))
+	http.HandleFunc("/topics/subscribe/", requireSession(subscribeTopicHandler))
+	http.HandleFunc("/topics/unsubscribe/", requireSession(topicHandler(unsubscribeTopic)))
 	http.HandleFunc("/retrieve/", retrieveHandler)
-	http.HandleFunc("/gcm/", gcmRegisterHandler)
+	http.HandleFunc("/gcm/", withSession(gcmRegisterHandler))
 	http.HandleFunc("/ungcm/", gcmUnregisterHandler)
+	http.HandleFunc("/apns/", withSession(apnsRegisterHandler))
+	http.HandleFunc("/unapns/", apnsUnregisterHandler)
+	http.HandleFunc("/device/", withSession(deviceRegisterHandler))
+	http.HandleFunc("/undevice/", withSession(deviceUnregisterHandler))
+	http.HandleFunc("/webpush/subscribe/", withSession(webPushSubscribeHandler))
+	http.HandleFunc("/webpush/unsubscribe/", webPushUnsubscribeHandler)
+	http.HandleFunc("/webpush/key/", webPushKeyHandler)
+	http.HandleFunc("/webhook/", withSession(webhookRegisterHandler))
+	http.HandleFunc("/unwebhook/", withSession(webhookUnregisterHandler))
+	http.HandleFunc("/stream/", sse.HandleSSEClient)
+	http.HandleFunc("/ws/", ws.HandleWSClient)
+	registerAPIv1(http.DefaultServeMux)
 
-	if err := http.ListenAndServeTLS(httpHostPort, certPemFile, keyPemFile, nil); err != nil {
+	handler := withRateLimit(http.DefaultServeMux)
+	if err := http.ListenAndServeTLS(httpHostPort, certPemFile, keyPemFile, handler); err != nil {
 		panic(err)
 	}
 }
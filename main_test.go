@@ -1,22 +1,34 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
+	"github.com/vhakulinen/push-server/auth"
 	"github.com/vhakulinen/push-server/config"
 	"github.com/vhakulinen/push-server/db"
 	"github.com/vhakulinen/push-server/email"
+	"github.com/vhakulinen/push-server/queue"
+	"github.com/vhakulinen/push-server/ratelimit"
+	"github.com/vhakulinen/push-server/sse"
 	"github.com/vhakulinen/push-server/tcp"
 	"github.com/vhakulinen/push-server/utils"
+	"github.com/vhakulinen/push-server/ws"
 )
 
 const (
@@ -30,16 +42,55 @@ func TestMain(m *testing.M) {
 	config.GetConfig("push-serv.conf.def")
 	db.SetupDatabase()
 	db.BackupForTesting()
+	auth.LoadConfig()
 
 	// General mock for these functions
 	email.SendRegistrationEmail = func(u *db.User) error { return nil }
-	utils.SendGcmPing = func(regIds []string) { return }
+	utils.SendFCM = func(regIds []string, data map[string]string) []utils.FCMResult { return nil }
+	utils.SendWebPush = func(sub utils.WebPushSubscription, payload []byte) error { return nil }
+	utils.SendAPNS = func(deviceTokens []string, n utils.APNSNotification) []utils.APNSResult { return nil }
 
+	queue.Start()
 	code := m.Run()
+	queue.Stop()
 	db.RestoreFromTesting()
 	os.Exit(code)
 }
 
+// accessToken logs u in and returns access token for management routes.
+func accessToken(t *testing.T, u *db.User) string {
+	tokens, err := auth.Login(u)
+	if err != nil {
+		t.Fatalf("Failed to log in (%v)", err)
+	}
+	return tokens.AccessToken
+}
+
+// postForm posts form to h with access token in Authorization header, if
+// it's not empty, and returns status code and body of the response.
+func postForm(t *testing.T, h http.HandlerFunc, access string, form url.Values) (int, []byte) {
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	req, err := http.NewRequest("POST", ts.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if access != "" {
+		req.Header.Set("Authorization", "Bearer "+access)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, body
+}
+
 func TestRetrieveHandler(t *testing.T) {
 	var email = "retrieve@user.com"
 	var pass = "password"
@@ -93,391 +144,1990 @@ func TestRetrieveHandler(t *testing.T) {
 	}
 }
 
-func TestActivateUserHandler(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(activateUserHandler))
+func TestRetrieveHandlerRehash(t *testing.T) {
+	var email = "rehash@user.com"
+	var pass = "password"
+
+	ts := httptest.NewServer(http.HandlerFunc(retrieveHandler))
 	defer ts.Close()
 
-	// Register the user
-	email := "activateuser@domain.com"
+	user, err := db.NewUser(email, pass)
+	if err != nil {
+		t.Fatalf("Failed to add user! (%v)", err)
+	}
+	// Store the password the way it was before argon2id
+	salt := "0123456789abcdef"
+	sum := sha256.Sum256([]byte(pass + salt))
+	user.Password = salt + hex.EncodeToString(sum[:])
+	user.Active = true
+	user.Save()
 
-	user, err := db.NewUser(email, "password123")
+	form := url.Values{}
+	form.Add("email", email)
+	form.Add("password", pass)
+	res, err := http.PostForm(ts.URL, form)
 	if err != nil {
 		t.Fatal(err)
 	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Got %d, want %d", res.StatusCode, 200)
+	}
 
-	var testData = []struct {
-		Email        string
-		Key          string
-		ExpectedCode int
-	}{
-		{user.Email, "foo", 400},
-		{"fail@domain.com", user.ActivateToken, 400},
-		{user.Email, user.ActivateToken, 200},
+	user, err = db.GetUser(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.NeedsRehash() {
+		t.Errorf("Password was not rehashed on retrieve")
+	}
+	if !user.ValidatePassword(pass) {
+		t.Errorf("Rehashed password doesn't validate")
 	}
+}
 
-	for _, data := range testData {
-		res, err := http.Get(fmt.Sprintf("%s?email=%s&key=%s", ts.URL, data.Email, data.Key))
+func TestRetrieveHandlerLockout(t *testing.T) {
+	var email = "lockout@user.com"
+	var pass = "password"
+
+	ts := httptest.NewServer(http.HandlerFunc(retrieveHandler))
+	defer ts.Close()
+
+	user, err := db.NewUser(email, pass)
+	if err != nil {
+		t.Fatalf("Failed to add user! (%v)", err)
+	}
+	user.Activate()
+
+	retrieve := func(password string) *http.Response {
+		form := url.Values{}
+		form.Add("email", email)
+		form.Add("password", password)
+		res, err := http.PostForm(ts.URL, form)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if data.ExpectedCode != res.StatusCode {
-			t.Errorf("Expected %v, got %v instead", data.ExpectedCode, res.StatusCode)
+		res.Body.Close()
+		return res
+	}
+
+	for i := int64(0); ratelimit.Lockout(i+1) == 0; i++ {
+		if res := retrieve("invalidpass"); res.StatusCode != 404 {
+			t.Fatalf("Got %d, want %d (attempt %d)", res.StatusCode, 404, i)
 		}
 	}
-	user, err = db.GetUser(email)
-	if err != nil {
-		t.Fatalf("Failed to get user with GetUser(%v)", email)
+	if res := retrieve("invalidpass"); res.StatusCode != 404 {
+		t.Fatalf("Got %d, want %d", res.StatusCode, 404)
 	}
-	if user.Active == false {
-		t.Error("User.Active == false after activation!")
+	// Locked out, even with the right password
+	res := retrieve(pass)
+	if res.StatusCode != 429 {
+		t.Fatalf("Got %d, want %d", res.StatusCode, 429)
 	}
-	res, _ := http.Get(fmt.Sprintf("%s/", ts.URL))
-	if res.StatusCode != 400 {
-		t.Error("URI with no email or key should have returned 400")
+	if res.Header.Get("Retry-After") == "" {
+		t.Errorf("Retry-After header is missing")
 	}
-	res, _ = http.Get(fmt.Sprintf("%s/asd/", ts.URL))
-	if res.StatusCode != 400 {
-		t.Error("URI with ivalid data should have returned 400")
+
+	// Lockout has passed
+	user, _ = db.GetUser(email)
+	user.LockFor(-time.Second)
+	if res = retrieve(pass); res.StatusCode != 200 {
+		t.Fatalf("Got %d, want %d", res.StatusCode, 200)
+	}
+	user, _ = db.GetUser(email)
+	if user.FailedAttempts != 0 {
+		t.Errorf("Got %d failed attempts, want 0 after login", user.FailedAttempts)
 	}
 }
 
-func TestRegisterHandler(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(registerHandler))
-	defer ts.Close()
+func TestRateLimit(t *testing.T) {
+	ratelimit.ByIP = ratelimit.New(1, 4)
+	ratelimit.ByEmail = ratelimit.New(1, 1)
+	defer func() { ratelimit.ByIP, ratelimit.ByEmail = nil, nil }()
 
-	emailDone := false
-	// Mock for this test
-	// NOTE: We'll are only waiting for one valid email address
-	email.SendRegistrationEmail = func(u *db.User) error {
-		if u.Active != false {
-			t.Error("User.Active should be false!")
-		}
-		expecting := "valid@email.com"
-		if u.Email != expecting {
-			t.Errorf("Expected %v, got %v instead", expecting, u.Email)
-		} else {
-			emailDone = true
-		}
-		return nil
-	}
+	// Echoes the body back, to see that it is left intact
+	ts := httptest.NewServer(withRateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})))
+	defer ts.Close()
 
 	var testData = []struct {
-		email          string
-		password       string
-		expectedCode   int
-		expectedString string
+		path         string
+		body         string
+		expectedCode int
 	}{
-		{"", "", 400, emailpassRequiredRegexString},
-		{"email@isnot_enough.com", "", 400, emailpassRequiredRegexString},
-		{"", "passwordisnotenough", 400, emailpassRequiredRegexString},
-		{"valid@email.com", "validpassword", 200, "Activation link was sent by email"},
-		{"valid@email.com", "validpassword", 400, userExistsRegexString},
+		{"/retrieve/", "email=ratelimit@user.com", 200},
+		// Email limit
+		{"/retrieve/", "email=RateLimit@user.com", 429},
+		{"/api/v1/retrieve/", `{"email": "ratelimit@user.com"}`, 429},
+		{"/api/v1/retrieve/", `{"email": "other@user.com"}`, 200},
+		// IP limit
+		{"/push/", "token=token", 429},
 	}
-
 	for i, data := range testData {
-		form := url.Values{}
-		form.Add("email", data.email)
-		form.Add("password", data.password)
-
-		res, err := http.PostForm(ts.URL, form)
+		contentType := "application/x-www-form-urlencoded"
+		if strings.HasPrefix(data.path, "/api/") {
+			contentType = "application/json"
+		}
+		res, err := http.Post(ts.URL+data.path, contentType, strings.NewReader(data.body))
 		if err != nil {
 			t.Fatal(err)
 		}
-
 		body, err := ioutil.ReadAll(res.Body)
 		res.Body.Close()
 		if err != nil {
 			t.Fatal(err)
 		}
-
 		if res.StatusCode != data.expectedCode {
 			t.Errorf("Got %d, want %d (run %d)", res.StatusCode, data.expectedCode, i)
 		}
-		ok, err := regexp.Match(data.expectedString, body)
-		if err != nil {
-			t.Fatal(err)
+		if res.StatusCode == 429 && res.Header.Get("Retry-After") != "1" {
+			t.Errorf("Got Retry-After %q, want %q (run %d)", res.Header.Get("Retry-After"), "1", i)
 		}
-		if !ok {
-			t.Errorf("Got \"%s\", want string matching regex \"%s\" (run %d)", body, data.expectedString, i)
+		if res.StatusCode == 200 && strings.HasPrefix(data.path, "/api/") && string(body) != data.body {
+			t.Errorf("Got body %s, want %s (run %d)", body, data.body, i)
+		}
+		if res.StatusCode == 429 && strings.HasPrefix(data.path, "/api/") && !strings.Contains(string(body), codeRateLimited) {
+			t.Errorf("Got %s, want %s error (run %d)", body, codeRateLimited, i)
 		}
 	}
+}
 
-	// Check that SendRegistrationEmail was ran
-	if !emailDone {
-		t.Error("email.SendRegistrationEmail was not called!")
+func TestClientIP(t *testing.T) {
+	realIPHeader = "X-Forwarded-For"
+	defer func() { realIPHeader, trustedHops = "", 1 }()
+
+	var testData = []struct {
+		header     string
+		hops       int
+		expectedIP string
+	}{
+		{"", 1, "10.0.0.1"},
+		{"203.0.113.1", 1, "203.0.113.1"},
+		// Client can put anything left of what the proxy appends
+		{"1.2.3.4, 203.0.113.1", 1, "203.0.113.1"},
+		{"1.2.3.4, 203.0.113.1, 198.51.100.1", 2, "203.0.113.1"},
+		{"203.0.113.1", 2, "203.0.113.1"},
+	}
+	for i, data := range testData {
+		trustedHops = data.hops
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if data.header != "" {
+			r.Header.Set("X-Forwarded-For", data.header)
+		}
+		if ip := clientIP(r); ip != data.expectedIP {
+			t.Errorf("Got %s, want %s (run %d)", ip, data.expectedIP, i)
+		}
 	}
+}
 
-	// Test the skipEmailVerification = true
-	//config.Config.AddOption("registration", "skipEmailVerification", "true")
-	skipEmailVerification = true // Simulate the above
-	semail := "skip@activation.com"
-	form := url.Values{}
-	form.Add("email", semail)
-	form.Add("password", "password123")
+func TestTOTPHandlers(t *testing.T) {
+	var email = "totp@user.com"
+	var pass = "password"
 
-	res, err := http.PostForm(ts.URL, form)
+	user, err := db.NewUser(email, pass)
 	if err != nil {
+		t.Fatalf("Failed to add user! (%v)", err)
+	}
+	user.Activate()
+	access := accessToken(t, user)
+
+	credentials := func(otp string) url.Values {
+		form := url.Values{}
+		form.Add("email", email)
+		form.Add("password", pass)
+		form.Add("otp", otp)
+		return form
+	}
+
+	// Email and password don't work in place of access token
+	if status, _ := postForm(t, requireSession(totpEnrollHandler), "", credentials("")); status != 401 {
+		t.Errorf("Got %d, want %d without access token", status, 401)
+	}
+	status, body := postForm(t, requireSession(totpEnrollHandler), access, url.Values{})
+	if status != 200 {
+		t.Fatalf("Got %d, want %d", status, 200)
+	}
+	var enrollment totpEnrollment
+	if err = json.Unmarshal(body, &enrollment); err != nil {
 		t.Fatal(err)
 	}
-	body, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
-	if err != nil {
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/") {
+		t.Errorf("Unexpected URI %s", enrollment.URI)
+	}
+
+	code, _ := utils.TOTP(enrollment.Secret, utils.TOTPStep(time.Now()))
+	status, body = postForm(t, requireSession(totpConfirmHandler), access, url.Values{"code": {code}})
+	if status != 200 {
+		t.Fatalf("Got %d, want %d", status, 200)
+	}
+	var recovery recoveryCodesResponse
+	if err = json.Unmarshal(body, &recovery); err != nil {
 		t.Fatal(err)
 	}
-	ok, err := regexp.Match(tokenRegexString, body)
+	if len(recovery.RecoveryCodes) == 0 {
+		t.Fatalf("Didn't get recovery codes")
+	}
+
+	var testData = []struct {
+		otp          string
+		expectedCode int
+	}{
+		{"", 401},
+		{"000000", 401},
+		{recovery.RecoveryCodes[0], 200},
+		// Recovery codes can be used only once
+		{recovery.RecoveryCodes[0], 401},
+	}
+	for i, data := range testData {
+		status, body = postForm(t, retrieveHandler, "", credentials(data.otp))
+		if status != data.expectedCode {
+			t.Errorf("Got %d, want %d (run %d)", status, data.expectedCode, i)
+		}
+		if status == 200 && string(body) != user.Token {
+			t.Errorf("Got %s, want %s (run %d)", body, user.Token, i)
+		}
+	}
+
+	// Password reset link alone doesn't get past the second factor
+	key, err := user.NewPasswordReset()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !ok {
-		t.Errorf("Got \"%s\", want string matching regex \"%s\"", body, tokenRegexString)
+	reset := url.Values{}
+	reset.Add("key", key)
+	reset.Add("password", pass)
+	if status, _ = postForm(t, resetPasswordHandler, "", reset); status != 401 {
+		t.Errorf("Got %d, want %d for reset without otp", status, 401)
+	}
+	reset.Add("otp", recovery.RecoveryCodes[1])
+	if status, body = postForm(t, resetPasswordHandler, "", reset); status != 200 || string(body) != user.Token {
+		t.Errorf("Got %d %s, want %d %s for reset with otp", status, body, 200, user.Token)
 	}
 
-	// Check the user.Active state
-	user, err := db.GetUser(semail)
+	// Guessing one-time password with reset link locks the account out
+	wrongOTP := func() int {
+		key, err := user.NewPasswordReset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, _ := postForm(t, resetPasswordHandler, "", url.Values{"key": {key}, "password": {pass}, "otp": {"wrongcode"}})
+		return status
+	}
+	for i := int64(0); ratelimit.Lockout(i+1) == 0; i++ {
+		if status = wrongOTP(); status != 401 {
+			t.Fatalf("Got %d, want %d (attempt %d)", status, 401, i)
+		}
+	}
+	if status = wrongOTP(); status != 401 {
+		t.Fatalf("Got %d, want %d", status, 401)
+	}
+	key, err = user.NewPasswordReset()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if user.Active != true {
-		t.Errorf("User.Active should be true since skipEmailVerification option was set to true in configuration!")
+	reset.Set("key", key)
+	reset.Set("otp", recovery.RecoveryCodes[3])
+	if status, _ = postForm(t, resetPasswordHandler, "", reset); status != 429 {
+		t.Errorf("Got %d, want %d when locked out", status, 429)
 	}
-	skipEmailVerification = false // Reset
-}
+	user, _ = db.GetUser(email)
+	user.ResetFailedAttempts()
 
-func TestPushHandler(t *testing.T) {
-	/*
-		PushHander doesnt care if the token is valid or not, so we dont check
-		the return messages because those will only contain error messages
-		to user, if even those.
+	// Reset ended the session
+	disable := requireSession(totpDisableHandler)
+	if status, _ = postForm(t, disable, access, url.Values{"otp": {recovery.RecoveryCodes[2]}}); status != 401 {
+		t.Errorf("Got %d, want %d with access token of ended session", status, 401)
+	}
+	access = accessToken(t, user)
+	// Access token alone can't disable the second factor
+	if status, _ = postForm(t, disable, access, url.Values{}); status != 401 {
+		t.Errorf("Got %d, want %d without otp", status, 401)
+	}
+	status, _ = postForm(t, disable, access, url.Values{"otp": {recovery.RecoveryCodes[2]}})
+	if status != 200 {
+		t.Fatalf("Got %d, want %d", status, 200)
+	}
+	if status, _ = postForm(t, retrieveHandler, "", credentials("")); status != 200 {
+		t.Errorf("Got %d, want %d after disabling", status, 200)
+	}
+}
 
-		Also, was the priority whatever, it shouldn't cause any problem
-	*/
+func TestPasswordResetHandlers(t *testing.T) {
+	var userEmail = "reset@user.com"
 
-	ts := httptest.NewServer(http.HandlerFunc(pushHandler))
-	defer ts.Close()
+	forgot := httptest.NewServer(http.HandlerFunc(forgotPasswordHandler))
+	defer forgot.Close()
+	reset := httptest.NewServer(http.HandlerFunc(resetPasswordHandler))
+	defer reset.Close()
 
-	// Backup to restore
-	oClientFromPool := tcp.ClientFromPool
-	defer func() {
-		tcp.ClientFromPool = oClientFromPool
-	}()
+	user, err := db.NewUser(userEmail, "password")
+	if err != nil {
+		t.Fatalf("Failed to add user! (%v)", err)
+	}
+	user.Activate()
 
-	tcpcount := 0
-	tcp.ClientFromPool = func(token string) (chan<- string, bool) {
-		tcpcount++
-		return nil, false
+	var sent []string
+	orig := email.SendPasswordResetEmail
+	email.SendPasswordResetEmail = func(u *db.User, key string) error {
+		if u.Email != userEmail {
+			t.Errorf("Reset email sent to %s, want %s", u.Email, userEmail)
+		}
+		sent = append(sent, key)
+		return nil
 	}
+	defer func() { email.SendPasswordResetEmail = orig }()
 
-	u, err := db.NewUser("push@test1.com", "password")
-	if err != nil {
-		t.Fatalf("Failed to craete new user (%v)", err)
+	// Unknown email looks the same as known one
+	for _, e := range []string{"unknown@user.com", userEmail} {
+		res, err := http.PostForm(forgot.URL, url.Values{"email": {e}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("Got %d, want %d (%s)", res.StatusCode, 200, e)
+		}
+	}
+	if len(sent) != 1 {
+		t.Fatalf("Got %d reset emails, want 1", len(sent))
 	}
+	key := sent[0]
 
 	var testData = []struct {
-		title        string
-		body         string
-		token        string
-		timestamp    string
-		priority     string
-		expectedCode int
+		key            string
+		password       string
+		expectedCode   int
+		expectedString string
 	}{
-		// Server doesnt notify user if the token is invalid
-		// so this takes care of invalid and valid token situations
-
-		{"title", "body", u.Token, "", "on", 200},
-		{"title", "body", u.Token, "", "10", 200},
-		{"title", "body", u.Token, "", "-1", 200},
-		{"title", "body", u.Token, "", "1", 200},
-		{"title", "body", u.Token, "", "2", 200},
-		{"title", "body", u.Token, "", "3", 200},
-
-		// All cases below are expected to fail
-		{"title", "body", "invalidtoken", "", "10", 200},
-
-		{"title", "body", "token", "invalidtimestapm", "", 200},
-		{"title", "body", "token", "-11", "", 200},
-		{"", "noTokenNorTitle", "", "", "2", 200},
-		{"", "noTokenNorTitle", "", "", "3", 200},
-		{"", "noTokenNorTitleWithTimeStamp", "", "100", "nn", 200},
+		{"invalidkey", "newpassword", 400, ""},
+		{key, "short", 400, ""},
+		{key, "newpassword", 200, user.Token},
+		// Key can be used only once
+		{key, "otherpassword", 400, ""},
 	}
-
 	for i, data := range testData {
 		form := url.Values{}
-		form.Add("title", data.title)
-		form.Add("body", data.body)
+		form.Add("password", data.password)
+		res, err := http.PostForm(reset.URL+"?key="+data.key, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != data.expectedCode {
+			t.Errorf("Got %d, want %d (run %d)", res.StatusCode, data.expectedCode, i)
+		}
+		if data.expectedString != "" && string(body) != data.expectedString {
+			t.Errorf("Got \"%s\", want \"%s\" (run %d)", body, data.expectedString, i)
+		}
+	}
+
+	user, err = db.GetUser(userEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.ValidatePassword("newpassword") {
+		t.Errorf("Password was not reset")
+	}
+}
+
+func TestEmailHandlers(t *testing.T) {
+	var oldEmail = "oldemail@user.com"
+	var newEmail = "newemail@user.com"
+	var pass = "password"
+
+	change := requireSession(emailHandler)
+	confirm := httptest.NewServer(http.HandlerFunc(emailConfirmHandler))
+	defer confirm.Close()
+
+	user, err := db.NewUser(oldEmail, pass)
+	if err != nil {
+		t.Fatalf("Failed to add user! (%v)", err)
+	}
+	user.Activate()
+	other, err := db.NewUser("otheremail@user.com", pass)
+	if err != nil {
+		t.Fatalf("Failed to add user! (%v)", err)
+	}
+
+	var keys = make(map[string]string)
+	orig := email.SendEmailVerificationEmail
+	email.SendEmailVerificationEmail = func(u *db.User) error {
+		keys[u.PendingEmail] = u.ActivateToken
+		return nil
+	}
+	defer func() { email.SendEmailVerificationEmail = orig }()
+
+	access := accessToken(t, user)
+	var changeData = []struct {
+		access       string
+		newEmail     string
+		expectedCode int
+	}{
+		{"", newEmail, 401},
+		{access, "invalid", 400},
+		{access, other.Email, 409},
+		{access, "takenlater@user.com", 200},
+		{access, newEmail, 200},
+	}
+	for i, data := range changeData {
+		status, _ := postForm(t, change, data.access, url.Values{"newemail": {data.newEmail}})
+		if status != data.expectedCode {
+			t.Errorf("Got %d, want %d (run %d)", status, data.expectedCode, i)
+		}
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Got %d verification emails, want 2", len(keys))
+	}
+	// Email isn't changed before confirming
+	if _, err = db.GetUser(oldEmail); err != nil {
+		t.Errorf("Email was changed before confirming")
+	}
+	// Somebody registers the first address meanwhile
+	if _, err = db.NewUser("takenlater@user.com", pass); err != nil {
+		t.Fatal(err)
+	}
+
+	var confirmData = []struct {
+		email        string
+		key          string
+		expectedCode int
+	}{
+		{newEmail, "wrongkey", 400},
+		// Key of the earlier request was replaced by the later one
+		{"takenlater@user.com", keys["takenlater@user.com"], 400},
+		{newEmail, keys[newEmail], 200},
+		{newEmail, keys[newEmail], 400},
+	}
+	for i, data := range confirmData {
+		res, err := http.Get(fmt.Sprintf("%s?email=%s&key=%s", confirm.URL, url.QueryEscape(data.email), data.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != data.expectedCode {
+			t.Errorf("Got %d, want %d (run %d)", res.StatusCode, data.expectedCode, i)
+		}
+	}
+
+	if _, err = db.GetUser(oldEmail); err == nil {
+		t.Errorf("Old email still works")
+	}
+	changed, err := db.GetUser(newEmail)
+	if err != nil {
+		t.Fatalf("New email doesn't work (%v)", err)
+	}
+	if changed.ID != user.ID || changed.PendingEmail != "" {
+		t.Errorf("Email of wrong user was changed or pending email not cleared")
+	}
+}
+
+func TestAccountHandlers(t *testing.T) {
+	var userEmail = "account@user.com"
+	var pass = "password"
+
+	user, err := db.NewUser(userEmail, pass)
+	if err != nil {
+		t.Fatalf("Failed to add user! (%v)", err)
+	}
+	user.Activate()
+	token := user.Token
+
+	p, err := db.SavePushData("title", "body", token, "", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.RegisterGCMClient("accountgcm", token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.RegisterDevice("laptop", token); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = db.CreateTopic("account-topic", token); err != nil {
+		t.Fatal(err)
+	}
+	_, key, err := db.NewAPIKey(token, "script", []string{db.ScopePublish}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan *db.PushData, 1)
+	id, kicked := tcp.AddToPool(token, nil, nil, c)
+	defer tcp.RemoveFromPool(token, id)
+
+	access := accessToken(t, user)
+
+	// Export
+	exportHandler := requireSession(exportAccountHandler)
+	if status, _ := postForm(t, exportHandler, "", url.Values{"email": {userEmail}, "password": {pass}}); status != 401 {
+		t.Errorf("Export: got %d, want %d without access token", status, 401)
+	}
+	status, body := postForm(t, exportHandler, access, url.Values{})
+	if status != 200 {
+		t.Fatalf("Export: got %d, want %d", status, 200)
+	}
+	for _, secret := range []string{token, key, user.Password} {
+		if strings.Contains(string(body), secret) {
+			t.Errorf("Export contains secret %s", secret)
+		}
+	}
+	var export db.AccountExport
+	if err = json.Unmarshal(body, &export); err != nil {
+		t.Fatal(err)
+	}
+	if export.Email != userEmail || len(export.Pushes) != 1 || export.Pushes[0].ID != p.ID {
+		t.Errorf("Export has wrong user or pushes (%s)", body)
+	}
+	if len(export.Devices) != 2 || len(export.OwnedTopics) != 1 || len(export.APIKeys) != 1 {
+		t.Errorf("Export has wrong devices, topics or keys (%s)", body)
+	}
+
+	// Delete
+	var testData = []struct {
+		access       string
+		expectedCode int
+	}{
+		{"", 401},
+		{access, 200},
+		// Sessions are deleted with the account
+		{access, 401},
+	}
+	for i, data := range testData {
+		status, _ := postForm(t, requireSession(deleteAccountHandler), data.access, url.Values{})
+		if status != data.expectedCode {
+			t.Errorf("Delete: got %d, want %d (run %d)", status, data.expectedCode, i)
+		}
+	}
+
+	select {
+	case <-kicked:
+	case <-time.After(time.Second):
+		t.Errorf("Live client was not disconnected")
+	}
+	if _, err = db.GetUser(userEmail); err == nil {
+		t.Errorf("User was not deleted")
+	}
+	if _, err = db.GetPushDataByID(p.ID); err == nil {
+		t.Errorf("Push was not deleted")
+	}
+	if _, err = db.GetGCMClient("accountgcm"); err == nil {
+		t.Errorf("GCM client was not deleted")
+	}
+	if _, err = db.GetTopic("account-topic"); err == nil {
+		t.Errorf("Topic was not deleted")
+	}
+	if _, err = db.ResolveToken(key, db.ScopePublish); err == nil {
+		t.Errorf("API key still works")
+	}
+	// Email can be registered again
+	if _, err = db.NewUser(userEmail, pass); err != nil {
+		t.Errorf("Failed to register deleted email again (%v)", err)
+	}
+}
+
+func TestRotateTokenHandler(t *testing.T) {
+	var email = "rotate@user.com"
+	var pass = "password"
+
+	user, err := db.NewUser(email, pass)
+	if err != nil {
+		t.Fatalf("Failed to add user! (%v)", err)
+	}
+	user.Activate()
+	old := user.Token
+	access := accessToken(t, user)
+
+	c := make(chan *db.PushData, 1)
+	id, kicked := tcp.AddToPool(old, nil, nil, c)
+	defer tcp.RemoveFromPool(old, id)
+
+	var testData = []struct {
+		access       string
+		grace        string
+		expectedCode int
+	}{
+		{"", "", 401},
+		{"invalid", "", 401},
+		{access, "-1", 400},
+		{access, "60", 200},
+	}
+
+	for i, data := range testData {
+		form := url.Values{}
+		form.Add("email", email)
+		form.Add("password", pass)
+		form.Add("grace", data.grace)
+
+		status, body := postForm(t, requireSession(rotateTokenHandler), data.access, form)
+		if status != data.expectedCode {
+			t.Errorf("Got %d, want %d (run %d)", status, data.expectedCode, i)
+		}
+		if data.expectedCode == 200 {
+			if string(body) == old {
+				t.Errorf("Token was not rotated (run %d)", i)
+			}
+			if _, err := db.GetUserByToken(string(body)); err != nil {
+				t.Errorf("New token is not valid (%v) (run %d)", err, i)
+			}
+		}
+	}
+
+	select {
+	case <-kicked:
+	case <-time.After(time.Second):
+		t.Errorf("Live client of old token was not disconnected")
+	}
+}
+
+func TestAPIKeysOldToken(t *testing.T) {
+	u, err := db.NewUser("apikeysold@user.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to add user! (%v)", err)
+	}
+	u.Activate()
+	old := u.Token
+	token, err := u.RotateToken(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Old token still works during grace period, but keys belong to the
+	// new token
+	k, _, e := createAPIKey(old, "ci", []string{db.ScopeRead}, 0)
+	if e != nil {
+		t.Fatalf("Failed to create API key (%v)", e)
+	}
+	if k.Token != token {
+		t.Errorf("Got key for token %q, want %q", k.Token, token)
+	}
+	keys, e := listAPIKeys(old)
+	if e != nil || len(keys) != 1 || keys[0].ID != k.ID {
+		t.Errorf("Unexpected keys (%v) (%v)", keys, e)
+	}
+	if e = revokeAPIKey(old, k.ID); e != nil {
+		t.Errorf("Failed to revoke API key (%v)", e)
+	}
+	if keys = db.GetAPIKeys(token); len(keys) != 0 {
+		t.Errorf("Expected 0 keys, got %d", len(keys))
+	}
+}
+
+func TestActivateUserHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(activateUserHandler))
+	defer ts.Close()
+
+	// Register the user
+	email := "activateuser@domain.com"
+
+	user, err := db.NewUser(email, "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testData = []struct {
+		Email        string
+		Key          string
+		ExpectedCode int
+	}{
+		{user.Email, "foo", 400},
+		{"fail@domain.com", user.ActivateToken, 400},
+		{user.Email, user.ActivateToken, 200},
+	}
+
+	for _, data := range testData {
+		res, err := http.Get(fmt.Sprintf("%s?email=%s&key=%s", ts.URL, data.Email, data.Key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.ExpectedCode != res.StatusCode {
+			t.Errorf("Expected %v, got %v instead", data.ExpectedCode, res.StatusCode)
+		}
+	}
+	user, err = db.GetUser(email)
+	if err != nil {
+		t.Fatalf("Failed to get user with GetUser(%v)", email)
+	}
+	if user.Active == false {
+		t.Error("User.Active == false after activation!")
+	}
+	res, _ := http.Get(fmt.Sprintf("%s/", ts.URL))
+	if res.StatusCode != 400 {
+		t.Error("URI with no email or key should have returned 400")
+	}
+	res, _ = http.Get(fmt.Sprintf("%s/asd/", ts.URL))
+	if res.StatusCode != 400 {
+		t.Error("URI with ivalid data should have returned 400")
+	}
+}
+
+func TestActivateUserHandlerExpired(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(activateUserHandler))
+	defer ts.Close()
+
+	email := "activateexpired@domain.com"
+	user, err := db.NewUser(email, "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.ActivateToken) != 32 {
+		t.Errorf("Got activation key of length %d, want 32", len(user.ActivateToken))
+	}
+	user.ActivateExpires = time.Now().Add(-time.Minute)
+	user.Save()
+
+	res, err := http.Get(fmt.Sprintf("%s?email=%s&key=%s", ts.URL, email, user.ActivateToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 400 {
+		t.Errorf("Expired key: expected %v, got %v instead", 400, res.StatusCode)
+	}
+
+	// Registering again doesn't take the account over
+	if _, err = db.NewUser(email, "newpassword"); err == nil {
+		t.Errorf("Registering email of unactivated user should fail")
+	}
+
+	// Resending needs the password, and gives new key which works
+	if status, _ := postForm(t, resendActivationHandler, "", url.Values{"email": {email}, "password": {"wrongpassword"}}); status != 401 {
+		t.Errorf("Resend with wrong password: expected %v, got %v instead", 401, status)
+	}
+	if status, _ := postForm(t, resendActivationHandler, "", url.Values{"email": {email}, "password": {"password123"}}); status != 200 {
+		t.Fatalf("Resend: expected %v, got %v instead", 200, status)
+	}
+	again, err := db.GetUser(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ActivateToken == user.ActivateToken {
+		t.Errorf("Activation key was not renewed")
+	}
+	res, err = http.Get(fmt.Sprintf("%s?email=%s&key=%s", ts.URL, email, again.ActivateToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Errorf("Renewed key: expected %v, got %v instead", 200, res.StatusCode)
+	}
+	user, err = db.GetUser(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Active || !user.ValidatePassword("password123") {
+		t.Errorf("User should be active with the original password")
+	}
+
+	if status, _ := postForm(t, resendActivationHandler, "", url.Values{"email": {email}, "password": {"password123"}}); status != 400 {
+		t.Errorf("Resend for active user: expected %v, got %v instead", 400, status)
+	}
+}
+
+func TestRegisterHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(registerHandler))
+	defer ts.Close()
+
+	emailDone := false
+	// Mock for this test
+	// NOTE: We'll are only waiting for one valid email address
+	email.SendRegistrationEmail = func(u *db.User) error {
+		if u.Active != false {
+			t.Error("User.Active should be false!")
+		}
+		expecting := "valid@email.com"
+		if u.Email != expecting {
+			t.Errorf("Expected %v, got %v instead", expecting, u.Email)
+		} else {
+			emailDone = true
+		}
+		return nil
+	}
+
+	var testData = []struct {
+		email          string
+		password       string
+		expectedCode   int
+		expectedString string
+	}{
+		{"", "", 400, emailpassRequiredRegexString},
+		{"email@isnot_enough.com", "", 400, emailpassRequiredRegexString},
+		{"", "passwordisnotenough", 400, emailpassRequiredRegexString},
+		{"valid@email.com", "validpassword", 200, "Activation link was sent by email"},
+		{"valid@email.com", "validpassword", 400, userExistsRegexString},
+	}
+
+	for i, data := range testData {
+		form := url.Values{}
+		form.Add("email", data.email)
+		form.Add("password", data.password)
+
+		res, err := http.PostForm(ts.URL, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != data.expectedCode {
+			t.Errorf("Got %d, want %d (run %d)", res.StatusCode, data.expectedCode, i)
+		}
+		ok, err := regexp.Match(data.expectedString, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Errorf("Got \"%s\", want string matching regex \"%s\" (run %d)", body, data.expectedString, i)
+		}
+	}
+
+	// Check that SendRegistrationEmail was ran
+	if !emailDone {
+		t.Error("email.SendRegistrationEmail was not called!")
+	}
+
+	// Test the skipEmailVerification = true
+	//config.Config.AddOption("registration", "skipEmailVerification", "true")
+	skipEmailVerification = true // Simulate the above
+	semail := "skip@activation.com"
+	form := url.Values{}
+	form.Add("email", semail)
+	form.Add("password", "password123")
+
+	res, err := http.PostForm(ts.URL, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := regexp.Match(tokenRegexString, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Errorf("Got \"%s\", want string matching regex \"%s\"", body, tokenRegexString)
+	}
+
+	// Check the user.Active state
+	user, err := db.GetUser(semail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Active != true {
+		t.Errorf("User.Active should be true since skipEmailVerification option was set to true in configuration!")
+	}
+	skipEmailVerification = false // Reset
+}
+
+func TestPushHandler(t *testing.T) {
+	/*
+		PushHander doesnt care if the token is valid or not, so we dont check
+		the return messages because those will only contain error messages
+		to user, if even those.
+
+		Also, was the priority whatever, it shouldn't cause any problem
+	*/
+
+	ts := httptest.NewServer(http.HandlerFunc(pushHandler))
+	defer ts.Close()
+
+	// Backup to restore
+	oClientsFromPool := tcp.ClientsFromPool
+	defer func() {
+		tcp.ClientsFromPool = oClientsFromPool
+	}()
+
+	tcpcount := 0
+	tcp.ClientsFromPool = func(token string) []chan<- *db.PushData {
+		tcpcount++
+		return nil
+	}
+
+	u, err := db.NewUser("push@test1.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to craete new user (%v)", err)
+	}
+
+	var testData = []struct {
+		title        string
+		body         string
+		token        string
+		timestamp    string
+		priority     string
+		expectedCode int
+	}{
+		// Server doesnt notify user if the token is invalid
+		// so this takes care of invalid and valid token situations
+
+		{"title", "body", u.Token, "", "on", 200},
+		{"title", "body", u.Token, "", "10", 200},
+		{"title", "body", u.Token, "", "-1", 200},
+		{"title", "body", u.Token, "", "1", 200},
+		{"title", "body", u.Token, "", "2", 200},
+		{"title", "body", u.Token, "", "3", 200},
+
+		// All cases below are expected to fail
+		{"title", "body", "invalidtoken", "", "10", 200},
+
+		{"title", "body", "token", "invalidtimestapm", "", 200},
+		{"title", "body", "token", "-11", "", 200},
+		{"", "noTokenNorTitle", "", "", "2", 200},
+		{"", "noTokenNorTitle", "", "", "3", 200},
+		{"", "noTokenNorTitleWithTimeStamp", "", "100", "nn", 200},
+	}
+
+	for i, data := range testData {
+		form := url.Values{}
+		form.Add("title", data.title)
+		form.Add("body", data.body)
+		form.Add("token", data.token)
+		form.Add("timestamp", data.timestamp)
+		form.Add("priority", data.priority)
+
+		res, err := http.PostForm(ts.URL, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != data.expectedCode {
+			t.Errorf("Got %d, want %d (run %d)", res.StatusCode, data.expectedCode, i)
+		}
+	}
+
+	if tcpcount != 5 {
+		t.Errorf("tcp.ClientsFromPool call count was unexpected (expected %v, got %v)", 5, tcpcount)
+	}
+
+	var mu sync.Mutex
+	id1 := false
+	id2 := false
+	utils.SendFCM = func(regIds []string, data map[string]string) []utils.FCMResult {
+		mu.Lock()
+		defer mu.Unlock()
+		if data["title"] != "title" || data["body"] != "body" {
+			t.Errorf("utils.SendFCM was called with unexpected data (%v)", data)
+		}
+		for _, id := range regIds {
+			switch id {
+			case "id1":
+				id1 = true
+				break
+			case "id2":
+				id2 = true
+				break
+			default:
+				t.Errorf("Got unexpected ID in utils.SendFCM (%v)", id)
+				break
+			}
+		}
+		return nil
+	}
+
+	u, err = db.NewUser("gen@user.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.RegisterGCMClient("id1", u.Token)
+	db.RegisterGCMClient("id2", u.Token)
+
+	form := url.Values{}
+	form.Add("title", "title")
+	form.Add("body", "body")
+	form.Add("token", u.Token)
+	form.Add("timestamp", "0")
+
+	_, err = http.PostForm(ts.URL, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every client is sent to by its own queued job
+	if !waitFor(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return id1 && id2
+	}) {
+		t.Errorf("utils.SendFCM was not called for every client!")
+	}
+}
+
+func TestPushHandlerFanOut(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(pushHandler))
+	defer ts.Close()
+
+	u, err := db.NewUser("fanout@test.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+
+	c1 := make(chan *db.PushData, 1)
+	c2 := make(chan *db.PushData, 1)
+	full := make(chan *db.PushData) // Never has room, so push is dropped for it
+	for _, c := range []chan *db.PushData{c1, c2, full} {
+		id, _ := tcp.AddToPool(u.Token, nil, nil, c)
+		defer tcp.RemoveFromPool(u.Token, id)
+	}
+
+	form := url.Values{}
+	form.Add("title", "fanout")
+	form.Add("token", u.Token)
+	res, err := http.PostForm(ts.URL, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	for i, c := range []chan *db.PushData{c1, c2} {
+		select {
+		case p := <-c:
+			if p.Title != "fanout" {
+				t.Errorf("Got unexpected title %q (client %d)", p.Title, i)
+			}
+		default:
+			t.Errorf("Client %d didn't receive the push", i)
+		}
+	}
+}
+
+func TestPoolHandler(t *testing.T) {
+	var pushToken string
+	var pushTitle = "title"
+	var pushBody = "body"
+	var pushURL = "www.ddg.gg"
+	var pushTime = time.Now().Unix()
+
+	ts := httptest.NewServer(http.HandlerFunc(poolHandler))
+	defer ts.Close()
+
+	// Add user
+	user, err := db.NewUser("pooluser@domain.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user! (%v)", err)
+	}
+	pushToken = user.Token
+
+	// Add push data
+	_, err = db.SavePushData(pushTitle, pushBody, pushToken, pushURL, pushTime, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The actual testing
+	var testData = []struct {
+		token          string
+		expectingValid bool
+		expectedCode   int
+	}{
+		{pushToken, true, 200},
+		{"invalidtoken", false, 200},
+		{"invalid", false, 200},
+	}
+	type validDataStrcut struct {
+		UnixTimeStamp int64
+		Title         string
+		Body          string
+		URL           string
+	}
+
+	for i, data := range testData {
+		form := url.Values{}
+		form.Add("token", data.token)
+
+		res, err := http.PostForm(ts.URL, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != data.expectedCode {
+			t.Errorf("Go %v status code, want %d (run %d)", res.StatusCode, data.expectedCode, i)
+		}
+
+		if data.expectingValid {
+			v := &validDataStrcut{}
+			err = json.Unmarshal(body, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Body != pushBody {
+				t.Errorf("Got \"%v\" in body, want \"%s\"", v.Body, pushBody)
+			}
+			if v.Title != pushTitle {
+				t.Errorf("Got \"%v\" in title, want \"%s\"", v.Title, pushTitle)
+			}
+			if v.UnixTimeStamp != pushTime {
+				t.Errorf("Got \"%v\" in time, want \"%d\"", v.UnixTimeStamp, pushTime)
+			}
+			if v.URL != pushURL {
+				t.Errorf("Got \"%v\" in time, want \"%v\"", v.URL, pushURL)
+			}
+		}
+	}
+}
+
+func TestPoolHandlerDevices(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(poolHandler))
+	defer ts.Close()
+
+	user, err := db.NewUser("pooldevices@domain.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user! (%v)", err)
+	}
+	if _, err = db.SavePushData("title", "body", user.Token, "", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var testData = []struct {
+		device        string
+		expectingData bool
+	}{
+		{"laptop", true},
+		{"desktop", true},  // Other device still gets the push
+		{"laptop", false},  // Already delivered to this device
+		{"", true},         // Default device
+		{"desktop", false}, // Already delivered to this device
+		{"", false},        // Already delivered to default device
+	}
+
+	for i, data := range testData {
+		form := url.Values{}
+		form.Add("token", user.Token)
+		form.Add("device", data.device)
+
+		res, err := http.PostForm(ts.URL, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.expectingData && len(body) == 0 {
+			t.Errorf("Expected push data, got nothing (run %d)", i)
+		} else if !data.expectingData && len(body) != 0 {
+			t.Errorf("Expected nothing, got \"%s\" (run %d)", body, i)
+		}
+	}
+}
+
+func TestDeviceHandlers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(deviceRegisterHandler))
+	defer ts.Close()
+	ts2 := httptest.NewServer(http.HandlerFunc(deviceUnregisterHandler))
+	defer ts2.Close()
+
+	u, err := db.NewUser("devices@domain.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+
+	var testData = []struct {
+		token        string
+		device       string
+		expectedCode int
+	}{
+		{"", "", 400},
+		{u.Token, "", 400},
+		{"invalidtoken", "phone", 404},
+		{u.Token, "phone", 200},
+		{u.Token, "phone", 200}, // Already registered
+	}
+
+	for i, data := range testData {
+		form := url.Values{}
+		form.Add("token", data.token)
+		form.Add("device", data.device)
+		res, err := http.PostForm(ts.URL, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != data.expectedCode {
+			t.Errorf("Expected %v but got %v instead! (run %d)", data.expectedCode, res.StatusCode, i)
+		}
+	}
+
+	if _, err = db.GetDevice("phone", u.Token); err != nil {
+		t.Fatalf("Device was not registered (%v)", err)
+	}
+
+	form := url.Values{}
+	form.Add("token", u.Token)
+	form.Add("device", "phone")
+	res, err := http.PostForm(ts2.URL, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if _, err = db.GetDevice("phone", u.Token); err == nil {
+		t.Errorf("Device should be deleted but is not")
+	}
+}
+
+func TestGCMRegisterHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(gcmRegisterHandler))
+	defer ts.Close()
+
+	u1, err := db.NewUser("gcm1@gcm.com", "password")
+	u2, err := db.NewUser("gcm2@gcm.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create users (%v)", err)
+	}
+
+	token := u1.Token
+	token2 := u2.Token
+	var testData = []struct {
+		token        string
+		gcmid        string
+		expectedCode int
+	}{
+		{"", "", 400},
+		{token, "gcmid", 200},
+		{token, "gcmid", 200},  // Same token, should just pass
+		{token2, "gcmid", 200}, // Update the token
+		{token, "gcmid2", 200},
+		{"footoken", "foobar", 404}, // invalid token
+	}
+
+	for _, data := range testData {
+		form := url.Values{}
 		form.Add("token", data.token)
-		form.Add("timestamp", data.timestamp)
-		form.Add("priority", data.priority)
+		form.Add("gcmid", data.gcmid)
+
+		res, err := http.PostForm(ts.URL, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != data.expectedCode {
+			t.Errorf("Expected %v but got %v instead!", data.expectedCode, res.StatusCode)
+		}
+	}
+}
+
+func TestGMCUnregisterHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(gcmUnregisterHandler))
+	defer ts.Close()
+
+	gcmID := "GCMID"
+
+	u, err := db.NewUser("unregistergcm@gcm.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	_, err = db.RegisterGCMClient(gcmID, u.Token)
+	if err != nil {
+		t.Fatalf("Failed to create gcm client (%v)", err)
+	}
+
+	var testData = []struct {
+		gcmid        string
+		expectedCode int
+		entryDeleted bool // flag to check if the entry should be removed
+	}{
+		{"invalidToken", 200, false},
+		{gcmID, 200, true},
+	}
+
+	for _, d := range testData {
+		// Valid - this sould remove the gcm client
+		form := url.Values{}
+		form.Add("gcmid", d.gcmid)
+		res, err := http.PostForm(ts.URL, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != d.expectedCode {
+			t.Errorf("Expected %s but got %s instead!", 200, res.StatusCode)
+		}
+
+		_, err = db.GetGCMClient(gcmID)
+		if d.entryDeleted {
+			if err == nil {
+				t.Errorf("GCMClient should be deleted but is not")
+			}
+		} else {
+			if err != nil {
+				t.Errorf("GCMClient shouldn't be deleted but is")
+			}
+		}
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(sse.HandleSSEClient))
+	defer ts.Close()
+
+	u, err := db.NewUser("stream@user.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+
+	res, err := http.Get(fmt.Sprintf("%s?token=%s", ts.URL, "invalidtoken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("Expected %v, got %v instead", 404, res.StatusCode)
+	}
+
+	res, err = http.Get(fmt.Sprintf("%s?token=%s", ts.URL, u.Token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected %v, got %v instead", 200, res.StatusCode)
+	}
+
+	// Second listener for the same token gets the pushes too
+	res2, err := http.Get(fmt.Sprintf("%s?token=%s", ts.URL, u.Token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res2.Body.Close()
+	if res2.StatusCode != 200 {
+		t.Fatalf("Expected %v, got %v instead", 200, res2.StatusCode)
+	}
+
+	clients := tcp.ClientsFromPool(u.Token)
+	if len(clients) != 2 {
+		t.Fatalf("Expected 2 SSE clients in the pool, got %d", len(clients))
+	}
+	p := &db.PushData{Title: "title", Token: u.Token}
+	data, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, send := range clients {
+		send <- p
+	}
+
+	expected := []string{"event: push\n", fmt.Sprintf("data: %s\n", data), "\n"}
+	for _, r := range []*http.Response{res, res2} {
+		reader := bufio.NewReader(r.Body)
+		for _, want := range expected {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line != want {
+				t.Errorf("Got %q, want %q", line, want)
+			}
+		}
+	}
+}
+
+func TestWSHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(ws.HandleWSClient))
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	u, err := db.NewUser("websocket@user.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+
+	_, res, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s?token=%s", wsURL, "invalidtoken"), nil)
+	if err == nil {
+		t.Error("Expected dial with invalid token to fail")
+	} else if res == nil || res.StatusCode != 404 {
+		t.Errorf("Expected 404 with invalid token (%v)", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s?token=%s", wsURL, u.Token), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	clients := tcp.ClientsFromPool(u.Token)
+	if len(clients) != 1 {
+		t.Fatalf("Expected 1 WebSocket client in the pool, got %d", len(clients))
+	}
+	p, err := db.SavePushData("title", "body", u.Token, "", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients[0] <- p
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	mt, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt != websocket.TextMessage || string(msg) != string(data) {
+		t.Errorf("Got %q (type %d), want %q", msg, mt, data)
+	}
+	if err = conn.WriteMessage(websocket.TextMessage, []byte("ACK")); err != nil {
+		t.Fatal(err)
+	}
+	// Client without device name acknowledges for the default device
+	device, err := db.GetDevice(db.DefaultDeviceName, u.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return p.DeliveredTo(device) }) {
+		t.Errorf("Acknowledged push should be delivered to the default device")
+	}
+
+	// Anything else than ACK closes the connection
+	if err = conn.WriteMessage(websocket.TextMessage, []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseUnsupportedData) {
+		t.Errorf("Expected close frame with code %d, got %v", websocket.CloseUnsupportedData, err)
+	}
+}
+
+func TestWSHandlerOrigin(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(ws.HandleWSClient))
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	u, err := db.NewUser("websocketorigin@user.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	config.Config.AddOption("websocket", "origins", "https://app.example.com, https://other.example.com")
+	ws.LoadConfig()
+	defer func() {
+		config.Config.AddOption("websocket", "origins", "")
+		ws.LoadConfig()
+	}()
+
+	var testData = []struct {
+		origin       string
+		expectedCode int
+	}{
+		{"", 101},                         // Not a browser
+		{ts.URL, 101},                     // Page served by us
+		{"https://app.example.com", 101},  // Allowed origin
+		{"https://evil.example.com", 403}, // Other sites can't connect
+		{"https://app.example.com.evil", 403},
+	}
+	for i, data := range testData {
+		header := http.Header{}
+		if data.origin != "" {
+			header.Set("Origin", data.origin)
+		}
+		conn, res, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s?token=%s", wsURL, u.Token), header)
+		if conn != nil {
+			conn.Close()
+		}
+		if res == nil {
+			t.Fatalf("No response (%v) (run %d)", err, i)
+		}
+		if res.StatusCode != data.expectedCode {
+			t.Errorf("Expected %v, got %v instead (run %d)", data.expectedCode, res.StatusCode, i)
+		}
+	}
+}
+
+// waitFor polls cond until it returns true or a few seconds have passed.
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 50; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	return false
+}
+
+func TestTCPClientAck(t *testing.T) {
+	u, err := db.NewUser("tcpack@user.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	device, err := db.RegisterDevice("laptop", u.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := db.SavePushData("title", "body", u.Token, "", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate earlier connection which never acknowledged the push
+	if err = p.SetSent(device); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go tcp.HandleTCPClient(server)
+
+	if _, err = client.Write([]byte(u.Token)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Write([]byte(":DEVICE laptop\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unacknowledged push is sent again
+	client.SetReadDeadline(time.Now().Add(time.Second * 5))
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &db.PushData{}
+	if err = json.Unmarshal(line, v); err != nil {
+		t.Fatal(err)
+	}
+	if v.ID != p.ID {
+		t.Fatalf("Got push with ID %d, want %d", v.ID, p.ID)
+	}
+	if p.DeliveredTo(device) {
+		t.Errorf("Push shouldn't be delivered before it's acknowledged")
+	}
+
+	if _, err = client.Write([]byte(fmt.Sprintf(":ACK %d\n", p.ID))); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return p.DeliveredTo(device) }) {
+		t.Errorf("Push should be delivered after it's acknowledged")
+	}
+	if n := len(device.UndeliveredPushes()); n != 0 {
+		t.Errorf("Expected 0 undelivered pushes, got %d", n)
+	}
+}
+
+func TestTCPClientLegacyReconnect(t *testing.T) {
+	u, err := db.NewUser("tcplegacy@user.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	u.Activate()
+
+	// connect connects client which doesn't tell its device, delivers new
+	// push and returns the first push client gets
+	connect := func() (int64, *db.PushData) {
+		server, client := net.Pipe()
+		defer client.Close()
+		go tcp.HandleTCPClient(server)
+		if _, err := client.Write([]byte(u.Token)); err != nil {
+			t.Fatal(err)
+		}
+		if !waitFor(func() bool { return len(tcp.ClientsFromPool(u.Token)) > 0 }) {
+			t.Fatalf("Client wasn't added to pool")
+		}
+		p, err := db.SavePushData("title", "body", u.Token, "", 0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliverPush(p)
+		client.SetReadDeadline(time.Now().Add(time.Second * 5))
+		line, err := bufio.NewReader(client).ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := &db.PushData{}
+		if err = json.Unmarshal(line, v); err != nil {
+			t.Fatal(err)
+		}
+		return v.ID, p
+	}
+
+	if id, p := connect(); id != p.ID {
+		t.Fatalf("Got push with ID %d, want %d", id, p.ID)
+	}
+	if !waitFor(func() bool { return len(tcp.ClientsFromPool(u.Token)) == 0 }) {
+		t.Fatalf("Client wasn't removed from pool")
+	}
+	// The push wasn't acknowledged, but client never opted in, so only the
+	// new push is sent on reconnect
+	if id, p := connect(); id != p.ID {
+		t.Errorf("Got push with ID %d, want %d", id, p.ID)
+	}
+	if _, err := db.GetDevice(db.DefaultDeviceName, u.Token); err == nil {
+		t.Errorf("Expected default device not to be registered")
+	}
+}
 
-		res, err := http.PostForm(ts.URL, form)
+func TestTCPClientDeviceReconnect(t *testing.T) {
+	u, err := db.NewUser("tcpdevice@user.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	u.Activate()
+
+	// connect connects client as laptop device and returns the first push
+	// it gets
+	connect := func(deliver func()) int64 {
+		server, client := net.Pipe()
+		defer client.Close()
+		go tcp.HandleTCPClient(server)
+		if _, err := client.Write([]byte(u.Token)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write([]byte(":DEVICE laptop\n")); err != nil {
+			t.Fatal(err)
+		}
+		if deliver != nil {
+			if !waitFor(func() bool {
+				_, err := db.GetDevice("laptop", u.Token)
+				return err == nil
+			}) {
+				t.Fatalf("Device wasn't registered")
+			}
+			deliver()
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second * 5))
+		line, err := bufio.NewReader(client).ReadBytes('\n')
 		if err != nil {
 			t.Fatal(err)
 		}
+		v := &db.PushData{}
+		if err = json.Unmarshal(line, v); err != nil {
+			t.Fatal(err)
+		}
+		return v.ID
+	}
 
-		if res.StatusCode != data.expectedCode {
-			t.Errorf("Got %d, want %d (run %d)", res.StatusCode, data.expectedCode, i)
+	var p *db.PushData
+	id := connect(func() {
+		p, err = db.SavePushData("title", "body", u.Token, "", 0, 1)
+		if err != nil {
+			t.Fatal(err)
 		}
+		deliverPush(p)
+	})
+	if id != p.ID {
+		t.Fatalf("Got push with ID %d, want %d", id, p.ID)
+	}
+	if !waitFor(func() bool { return len(tcp.ClientsFromPool(u.Token)) == 0 }) {
+		t.Fatalf("Client wasn't removed from pool")
+	}
+	// The push wasn't acknowledged, so it's sent again on reconnect
+	if id = connect(nil); id != p.ID {
+		t.Errorf("Got push with ID %d, want %d", id, p.ID)
 	}
+	// Nothing was sent to the default device
+	if _, err := db.GetDevice(db.DefaultDeviceName, u.Token); err == nil {
+		t.Errorf("Expected default device not to be registered")
+	}
+}
 
-	if tcpcount != 5 {
-		t.Errorf("tcp.ClientFromPool call count was unexpected (expected %v, got %v)", 5, tcpcount)
+func TestTCPClientAPIKeyRevoked(t *testing.T) {
+	u, err := db.NewUser("tcpkey@user.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	k, key, err := db.NewAPIKey(u.Token, "reader", []string{db.ScopeRead}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, expiring, err := db.NewAPIKey(u.Token, "short", []string{db.ScopeRead}, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	count := 0
-	id1 := false
-	id2 := false
-	utils.SendGcmPing = func(regIds []string) {
-		for _, id := range regIds {
-			switch id {
-			case "id1":
-				id1 = true
-				break
-			case "id2":
-				id2 = true
-				break
-			default:
-				t.Errorf("Got unexpected ID in utils.SendGcmPing (%v)", id)
-				break
+	// connect connects client with credential and returns the lines it gets
+	connect := func(credential string) <-chan string {
+		server, client := net.Pipe()
+		go tcp.HandleTCPClient(server)
+		if _, err := client.Write([]byte(credential)); err != nil {
+			t.Fatal(err)
+		}
+		lines := make(chan string, 10)
+		go func() {
+			defer client.Close()
+			defer close(lines)
+			r := bufio.NewReader(client)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				lines <- line
+			}
+		}()
+		return lines
+	}
+	kicked := func(lines <-chan string) bool {
+		timeout := time.After(time.Second * 5)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return false
+				}
+				if line == "Token revoked\n" {
+					return true
+				}
+			case <-timeout:
+				return false
 			}
 		}
-		count++
 	}
 
-	u, err = db.NewUser("gen@user.com", "password")
+	connect(u.Token)
+	keyLines := connect(key)
+	expiringLines := connect(expiring)
+	if !waitFor(func() bool { return len(tcp.ClientsFromPool(u.Token)) == 3 }) {
+		t.Fatalf("Clients weren't added to pool")
+	}
+
+	if e := revokeAPIKey(u.Token, k.ID); e != nil {
+		t.Fatal(e)
+	}
+	if !kicked(keyLines) {
+		t.Errorf("Client of revoked key was not disconnected")
+	}
+	if !kicked(expiringLines) {
+		t.Errorf("Client of expired key was not disconnected")
+	}
+	if n := len(tcp.ClientsFromPool(u.Token)); n != 1 {
+		t.Errorf("Client of the token should stay connected (%d clients in pool)", n)
+	}
+	tcp.DisconnectFromPool(u.Token)
+}
+
+func TestTCPClientOldTokenExpired(t *testing.T) {
+	u, err := db.NewUser("tcpoldtoken@user.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	u.Activate()
+	old := u.Token
+	token, err := u.RotateToken(time.Second)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	db.RegisterGCMClient("id1", u.Token)
-	db.RegisterGCMClient("id2", u.Token)
+	// connect connects client with credential and returns channel which is
+	// closed when the client is disconnected
+	connect := func(credential string) <-chan struct{} {
+		server, client := net.Pipe()
+		go tcp.HandleTCPClient(server)
+		if _, err := client.Write([]byte(credential)); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer client.Close()
+			defer close(done)
+			r := bufio.NewReader(client)
+			for {
+				if _, err := r.ReadString('\n'); err != nil {
+					return
+				}
+			}
+		}()
+		return done
+	}
 
-	form := url.Values{}
-	form.Add("title", "title")
-	form.Add("body", "body")
-	form.Add("token", u.Token)
-	form.Add("timestamp", "0")
+	connect(token)
+	oldDone := connect(old)
+	if !waitFor(func() bool { return len(tcp.ClientsFromPool(token)) == 2 }) {
+		t.Fatalf("Clients weren't added to pool")
+	}
 
-	_, err = http.PostForm(ts.URL, form)
+	select {
+	case <-oldDone:
+	case <-time.After(time.Second * 5):
+		t.Errorf("Client of old token was not disconnected after grace period")
+	}
+	if n := len(tcp.ClientsFromPool(token)); n != 1 {
+		t.Errorf("Client of the new token should stay connected (%d clients in pool)", n)
+	}
+	tcp.DisconnectFromPool(token)
+}
+
+func TestTCPClientSince(t *testing.T) {
+	u, err := db.NewUser("tcpsince@user.com", "password")
 	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	var ids []int64
+	for _, priority := range []int64{1, 3, 2} {
+		p, err := db.SavePushData("title", "body", u.Token, "", 0, priority)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, p.ID)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go tcp.HandleTCPClient(server)
+	reader := bufio.NewReader(client)
+
+	readID := func() int64 {
+		client.SetReadDeadline(time.Now().Add(time.Second * 5))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := &db.PushData{}
+		if err = json.Unmarshal(line, v); err != nil {
+			t.Fatal(err)
+		}
+		return v.ID
+	}
+
+	if _, err = client.Write([]byte(u.Token)); err != nil {
 		t.Fatal(err)
 	}
 
-	if count != 1 {
-		t.Errorf("utils.SendGcmPing was not called!")
+	// Priority 3 push is not replayed
+	if _, err = client.Write([]byte(fmt.Sprintf(":SINCE %d\n", ids[0]))); err != nil {
+		t.Fatal(err)
 	}
-	if !id1 || !id2 {
-		t.Errorf("utils.SendGcmPing was called with invalid IDs!")
+	if id := readID(); id != ids[2] {
+		t.Errorf("Got push with ID %d, want %d", id, ids[2])
 	}
-}
 
-func TestPoolHandler(t *testing.T) {
-	var pushToken string
-	var pushTitle = "title"
-	var pushBody = "body"
-	var pushURL = "www.ddg.gg"
-	var pushTime = time.Now().Unix()
+	if _, err = client.Write([]byte(":SINCE @0\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int64{ids[0], ids[2]} {
+		if id := readID(); id != want {
+			t.Errorf("Got push with ID %d, want %d", id, want)
+		}
+	}
+}
 
-	ts := httptest.NewServer(http.HandlerFunc(poolHandler))
+func TestWebPushSubscribeHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(webPushSubscribeHandler))
 	defer ts.Close()
+	pushServer := httptest.NewServer(http.HandlerFunc(pushHandler))
+	defer pushServer.Close()
 
-	// Add user
-	user, err := db.NewUser("pooluser@domain.com", "password")
-	if err != nil {
-		t.Fatalf("Failed to create user! (%v)", err)
-	}
-	pushToken = user.Token
-
-	// Add push data
-	_, err = db.SavePushData(pushTitle, pushBody, pushToken, pushURL, pushTime, 1)
+	u, err := db.NewUser("webpush@user.com", "password")
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("Failed to create user (%v)", err)
 	}
 
-	// The actual testing
 	var testData = []struct {
-		token          string
-		expectingValid bool
-		expectedCode   int
+		token        string
+		endpoint     string
+		expectedCode int
 	}{
-		{pushToken, true, 200},
-		{"invalidtoken", false, 200},
-		{"invalid", false, 200},
-	}
-	type validDataStrcut struct {
-		UnixTimeStamp int64
-		Title         string
-		Body          string
-		URL           string
+		{"", "", 400},
+		{u.Token, "", 400},
+		{"invalidtoken", "https://push.example.com/1", 404},
+		// Only public https endpoints
+		{u.Token, "http://push.example.com/1", 400},
+		{u.Token, "https://localhost/1", 400},
+		{u.Token, "https://10.0.0.1/1", 400},
+		{u.Token, "https://169.254.169.254/latest/meta-data/", 400},
+		{u.Token, "https://push.example.com/1", 200},
+		{u.Token, "https://push.example.com/1", 200}, // Updates existing
+		{u.Token, "https://push.example.com/2", 200},
 	}
 
 	for i, data := range testData {
 		form := url.Values{}
 		form.Add("token", data.token)
-
+		form.Add("endpoint", data.endpoint)
+		form.Add("p256dh", "key")
+		form.Add("auth", "secret")
 		res, err := http.PostForm(ts.URL, form)
 		if err != nil {
 			t.Fatal(err)
 		}
-		body, err := ioutil.ReadAll(res.Body)
 		res.Body.Close()
-		if err != nil {
-			t.Fatal(err)
+		if res.StatusCode != data.expectedCode {
+			t.Errorf("Expected %v but got %v instead! (run %d)", data.expectedCode, res.StatusCode, i)
 		}
+	}
 
-		if res.StatusCode != data.expectedCode {
-			t.Errorf("Go %v status code, want %d (run %d)", res.StatusCode, data.expectedCode, i)
+	// Pushes are sent to every subscription and gone ones are deleted
+	oSendWebPush := utils.SendWebPush
+	defer func() {
+		utils.SendWebPush = oSendWebPush
+	}()
+	sent := make(chan string, 2)
+	utils.SendWebPush = func(sub utils.WebPushSubscription, payload []byte) error {
+		sent <- sub.Endpoint
+		if sub.Endpoint == "https://push.example.com/2" {
+			return utils.ErrWebPushGone
 		}
+		return nil
+	}
 
-		if data.expectingValid {
-			v := &validDataStrcut{}
-			err = json.Unmarshal(body, v)
-			if err != nil {
-				t.Fatal(err)
-			}
-			if v.Body != pushBody {
-				t.Errorf("Got \"%v\" in body, want \"%s\"", v.Body, pushBody)
-			}
-			if v.Title != pushTitle {
-				t.Errorf("Got \"%v\" in title, want \"%s\"", v.Title, pushTitle)
-			}
-			if v.UnixTimeStamp != pushTime {
-				t.Errorf("Got \"%v\" in time, want \"%d\"", v.UnixTimeStamp, pushTime)
-			}
-			if v.URL != pushURL {
-				t.Errorf("Got \"%v\" in time, want \"%v\"", v.URL, pushURL)
-			}
+	form := url.Values{}
+	form.Add("title", "title")
+	form.Add("token", u.Token)
+	res, err := http.PostForm(pushServer.URL, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-sent:
+		case <-time.After(time.Second * 5):
+			t.Fatal("utils.SendWebPush was not called for every subscription")
 		}
 	}
+	if !waitFor(func() bool {
+		_, err := db.GetWebPushSubscription("https://push.example.com/2")
+		return err != nil
+	}) {
+		t.Errorf("Gone subscription should be deleted but is not")
+	}
+	if _, err = db.GetWebPushSubscription("https://push.example.com/1"); err != nil {
+		t.Errorf("Subscription shouldn't be deleted but is")
+	}
 }
 
-func TestGCMRegisterHandler(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(gcmRegisterHandler))
+func TestAPNSRegisterHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(apnsRegisterHandler))
 	defer ts.Close()
 
-	u1, err := db.NewUser("gcm1@gcm.com", "password")
-	u2, err := db.NewUser("gcm2@gcm.com", "password")
+	u1, err := db.NewUser("apns1@apns.com", "password")
+	u2, err := db.NewUser("apns2@apns.com", "password")
 	if err != nil {
 		t.Fatalf("Failed to create users (%v)", err)
 	}
 
-	token := u1.Token
-	token2 := u2.Token
+	deviceToken := strings.Repeat("0f", 32)
 	var testData = []struct {
 		token        string
-		gcmid        string
+		devicetoken  string
 		expectedCode int
 	}{
 		{"", "", 400},
-		{token, "gcmid", 200},
-		{token, "gcmid", 200},  // Same token, should just pass
-		{token2, "gcmid", 200}, // Update the token
-		{token, "gcmid2", 200},
-		{"footoken", "foobar", 500}, // invalid token
+		{u1.Token, "", 400},
+		{u1.Token, "devicetoken", 400},
+		{u1.Token, "../../3/device/" + deviceToken, 400},
+		{u1.Token, deviceToken, 200},
+		{u1.Token, deviceToken, 200},
+		{u2.Token, deviceToken, 200}, // Moves to the other token
+		{"footoken", deviceToken, 404},
 	}
 
 	for _, data := range testData {
 		form := url.Values{}
 		form.Add("token", data.token)
-		form.Add("gcmid", data.gcmid)
+		form.Add("devicetoken", data.devicetoken)
 
 		res, err := http.PostForm(ts.URL, form)
 		if err != nil {
@@ -489,54 +2139,155 @@ func TestGCMRegisterHandler(t *testing.T) {
 			t.Errorf("Expected %v but got %v instead!", data.expectedCode, res.StatusCode)
 		}
 	}
-}
-
-func TestGMCUnregisterHandler(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(gcmUnregisterHandler))
-	defer ts.Close()
-
-	gcmID := "GCMID"
 
-	u, err := db.NewUser("unregistergcm@gcm.com", "password")
+	a, err := db.GetAPNSClient(deviceToken)
 	if err != nil {
-		t.Fatalf("Failed to create user (%v)", err)
+		t.Fatal(err)
 	}
-	_, err = db.RegisterGCMClient(gcmID, u.Token)
+	if a.Token != u2.Token {
+		t.Errorf("APNSClient should belong to %s but belongs to %s", u2.Token, a.Token)
+	}
+}
+
+func TestTopicHandlers(t *testing.T) {
+	owner, err := db.NewUser("topics1@topics.com", "password")
+	subscriber, err := db.NewUser("topics2@topics.com", "password")
+	outsider, err := db.NewUser("topics3@topics.com", "password")
 	if err != nil {
-		t.Fatalf("Failed to create gcm client (%v)", err)
+		t.Fatalf("Failed to create users (%v)", err)
+	}
+
+	oClientsFromPool := tcp.ClientsFromPool
+	defer func() {
+		tcp.ClientsFromPool = oClientsFromPool
+	}()
+	var mu sync.Mutex
+	received := make(map[string]string)
+	topicOf := func(token string) (string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		topic, ok := received[token]
+		return topic, ok
+	}
+	tcp.ClientsFromPool = func(token string) []chan<- *db.PushData {
+		c := make(chan *db.PushData, 1)
+		go func() {
+			p := <-c
+			mu.Lock()
+			received[token] = p.Topic
+			mu.Unlock()
+		}()
+		return []chan<- *db.PushData{c}
+	}
+
+	ownerAccess := accessToken(t, owner)
+	subscriberAccess := accessToken(t, subscriber)
+	outsiderAccess := accessToken(t, outsider)
+
+	post := func(handler http.HandlerFunc, access string, values map[string]string) (int, string) {
+		form := url.Values{}
+		for k, v := range values {
+			form.Add(k, v)
+		}
+		code, body := postForm(t, handler, access, form)
+		return code, string(body)
 	}
+	create := requireSession(createTopicHandler)
+	subscribe := requireSession(subscribeTopicHandler)
+	unsubscribe := requireSession(topicHandler(unsubscribeTopic))
+	del := requireSession(topicHandler(deleteTopic))
 
 	var testData = []struct {
-		gcmid        string
+		access       string
+		topic        string
 		expectedCode int
-		entryDeleted bool // flag to check if the entry should be removed
 	}{
-		{"invalidToken", 200, false},
-		{gcmID, 200, true},
+		{ownerAccess, "", 400},
+		{ownerAccess, "Invalid Name", 400},
+		{"", "alerts", 401},
+	}
+	for i, data := range testData {
+		code, _ := post(create, data.access, map[string]string{"token": owner.Token, "topic": data.topic})
+		if code != data.expectedCode {
+			t.Errorf("Got %d, want %d (run %d)", code, data.expectedCode, i)
+		}
 	}
 
-	for _, d := range testData {
-		// Valid - this sould remove the gcm client
-		form := url.Values{}
-		form.Add("gcmid", d.gcmid)
-		res, err := http.PostForm(ts.URL, form)
-		if err != nil {
-			t.Fatal(err)
+	code, key := post(create, ownerAccess, map[string]string{"topic": "alerts"})
+	if code != 200 || key == "" {
+		t.Fatalf("Got %d and key %q, want 200 and key", code, key)
+	}
+	if code, _ = post(create, subscriberAccess, map[string]string{"topic": "alerts"}); code != 409 {
+		t.Errorf("Got %d, want %d for existing topic", code, 409)
+	}
+
+	var subscribeData = []struct {
+		access       string
+		topic        string
+		key          string
+		expectedCode int
+	}{
+		{subscriberAccess, "nosuchtopic", key, 404},
+		// Topic name alone isn't enough to subscribe
+		{outsiderAccess, "alerts", "", 403},
+		{outsiderAccess, "alerts", "wrongkey", 403},
+		{"", "alerts", key, 401},
+		{subscriberAccess, "alerts", key, 200},
+	}
+	for i, data := range subscribeData {
+		code, _ := post(subscribe, data.access, map[string]string{"topic": data.topic, "key": data.key})
+		if code != data.expectedCode {
+			t.Errorf("Got %d, want %d (run %d)", code, data.expectedCode, i)
 		}
-		res.Body.Close()
-		if res.StatusCode != d.expectedCode {
-			t.Errorf("Expected %s but got %s instead!", 200, res.StatusCode)
+	}
+	if code, _ = post(del, subscriberAccess, map[string]string{"topic": "alerts"}); code != 403 {
+		t.Errorf("Got %d, want %d when subscriber deletes topic", code, 403)
+	}
+
+	// Outsiders and subscribers can't publish
+	for _, token := range []string{outsider.Token, subscriber.Token} {
+		pushes, e := sendTopicPush("title", "body", token, "alerts", "", 0, 1)
+		if e == nil || e.Status != http.StatusForbidden {
+			t.Errorf("Only owner should be able to publish to topic (%v, %v)", pushes, e)
 		}
+	}
 
-		_, err = db.GetGCMClient(gcmID)
-		if d.entryDeleted {
-			if err == nil {
-				t.Errorf("GCMClient should be deleted but is not")
-			}
-		} else {
-			if err != nil {
-				t.Errorf("GCMClient shouldn't be deleted but is")
-			}
+	// Push to topic is saved and delivered to every subscriber
+	post(pushHandler, "", map[string]string{"token": owner.Token, "topic": "alerts", "title": "title"})
+	if !waitFor(func() bool {
+		t1, _ := topicOf(owner.Token)
+		t2, _ := topicOf(subscriber.Token)
+		return t1 == "alerts" && t2 == "alerts"
+	}) {
+		t.Errorf("Push to topic wasn't delivered to every subscriber")
+	}
+	if _, ok := topicOf(outsider.Token); ok {
+		t.Errorf("Push to topic was delivered to outsider")
+	}
+	for _, token := range []string{owner.Token, subscriber.Token} {
+		if pushes := db.GetPushesForToken(token); len(pushes) != 1 || pushes[0].Topic != "alerts" {
+			t.Errorf("Expected one push to topic saved for %s (%v)", token, pushes)
 		}
 	}
+
+	post(unsubscribe, subscriberAccess, map[string]string{"topic": "alerts"})
+	pushes, e := sendTopicPush("title", "body", owner.Token, "alerts", "", 0, 1)
+	if e != nil || len(pushes) != 1 || pushes[0].Token != owner.Token {
+		t.Errorf("Push should only go to owner after unsubscribing (%v, %v)", pushes, e)
+	}
+
+	// Old token still works as the owner during grace period after rotating
+	old := owner.Token
+	if _, err = owner.RotateToken(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if pushes, e = sendTopicPush("title", "body", old, "alerts", "", 0, 1); e != nil {
+		t.Errorf("Owner should be able to publish with old token (%v)", e)
+	}
+	if code, _ := post(del, ownerAccess, map[string]string{"topic": "alerts"}); code != 200 {
+		t.Errorf("Owner should be able to delete topic (got %d)", code)
+	}
+	if _, err := db.GetTopic("alerts"); err == nil {
+		t.Errorf("Topic should be deleted")
+	}
 }
@@ -0,0 +1,96 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/vhakulinen/push-server/db"
+	"github.com/vhakulinen/push-server/queue"
+	"github.com/vhakulinen/push-server/utils"
+)
+
+// apnsNotifier sends pushes to iOS devices through Apple Push Notification
+// service. Devices are registered with "devicetoken" param.
+type apnsNotifier struct{}
+
+func init() {
+	queue.Register("apns", runAPNSJob, nil)
+}
+
+func (apnsNotifier) Name() string {
+	return "apns"
+}
+
+func (apnsNotifier) Register(token string, params map[string]string) error {
+	_, err := db.RegisterAPNSClient(params["devicetoken"], token)
+	return err
+}
+
+func (apnsNotifier) Unregister(params map[string]string) error {
+	a, err := db.GetAPNSClient(params["devicetoken"])
+	if err != nil {
+		return err
+	}
+	a.Delete()
+	return nil
+}
+
+// Deliver queues delivery to every APNs device of the token.
+func (apnsNotifier) Deliver(p *db.PushData) error {
+	u, err := db.GetUserByToken(p.Token)
+	if err != nil {
+		return fmt.Errorf("Failed to get user (%v)", err)
+	}
+	for _, c := range u.APNSClients {
+		if err := queue.Enqueue("apns", p, c.DeviceToken); err != nil {
+			log.Printf("Failed to queue push %d for APNs device %s (%v)", p.ID, c.DeviceToken, err)
+		}
+	}
+	return nil
+}
+
+// runAPNSJob sends push to one APNs device.
+func runAPNSJob(j *db.Job, p *db.PushData) error {
+	results := utils.SendAPNS([]string{j.Target}, apnsNotification(p))
+	pruneAPNSClients(results)
+	for _, r := range results {
+		switch r.Error {
+		case "", utils.APNSErrorUnregistered, utils.APNSErrorBadDeviceToken, utils.APNSErrorDeviceTokenNotForTopic:
+		default:
+			if r.Permanent {
+				return queue.Permanent(errors.New(r.Error))
+			}
+			return errors.New(r.Error)
+		}
+	}
+	return nil
+}
+
+// apnsNotification returns push data as APNs notification. Sound is already
+// cleared for priority 2 pushes which were delivered to live clients.
+func apnsNotification(p *db.PushData) utils.APNSNotification {
+	return utils.APNSNotification{
+		ID:    p.ID,
+		Title: p.Title,
+		Body:  p.Body,
+		URL:   p.URL,
+		Sound: p.Sound,
+	}
+}
+
+// pruneAPNSClients deletes APNs devices which APNs reported to be
+// unregistered or invalid.
+func pruneAPNSClients(results []utils.APNSResult) {
+	for _, r := range results {
+		switch r.Error {
+		case utils.APNSErrorUnregistered, utils.APNSErrorBadDeviceToken, utils.APNSErrorDeviceTokenNotForTopic:
+		default:
+			continue
+		}
+		if a, err := db.GetAPNSClient(r.DeviceToken); err == nil {
+			log.Printf("Removing APNs client %s (%s)", r.DeviceToken, r.Error)
+			a.Delete()
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/vhakulinen/push-server/db"
+	"github.com/vhakulinen/push-server/queue"
+	"github.com/vhakulinen/push-server/utils"
+)
+
+// fcmNotifier sends pushes to Firebase Cloud Messaging clients. Clients are
+// registered with "gcmid" and optionally "device" params.
+type fcmNotifier struct{}
+
+func init() {
+	queue.Register("fcm", runFCMJob, nil)
+}
+
+func (fcmNotifier) Name() string {
+	return "fcm"
+}
+
+func (fcmNotifier) Register(token string, params map[string]string) error {
+	g, err := db.RegisterGCMClient(params["gcmid"], token)
+	if err != nil {
+		return err
+	}
+	if name := params["device"]; name != "" {
+		d, err := db.RegisterDevice(name, token)
+		if err != nil {
+			return err
+		}
+		return g.SetDevice(d)
+	}
+	return nil
+}
+
+func (fcmNotifier) Unregister(params map[string]string) error {
+	g, err := db.GetGCMClient(params["gcmid"])
+	if err != nil {
+		return err
+	}
+	g.Delete()
+	return nil
+}
+
+// Deliver queues delivery to every FCM client of the token.
+func (fcmNotifier) Deliver(p *db.PushData) error {
+	u, err := db.GetUserByToken(p.Token)
+	if err != nil {
+		return fmt.Errorf("Failed to get user (%v)", err)
+	}
+	for _, c := range u.GCMClients {
+		if err := queue.Enqueue("fcm", p, c.GCMId); err != nil {
+			log.Printf("Failed to queue push %d for FCM client %s (%v)", p.ID, c.GCMId, err)
+		}
+	}
+	return nil
+}
+
+// runFCMJob sends push to one FCM client.
+func runFCMJob(j *db.Job, p *db.PushData) error {
+	results := utils.SendFCM([]string{j.Target}, fcmData(p))
+	pruneGCMClients(results)
+	for _, r := range results {
+		switch r.Error {
+		case "":
+			recordFCMDelivery(r.RegistrationID, p)
+		case utils.FCMErrorUnregistered, utils.FCMErrorInvalidRegistration:
+		default:
+			if r.Permanent {
+				return queue.Permanent(errors.New(r.Error))
+			}
+			if r.RetryAfter > 0 {
+				return queue.RetryAfter(errors.New(r.Error), r.RetryAfter)
+			}
+			return errors.New(r.Error)
+		}
+	}
+	return nil
+}
+
+// recordFCMDelivery records that p was sent to the device which GCM client
+// gcmID is linked to. Ping only tells the client to pool, so the push is
+// delivered when it does.
+func recordFCMDelivery(gcmID string, p *db.PushData) {
+	g, err := db.GetGCMClient(gcmID)
+	if err != nil {
+		return
+	}
+	d, err := g.Device()
+	if err != nil {
+		return
+	}
+	if utils.FCMSendsPayload() {
+		err = p.SetDelivered(d)
+	} else {
+		err = p.SetSent(d)
+	}
+	if err != nil {
+		log.Printf("Failed to record FCM delivery of push %d (%v)", p.ID, err)
+	}
+}
+
+// fcmData returns push data as FCM data message (which only has string values).
+func fcmData(p *db.PushData) map[string]string {
+	return map[string]string{
+		"id":            strconv.FormatInt(p.ID, 10),
+		"title":         p.Title,
+		"body":          p.Body,
+		"url":           p.URL,
+		"unixtimestamp": strconv.FormatInt(p.UnixTimeStamp, 10),
+		"sound":         strconv.FormatBool(p.Sound),
+	}
+}
+
+// pruneGCMClients deletes GCM clients which FCM reported to be unregistered
+// or invalid.
+func pruneGCMClients(results []utils.FCMResult) {
+	for _, r := range results {
+		if r.Error != utils.FCMErrorUnregistered && r.Error != utils.FCMErrorInvalidRegistration {
+			continue
+		}
+		if g, err := db.GetGCMClient(r.RegistrationID); err == nil {
+			log.Printf("Removing GCM client %s (%s)", r.RegistrationID, r.Error)
+			g.Delete()
+		}
+	}
+}
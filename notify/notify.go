@@ -0,0 +1,100 @@
+// Package notify delivers pushes to clients through pluggable delivery
+// channels (notifiers). Each notifier is configured in its own section of
+// the configuration file and can be turned off with enabled=false.
+package notify
+
+import (
+	"errors"
+	"log"
+
+	"github.com/vhakulinen/push-server/config"
+	"github.com/vhakulinen/push-server/db"
+)
+
+var (
+	// ErrNotSupported is returned by notifiers which clients can't register
+	// to (e.g. live clients register by connecting).
+	ErrNotSupported = errors.New("Notifier doesn't support registering clients")
+	// ErrDisabled is returned when notifier doesn't exist or is disabled
+	ErrDisabled = errors.New("Notifier not enabled")
+)
+
+// Notifier is a delivery channel through which pushes are sent to clients.
+type Notifier interface {
+	// Name returns name of the notifier, which is also its configuration
+	// section
+	Name() string
+	// Register registers client to token. params are notifier specific.
+	Register(token string, params map[string]string) error
+	// Unregister removes client identified by notifier specific params.
+	Unregister(params map[string]string) error
+	// Deliver sends push to the clients of p.Token. Notifiers are run in
+	// order, so changes made to p (e.g. clearing Sound) are seen by the
+	// notifiers after it.
+	Deliver(p *db.PushData) error
+}
+
+// notifiers are all the available notifiers in the order pushes are
+// delivered through them. Live clients must be first, since whether they got
+// the push affects the rest.
+var notifiers = []Notifier{
+	tcpNotifier{},
+	fcmNotifier{},
+	apnsNotifier{},
+	webPushNotifier{},
+	webhookNotifier{},
+}
+
+// enabled are the notifiers which are not disabled in configuration
+var enabled = notifiers
+
+// LoadConfig loads this package configuration from global config.Config object
+func LoadConfig() {
+	loadWebhookConfig()
+	enabled = nil
+	for _, n := range notifiers {
+		if on, err := config.Config.Bool(n.Name(), "enabled"); err == nil && !on {
+			log.Printf("Notifier %s disabled", n.Name())
+			continue
+		}
+		enabled = append(enabled, n)
+	}
+}
+
+// Get returns enabled notifier by name.
+func Get(name string) (Notifier, error) {
+	for _, n := range enabled {
+		if n.Name() == name {
+			return n, nil
+		}
+	}
+	return nil, ErrDisabled
+}
+
+// Register registers client to token with notifier called name.
+func Register(name, token string, params map[string]string) error {
+	n, err := Get(name)
+	if err != nil {
+		return err
+	}
+	return n.Register(token, params)
+}
+
+// Unregister removes client from notifier called name.
+func Unregister(name string, params map[string]string) error {
+	n, err := Get(name)
+	if err != nil {
+		return err
+	}
+	return n.Unregister(params)
+}
+
+// Deliver sends push through every enabled notifier. Failing notifier
+// doesn't stop the others.
+func Deliver(p *db.PushData) {
+	for _, n := range enabled {
+		if err := n.Deliver(p); err != nil {
+			log.Printf("Notifier %s failed to deliver push %d (%v)", n.Name(), p.ID, err)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package notify
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vhakulinen/push-server/config"
+	"github.com/vhakulinen/push-server/db"
+	"github.com/vhakulinen/push-server/queue"
+	"github.com/vhakulinen/push-server/tcp"
+	"github.com/vhakulinen/push-server/utils"
+)
+
+func TestMain(m *testing.M) {
+	config.GetConfig("../push-serv.conf.def")
+	db.SetupDatabase()
+	db.BackupForTesting()
+
+	utils.SendFCM = func(regIds []string, data map[string]string) []utils.FCMResult { return nil }
+	utils.SendWebPush = func(sub utils.WebPushSubscription, payload []byte) error { return nil }
+	utils.SendAPNS = func(deviceTokens []string, n utils.APNSNotification) []utils.APNSResult { return nil }
+	// Test webhooks are served from localhost
+	utils.WebhookAllowPrivate = true
+
+	code := m.Run()
+	db.RestoreFromTesting()
+	os.Exit(code)
+}
+
+// fakeNotifier records pushes delivered to it
+type fakeNotifier struct {
+	name      string
+	delivered *[]string
+}
+
+func (f fakeNotifier) Name() string {
+	return f.name
+}
+
+func (f fakeNotifier) Register(token string, params map[string]string) error {
+	return nil
+}
+
+func (f fakeNotifier) Unregister(params map[string]string) error {
+	return nil
+}
+
+func (f fakeNotifier) Deliver(p *db.PushData) error {
+	*f.delivered = append(*f.delivered, f.name)
+	p.Sound = false
+	return nil
+}
+
+func TestDeliver(t *testing.T) {
+	oenabled := enabled
+	defer func() { enabled = oenabled }()
+
+	var delivered []string
+	enabled = []Notifier{
+		fakeNotifier{"first", &delivered},
+		fakeNotifier{"second", &delivered},
+	}
+
+	p := &db.PushData{Title: "title", Sound: true}
+	Deliver(p)
+	if len(delivered) != 2 || delivered[0] != "first" || delivered[1] != "second" {
+		t.Errorf("Notifiers weren't run in order (%v)", delivered)
+	}
+	if p.Sound {
+		t.Errorf("Changes made by notifier weren't kept")
+	}
+
+	if _, err := Get("second"); err != nil {
+		t.Errorf("Enabled notifier not found (%v)", err)
+	}
+	if err := Register("third", "token", nil); err != ErrDisabled {
+		t.Errorf("Expected ErrDisabled but got %v", err)
+	}
+}
+
+func TestTCPNotifier(t *testing.T) {
+	u, err := db.NewUser("tcpnotifier@notify.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+
+	oClientsFromPool := tcp.ClientsFromPool
+	defer func() { tcp.ClientsFromPool = oClientsFromPool }()
+	c := make(chan *db.PushData, 1)
+	tcp.ClientsFromPool = func(token string) []chan<- *db.PushData {
+		return []chan<- *db.PushData{c}
+	}
+
+	var testData = []struct {
+		priority      int64
+		expectingSent bool
+		expectedSound bool
+	}{
+		{1, true, true},
+		{2, true, false},
+		{3, false, true},
+	}
+	for _, data := range testData {
+		p, err := db.SavePushData("title", "body", u.Token, "", 0, data.priority)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcpNotifier{}.Deliver(p)
+		select {
+		case <-c:
+			if !data.expectingSent {
+				t.Errorf("Priority %d push was sent to live client", data.priority)
+			}
+		default:
+			if data.expectingSent {
+				t.Errorf("Priority %d push wasn't sent to live client", data.priority)
+			}
+		}
+		if p.Sound != data.expectedSound {
+			t.Errorf("Priority %d push should have sound %v", data.priority, data.expectedSound)
+		}
+	}
+}
+
+func TestPruneGCMClients(t *testing.T) {
+	u, err := db.NewUser("prunegcm@gcm.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	for _, id := range []string{"valid", "unregistered", "invalid", "unavailable"} {
+		if _, err = db.RegisterGCMClient(id, u.Token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruneGCMClients([]utils.FCMResult{
+		{RegistrationID: "valid"},
+		{RegistrationID: "unregistered", Error: utils.FCMErrorUnregistered},
+		{RegistrationID: "invalid", Error: utils.FCMErrorInvalidRegistration},
+		{RegistrationID: "unavailable", Error: "FCM replied 503 (Unavailable)"},
+	})
+
+	for id, deleted := range map[string]bool{
+		"valid":        false,
+		"unregistered": true,
+		"invalid":      true,
+		"unavailable":  false,
+	} {
+		_, err := db.GetGCMClient(id)
+		if deleted && err == nil {
+			t.Errorf("GCMClient %s should be deleted but is not", id)
+		} else if !deleted && err != nil {
+			t.Errorf("GCMClient %s shouldn't be deleted but is", id)
+		}
+	}
+}
+
+func TestFCMJobDelivery(t *testing.T) {
+	oSendFCM, oSendsPayload := utils.SendFCM, utils.FCMSendsPayload
+	defer func() { utils.SendFCM, utils.FCMSendsPayload = oSendFCM, oSendsPayload }()
+	sendsPayload := false
+	utils.FCMSendsPayload = func() bool { return sendsPayload }
+	failing := false
+	utils.SendFCM = func(regIds []string, data map[string]string) []utils.FCMResult {
+		if failing {
+			return []utils.FCMResult{{RegistrationID: regIds[0], Error: "FCM replied 503 (Unavailable)"}}
+		}
+		return []utils.FCMResult{{RegistrationID: regIds[0]}}
+	}
+
+	u, err := db.NewUser("fcmdelivery@gcm.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	if err = (fcmNotifier{}).Register(u.Token, map[string]string{"gcmid": "linked", "device": "phone"}); err != nil {
+		t.Fatal(err)
+	}
+	device, err := db.GetDevice("phone", u.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := func() *db.PushData {
+		p, err := db.SavePushData("title", "body", u.Token, "", 0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	job := &db.Job{Channel: "fcm", Target: "linked"}
+
+	// Failed send isn't recorded
+	failing = true
+	p := push()
+	if err = runFCMJob(job, p); err == nil {
+		t.Errorf("Expected error from failed send")
+	}
+	if n := len(device.UnackedPushes()); n != 0 {
+		t.Errorf("Failed send shouldn't be recorded (%d unacked pushes)", n)
+	}
+	failing = false
+
+	// Ping is sent, and the push is delivered when the client pools
+	if err = runFCMJob(job, p); err != nil {
+		t.Fatal(err)
+	}
+	if unacked := device.UnackedPushes(); len(unacked) != 1 || unacked[0].ID != p.ID {
+		t.Errorf("Pinged push should be sent to the device (%v)", unacked)
+	}
+	if p.DeliveredTo(device) {
+		t.Errorf("Pinged push shouldn't be delivered before the client pools")
+	}
+
+	// Payload is delivered right away
+	sendsPayload = true
+	p = push()
+	if err = runFCMJob(job, p); err != nil {
+		t.Fatal(err)
+	}
+	if !p.DeliveredTo(device) {
+		t.Errorf("Push sent as payload should be delivered to the device")
+	}
+}
+
+func TestFCMJobRetry(t *testing.T) {
+	oSendFCM := utils.SendFCM
+	defer func() { utils.SendFCM = oSendFCM }()
+	var result utils.FCMResult
+	utils.SendFCM = func(regIds []string, data map[string]string) []utils.FCMResult {
+		result.RegistrationID = regIds[0]
+		return []utils.FCMResult{result}
+	}
+	job := &db.Job{Channel: "fcm", Target: "retry"}
+	p := &db.PushData{Title: "title"}
+
+	// Unavailable FCM is retried
+	result = utils.FCMResult{Error: "FCM replied 503 (Unavailable)", RetryAfter: time.Minute}
+	if err := runFCMJob(job, p); err == nil || queue.IsPermanent(err) {
+		t.Errorf("Expected retryable error, got %v", err)
+	}
+	// Rejected message is not
+	result = utils.FCMResult{Error: "FCM replied 400 (Invalid data payload)", Permanent: true}
+	if err := runFCMJob(job, p); err == nil || !queue.IsPermanent(err) {
+		t.Errorf("Expected permanent error, got %v", err)
+	}
+}
+
+func TestPruneAPNSClients(t *testing.T) {
+	u, err := db.NewUser("pruneapns@apns.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	valid := strings.Repeat("a", 64)
+	unregistered := strings.Repeat("b", 64)
+	bad := strings.Repeat("c", 64)
+	unavailable := strings.Repeat("d", 64)
+	for _, id := range []string{valid, unregistered, bad, unavailable} {
+		if _, err = db.RegisterAPNSClient(id, u.Token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruneAPNSClients([]utils.APNSResult{
+		{DeviceToken: valid},
+		{DeviceToken: unregistered, Error: utils.APNSErrorUnregistered},
+		{DeviceToken: bad, Error: utils.APNSErrorBadDeviceToken},
+		{DeviceToken: unavailable, Error: "ServiceUnavailable"},
+	})
+
+	for id, deleted := range map[string]bool{
+		valid:        false,
+		unregistered: true,
+		bad:          true,
+		unavailable:  false,
+	} {
+		_, err := db.GetAPNSClient(id)
+		if deleted && err == nil {
+			t.Errorf("APNSClient %s should be deleted but is not", id)
+		} else if !deleted && err != nil {
+			t.Errorf("APNSClient %s shouldn't be deleted but is", id)
+		}
+	}
+}
+
+func TestWebhookJob(t *testing.T) {
+	u, err := db.NewUser("webhook@notify.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	p, err := db.SavePushData("title", "body", u.Token, "", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oMaxFailures := webhookMaxFailures
+	defer func() { webhookMaxFailures = oMaxFailures }()
+	webhookMaxFailures = 2
+
+	status := http.StatusServiceUnavailable
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(utils.WebhookSignatureHeader) != utils.SignWebhook("secret", body) {
+			t.Errorf("Invalid signature (%s)", r.Header.Get(utils.WebhookSignatureHeader))
+		}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	w, err := db.RegisterWebhook(ts.URL, "secret", u.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &db.Job{Channel: "webhook", PushDataID: p.ID, Target: strconv.FormatInt(w.ID, 10), Attempts: 1}
+
+	// Server errors are retried, client errors aren't
+	if err := runWebhookJob(j, p); err == nil {
+		t.Errorf("Expected error on 503")
+	} else if queue.IsPermanent(err) {
+		t.Errorf("503 shouldn't be permanent")
+	}
+	status = http.StatusOK
+	j.Attempts = 2
+	if err := runWebhookJob(j, p); err != nil {
+		t.Errorf("Expected success but got %v", err)
+	}
+	status = http.StatusNotFound
+	j.Attempts = 1
+	if err := runWebhookJob(j, p); err == nil || !queue.IsPermanent(err) {
+		t.Errorf("404 should be permanent error (%v)", err)
+	}
+
+	log := w.Deliveries()
+	if len(log) != 3 || log[1].Success != true || log[2].StatusCode != 503 || log[2].Attempt != 1 {
+		t.Errorf("Unexpected delivery log (%v)", log)
+	}
+
+	// Webhook is disabled after its deliveries fail twice
+	webhookJobDead(j)
+	if len(db.GetWebhooks(u.Token)) != 1 {
+		t.Errorf("Webhook shouldn't be disabled after one failure")
+	}
+	webhookJobDead(j)
+	if len(db.GetWebhooks(u.Token)) != 0 {
+		t.Errorf("Webhook should be disabled after two failures")
+	}
+
+	// Registering again enables it
+	if _, err := db.RegisterWebhook(ts.URL, "secret", u.Token); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.GetWebhooks(u.Token)) != 1 {
+		t.Errorf("Registering webhook again should enable it")
+	}
+}
@@ -0,0 +1,49 @@
+package notify
+
+import (
+	"log"
+
+	"github.com/vhakulinen/push-server/db"
+	"github.com/vhakulinen/push-server/tcp"
+)
+
+// tcpNotifier sends pushes to live clients (TCP, SSE and websocket) in the
+// client pool.
+type tcpNotifier struct{}
+
+func (tcpNotifier) Name() string {
+	return "tcp"
+}
+
+func (tcpNotifier) Register(token string, params map[string]string) error {
+	return ErrNotSupported
+}
+
+func (tcpNotifier) Unregister(params map[string]string) error {
+	return ErrNotSupported
+}
+
+// Deliver sends the push to every live client listening for the token. If
+// priority 2 push reaches any of them, sound is turned off for the rest.
+func (tcpNotifier) Deliver(p *db.PushData) error {
+	if p.Priority == 3 {
+		return nil
+	}
+	delivered := false
+	for _, send := range tcp.ClientsFromPool(p.Token) {
+		// Every client gets its own copy since p is modified below
+		c := *p
+		select {
+		case send <- &c:
+			delivered = true
+		default:
+			// This client's buffer is full (it is hanging on ping
+			// message), so it misses this push. Others still get it.
+			log.Printf("Live client buffer full, dropping push %d", p.ID)
+		}
+	}
+	if delivered && p.Priority == 2 {
+		p.SetSilent()
+	}
+	return nil
+}
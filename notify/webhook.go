@@ -0,0 +1,103 @@
+package notify
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/vhakulinen/push-server/config"
+	"github.com/vhakulinen/push-server/db"
+	"github.com/vhakulinen/push-server/queue"
+	"github.com/vhakulinen/push-server/utils"
+)
+
+// webhookMaxFailures is how many pushes in row can fail before the webhook
+// is disabled
+var webhookMaxFailures int64 = 10
+
+// webhookNotifier POSTs pushes to webhooks. Webhooks are registered with
+// "url" and "secret" params and unregistered with "token" and "url".
+type webhookNotifier struct{}
+
+func init() {
+	queue.Register("webhook", runWebhookJob, webhookJobDead)
+}
+
+func (webhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (webhookNotifier) Register(token string, params map[string]string) error {
+	_, err := db.RegisterWebhook(params["url"], params["secret"], token)
+	return err
+}
+
+func (webhookNotifier) Unregister(params map[string]string) error {
+	w, err := db.GetWebhook(params["token"], params["url"])
+	if err != nil {
+		return err
+	}
+	w.Delete()
+	return nil
+}
+
+// Deliver queues delivery to every enabled webhook of the token.
+func (webhookNotifier) Deliver(p *db.PushData) error {
+	for _, w := range db.GetWebhooks(p.Token) {
+		if err := queue.Enqueue("webhook", p, strconv.FormatInt(w.ID, 10)); err != nil {
+			log.Printf("Failed to queue push %d for webhook %d (%v)", p.ID, w.ID, err)
+		}
+	}
+	return nil
+}
+
+// runWebhookJob POSTs push to one webhook. Every attempt is logged.
+func runWebhookJob(j *db.Job, p *db.PushData) error {
+	w := jobWebhook(j)
+	if w == nil || w.Disabled {
+		return nil
+	}
+	payload, err := p.ToJSON()
+	if err != nil {
+		return queue.Permanent(err)
+	}
+	status, err := utils.SendWebhook(w.URL, w.Secret, payload)
+	w.LogDelivery(p, j.Attempts, int64(status), err)
+	if err == nil {
+		w.Delivered()
+		return nil
+	}
+	// Client errors (other than rate limiting) won't get better by retrying
+	if status >= 400 && status < 500 && status != 429 {
+		return queue.Permanent(err)
+	}
+	return err
+}
+
+// webhookJobDead counts the failed push against the webhook, disabling it
+// after too many failures in row.
+func webhookJobDead(j *db.Job) {
+	if w := jobWebhook(j); w != nil && w.Failed(webhookMaxFailures) {
+		log.Printf("Disabled webhook %d after %d failures", w.ID, w.Failures)
+	}
+}
+
+func jobWebhook(j *db.Job) *db.Webhook {
+	id, err := strconv.ParseInt(j.Target, 10, 64)
+	if err != nil {
+		return nil
+	}
+	w, err := db.GetWebhookByID(id)
+	if err != nil {
+		return nil
+	}
+	return w
+}
+
+func loadWebhookConfig() {
+	if n, err := config.Config.Int("webhook", "maxfailures"); err == nil {
+		webhookMaxFailures = int64(n)
+	}
+	if allow, err := config.Config.Bool("webhook", "allowprivate"); err == nil {
+		utils.WebhookAllowPrivate = allow
+	}
+}
@@ -0,0 +1,72 @@
+package notify
+
+import (
+	"log"
+
+	"github.com/vhakulinen/push-server/db"
+	"github.com/vhakulinen/push-server/queue"
+	"github.com/vhakulinen/push-server/utils"
+)
+
+// webPushNotifier sends pushes to browsers with Web Push. Subscriptions are
+// registered with "endpoint", "p256dh" and "auth" params.
+type webPushNotifier struct{}
+
+func init() {
+	queue.Register("webpush", runWebPushJob, nil)
+}
+
+func (webPushNotifier) Name() string {
+	return "webpush"
+}
+
+func (webPushNotifier) Register(token string, params map[string]string) error {
+	_, err := db.RegisterWebPushSubscription(params["endpoint"], params["p256dh"], params["auth"], token)
+	return err
+}
+
+func (webPushNotifier) Unregister(params map[string]string) error {
+	s, err := db.GetWebPushSubscription(params["endpoint"])
+	if err != nil {
+		return err
+	}
+	s.Delete()
+	return nil
+}
+
+// Deliver queues delivery to every web push subscription of the token.
+func (webPushNotifier) Deliver(p *db.PushData) error {
+	for _, s := range db.GetWebPushSubscriptions(p.Token) {
+		if err := queue.Enqueue("webpush", p, s.Endpoint); err != nil {
+			log.Printf("Failed to queue push %d for web push subscription %s (%v)", p.ID, s.Endpoint, err)
+		}
+	}
+	return nil
+}
+
+// runWebPushJob sends push to one subscription and deletes it if it doesn't
+// exist anymore. Network errors, throttling and server errors are retried.
+func runWebPushJob(j *db.Job, p *db.PushData) error {
+	s, err := db.GetWebPushSubscription(j.Target)
+	if err != nil {
+		// Unsubscribed after the push was queued
+		return nil
+	}
+	payload, err := p.ToJSON()
+	if err != nil {
+		return queue.Permanent(err)
+	}
+	err = utils.SendWebPush(utils.WebPushSubscription{
+		Endpoint: s.Endpoint,
+		P256dh:   s.P256dh,
+		Auth:     s.Auth,
+	}, payload)
+	if err == utils.ErrWebPushGone {
+		s.Delete()
+		return nil
+	}
+	if utils.WebPushRejected(err) {
+		return queue.Permanent(err)
+	}
+	return err
+}
@@ -0,0 +1,209 @@
+// Package queue delivers pushes to out-of-band clients (FCM, APNs, ...)
+// through jobs stored in database, so deliveries survive restarts and
+// provider outages. Jobs are run by a pool of workers and failed ones are
+// retried with exponential backoff until they are marked dead.
+//
+// Only one process may run the workers for the same database.
+package queue
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/vhakulinen/push-server/config"
+	"github.com/vhakulinen/push-server/db"
+)
+
+const maxBackoff = time.Hour
+
+var (
+	workers              = 4
+	maxAttempts    int64 = 6
+	initialBackoff       = time.Second
+	pollInterval         = time.Second
+)
+
+// Handler delivers push p to the job's target. Returning error retries the
+// job later, unless the error is Permanent. Errors wrapped with RetryAfter
+// aren't retried sooner than the service asked.
+type Handler func(j *db.Job, p *db.PushData) error
+
+type channel struct {
+	run  Handler
+	dead func(j *db.Job)
+}
+
+var (
+	mu       sync.Mutex // protects channels
+	channels = make(map[string]channel)
+
+	wake    = make(chan struct{}, 1)
+	stop    chan struct{}
+	stopped sync.WaitGroup
+)
+
+// Register registers handler for jobs of channel. dead is called (if not nil)
+// when job of the channel is given up on.
+func Register(name string, run Handler, dead func(j *db.Job)) {
+	mu.Lock()
+	defer mu.Unlock()
+	channels[name] = channel{run, dead}
+}
+
+// Enqueue queues delivery of p to target through channel.
+func Enqueue(name string, p *db.PushData, target string) error {
+	if _, err := db.EnqueueJob(name, p.ID, target); err != nil {
+		return err
+	}
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+type permanentError struct {
+	error
+}
+
+// Permanent wraps err so that the job isn't retried.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// IsPermanent tells if err was wrapped with Permanent.
+func IsPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+type retryAfterError struct {
+	error
+	after time.Duration
+}
+
+// RetryAfter wraps err so that the job isn't retried before d has passed.
+// The wait is capped to maximum backoff.
+func RetryAfter(err error, d time.Duration) error {
+	return retryAfterError{err, d}
+}
+
+// Start starts the workers. Jobs left running by previous process are run
+// again.
+func Start() {
+	db.ResetRunningJobs()
+	stop = make(chan struct{})
+	jobs := make(chan *db.Job)
+	for i := 0; i < workers; i++ {
+		stopped.Add(1)
+		go func() {
+			defer stopped.Done()
+			for j := range jobs {
+				run(j)
+			}
+		}()
+	}
+	stopped.Add(1)
+	go func() {
+		defer stopped.Done()
+		defer close(jobs)
+		poll(jobs)
+	}()
+}
+
+// Stop stops the workers and waits for running jobs to finish.
+func Stop() {
+	close(stop)
+	stopped.Wait()
+}
+
+// poll feeds due jobs to the workers until stopped.
+func poll(jobs chan<- *db.Job) {
+	for {
+		for j := db.ClaimJob(); j != nil; j = db.ClaimJob() {
+			select {
+			case jobs <- j:
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case <-wake:
+		case <-time.After(pollInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func run(j *db.Job) {
+	mu.Lock()
+	c, ok := channels[j.Channel]
+	mu.Unlock()
+	if !ok {
+		j.Dead(fmt.Errorf("No handler for channel %s", j.Channel))
+		return
+	}
+	p, err := db.GetPushDataByID(j.PushDataID)
+	if err != nil {
+		// Push was deleted, nothing to deliver anymore
+		j.Done()
+		return
+	}
+
+	err = c.run(j, p)
+	if err == nil {
+		j.Done()
+		return
+	}
+	if IsPermanent(err) || j.Attempts >= maxAttempts {
+		log.Printf("Giving up %s delivery of push %d to %s (%v)", j.Channel, p.ID, j.Target, err)
+		j.Dead(err)
+		if c.dead != nil {
+			c.dead(j)
+		}
+		return
+	}
+	j.Retry(err, time.Now().Add(retryDelay(err, j.Attempts)))
+}
+
+// retryDelay returns how long to wait before retrying job which has failed
+// attempts times, last time with err.
+func retryDelay(err error, attempts int64) time.Duration {
+	d := backoff(attempts)
+	if e, ok := err.(retryAfterError); ok && e.after > d {
+		d = e.after
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// backoff returns how long to wait before retrying job which has failed
+// attempts times.
+func backoff(attempts int64) time.Duration {
+	d := initialBackoff
+	for i := int64(1); i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// LoadConfig loads this package configuration from global config.Config object
+func LoadConfig() {
+	if n, err := config.Config.Int("queue", "workers"); err == nil && n > 0 {
+		workers = n
+	}
+	if n, err := config.Config.Int("queue", "maxattempts"); err == nil && n > 0 {
+		maxAttempts = int64(n)
+	}
+	if n, err := config.Config.Int("queue", "backoff"); err == nil && n >= 0 {
+		initialBackoff = time.Duration(n) * time.Second
+	}
+}
@@ -0,0 +1,176 @@
+package queue
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vhakulinen/push-server/config"
+	"github.com/vhakulinen/push-server/db"
+)
+
+func TestMain(m *testing.M) {
+	config.GetConfig("../push-serv.conf.def")
+	db.SetupDatabase()
+	db.BackupForTesting()
+
+	maxAttempts = 3
+	initialBackoff = 0
+	pollInterval = time.Millisecond * 10
+
+	code := m.Run()
+	db.RestoreFromTesting()
+	os.Exit(code)
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 50; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	return false
+}
+
+// counter counts handler calls per target
+type counter struct {
+	mu sync.Mutex
+	n  map[string]int
+}
+
+func (c *counter) inc(target string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n[target]++
+	return c.n[target]
+}
+
+func (c *counter) get(target string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n[target]
+}
+
+func TestQueue(t *testing.T) {
+	u, err := db.NewUser("queue@queue.com", "password")
+	if err != nil {
+		t.Fatalf("Failed to create user (%v)", err)
+	}
+	p, err := db.SavePushData("title", "body", u.Token, "", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := &counter{n: make(map[string]int)}
+	dead := &counter{n: make(map[string]int)}
+	Register("test", func(j *db.Job, p *db.PushData) error {
+		n := calls.inc(j.Target)
+		switch j.Target {
+		case "flaky":
+			if n < 3 {
+				return errors.New("flaky")
+			}
+		case "broken":
+			return errors.New("broken")
+		case "permanent":
+			return Permanent(errors.New("permanent"))
+		}
+		return nil
+	}, func(j *db.Job) {
+		dead.inc(j.Target)
+	})
+
+	Start()
+	for _, target := range []string{"ok", "flaky", "broken", "permanent"} {
+		if err := Enqueue("test", p, target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitFor(func() bool {
+		return len(db.GetJobs(db.JobPending)) == 0 && len(db.GetJobs(db.JobRunning)) == 0
+	}) {
+		t.Fatal("Jobs weren't run")
+	}
+	Stop()
+
+	for target, expected := range map[string]int{"ok": 1, "flaky": 3, "broken": 3, "permanent": 1} {
+		if n := calls.get(target); n != expected {
+			t.Errorf("Expected %s to be run %d times but was run %d times", target, expected, n)
+		}
+	}
+	deadJobs := db.GetJobs(db.JobDead)
+	if len(deadJobs) != 2 || deadJobs[0].Target != "broken" || deadJobs[1].Target != "permanent" {
+		t.Errorf("Unexpected dead jobs (%v)", deadJobs)
+	}
+	if dead.get("broken") != 1 || dead.get("permanent") != 1 || dead.get("flaky") != 0 {
+		t.Errorf("Dead callback wasn't called for dead jobs (%v)", dead.n)
+	}
+
+	// Jobs queued and interrupted while workers are stopped are run when
+	// they are started again
+	if err := Enqueue("test", p, "queued"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Enqueue("test", p, "interrupted"); err != nil {
+		t.Fatal(err)
+	}
+	for j := db.ClaimJob(); j != nil; j = db.ClaimJob() {
+		if j.Target == "interrupted" {
+			break
+		}
+	}
+	Start()
+	defer Stop()
+	if !waitFor(func() bool {
+		return calls.get("queued") == 1 && calls.get("interrupted") == 1
+	}) {
+		t.Errorf("Jobs weren't run after restart")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	o := initialBackoff
+	defer func() { initialBackoff = o }()
+	initialBackoff = time.Second
+
+	var testData = []struct {
+		attempts int64
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, time.Second * 2},
+		{4, time.Second * 8},
+		{100, maxBackoff},
+	}
+	for _, data := range testData {
+		if d := backoff(data.attempts); d != data.expected {
+			t.Errorf("Expected backoff %v after %d attempts but got %v", data.expected, data.attempts, d)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	o := initialBackoff
+	defer func() { initialBackoff = o }()
+	initialBackoff = time.Second
+
+	err := errors.New("unavailable")
+	var testData = []struct {
+		err      error
+		attempts int64
+		expected time.Duration
+	}{
+		{err, 2, time.Second * 2},
+		{RetryAfter(err, time.Second*10), 2, time.Second * 10},
+		{RetryAfter(err, time.Second), 4, time.Second * 8},
+		{RetryAfter(err, time.Hour*24), 1, maxBackoff},
+	}
+	for _, data := range testData {
+		if d := retryDelay(data.err, data.attempts); d != data.expected {
+			t.Errorf("Expected delay %v after %d attempts with %v but got %v", data.expected, data.attempts, data.err, d)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/vhakulinen/push-server/ratelimit"
+)
+
+// maxPeek is how much of JSON request body is read for the rate limit keys
+const maxPeek = 64 * 1024
+
+// realIPHeader is header with client's address set by reverse proxy, if
+// the server is behind one.
+var realIPHeader string
+
+// trustedHops is how many proxies in front of the server append to
+// realIPHeader. Entries left of them are set by the client and can't be
+// trusted.
+var trustedHops = 1
+
+// withRateLimit wraps h so that requests are limited per client IP address,
+// and per email and token if the request has them. Limited requests get 429
+// with Retry-After header.
+func withRateLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		semail, token := rateLimitKeys(r)
+		var wait time.Duration
+		limit := func(l *ratelimit.Limiter, key string) {
+			if key == "" {
+				return
+			}
+			if ok, d := l.Allow(key); !ok && d > wait {
+				wait = d
+			}
+		}
+		limit(ratelimit.ByIP, clientIP(r))
+		limit(ratelimit.ByEmail, strings.ToLower(semail))
+		limit(ratelimit.ByToken, token)
+		if wait == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		defer r.Body.Close()
+		e := newRetryError(wait, codeRateLimited, "Too many requests, try again later")
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeJSONError(w, e)
+			return
+		}
+		writeErrorHeader(w, e)
+		w.Write([]byte(http.StatusText(e.Status)))
+	})
+}
+
+// clientIP returns IP address of the client which made r.
+func clientIP(r *http.Request) string {
+	if realIPHeader != "" {
+		if ip := r.Header.Get(realIPHeader); ip != "" {
+			// X-Forwarded-For has the whole chain of proxies, each
+			// appending the address it got the request from
+			ips := strings.Split(ip, ",")
+			i := len(ips) - trustedHops
+			if i < 0 {
+				i = 0
+			}
+			return strings.TrimSpace(ips[i])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitKeys returns email and token of r. JSON API requests have them in
+// the body, which is put back for the handler.
+func rateLimitKeys(r *http.Request) (string, string) {
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		return strings.TrimSpace(r.FormValue("email")), r.FormValue("token")
+	}
+	if r.Body == nil {
+		return "", ""
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPeek))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+	if err != nil {
+		return "", ""
+	}
+	var keys struct {
+		Email string `json:"email"`
+		Token string `json:"token"`
+	}
+	// Invalid JSON is left for the handler to complain about
+	json.Unmarshal(data, &keys)
+	return strings.TrimSpace(keys.Email), keys.Token
+}
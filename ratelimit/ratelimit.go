@@ -0,0 +1,161 @@
+// Package ratelimit limits how often clients can make requests, with token
+// buckets keyed by e.g. IP address, email or token, and decides how long
+// accounts are locked out after failed login attempts.
+package ratelimit
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/vhakulinen/push-server/config"
+)
+
+// sweepInterval is how often buckets which have filled up are forgotten
+const sweepInterval = time.Minute
+
+// now is the clock of the limiters, replaced in tests
+var now = time.Now
+
+// Limiters used by the HTTP server, set up by LoadConfig. Nil limiter
+// allows everything.
+var (
+	// ByIP limits requests from one IP address
+	ByIP *Limiter
+	// ByEmail limits requests for one account, e.g. login attempts
+	ByEmail *Limiter
+	// ByToken limits requests with one token, e.g. pushes
+	ByToken *Limiter
+)
+
+var (
+	lockoutThreshold int64 = 5
+	lockoutBase            = time.Minute
+	lockoutMax             = time.Hour
+)
+
+// Limiter is set of token buckets. Each key has its own bucket which holds
+// up to burst tokens and is refilled with rate tokens per second.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex // protects fields below
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New returns limiter allowing rate requests per second per key, and up to
+// burst requests at once.
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes token from the bucket of key. If the bucket is empty, returns
+// false and how long until there is token again.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t := now()
+	l.sweep(t)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: t}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, t)
+	b.last = t
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *Limiter) refill(b *bucket, t time.Time) float64 {
+	return math.Min(l.burst, b.tokens+t.Sub(b.last).Seconds()*l.rate)
+}
+
+// sweep forgets buckets which are full, since new bucket is the same.
+func (l *Limiter) sweep(t time.Time) {
+	if t.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = t
+	for key, b := range l.buckets {
+		if l.refill(b, t) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Lockout returns how long account is locked out after failures failed
+// attempts in row. The lockout starts after lockoutThreshold failures and
+// doubles with each failure after that.
+func Lockout(failures int64) time.Duration {
+	if failures < lockoutThreshold {
+		return 0
+	}
+	n := failures - lockoutThreshold
+	if n > 30 {
+		return lockoutMax
+	}
+	d := lockoutBase << uint(n)
+	if d <= 0 || d > lockoutMax {
+		return lockoutMax
+	}
+	return d
+}
+
+// newLimiter returns limiter configured with keys prefix (requests per
+// minute) and prefix+"burst" of [ratelimit] section, or with rate and burst
+// if they are not set. Returns nil if the rate is 0.
+func newLimiter(prefix string, rate, burst int) *Limiter {
+	if n, err := config.Config.Int("ratelimit", prefix); err == nil {
+		rate = n
+	}
+	if n, err := config.Config.Int("ratelimit", prefix+"burst"); err == nil && n > 0 {
+		burst = n
+	}
+	if rate <= 0 {
+		return nil
+	}
+	return New(float64(rate)/60, burst)
+}
+
+// LoadConfig loads this package's configuration from config.Config package
+func LoadConfig() {
+	if enabled, err := config.Config.Bool("ratelimit", "enabled"); err == nil && !enabled {
+		log.Println("Rate limiting is disabled")
+		ByIP, ByEmail, ByToken = nil, nil, nil
+	} else {
+		ByIP = newLimiter("ip", 600, 100)
+		ByEmail = newLimiter("email", 10, 10)
+		ByToken = newLimiter("token", 600, 100)
+	}
+
+	if n, err := config.Config.Int("ratelimit", "lockoutthreshold"); err == nil && n > 0 {
+		lockoutThreshold = int64(n)
+	}
+	if n, err := config.Config.Int("ratelimit", "lockoutbase"); err == nil && n > 0 {
+		lockoutBase = time.Duration(n) * time.Second
+	}
+	if n, err := config.Config.Int("ratelimit", "lockoutmax"); err == nil && n > 0 {
+		lockoutMax = time.Duration(n) * time.Second
+	}
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	clock := time.Unix(1500000000, 0)
+	now = func() time.Time { return clock }
+	defer func() { now = time.Now }()
+
+	// One request per second, three at once
+	l := New(1, 3)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("Request %d was not allowed", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatalf("Request over burst was allowed")
+	}
+	if wait != time.Second {
+		t.Errorf("Got wait %v, want %v", wait, time.Second)
+	}
+	// Other keys have their own buckets
+	if ok, _ := l.Allow("b"); !ok {
+		t.Errorf("Request with other key was not allowed")
+	}
+
+	clock = clock.Add(500 * time.Millisecond)
+	if ok, wait := l.Allow("a"); ok || wait != 500*time.Millisecond {
+		t.Errorf("Got %v and wait %v, want false and %v", ok, wait, 500*time.Millisecond)
+	}
+	clock = clock.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Errorf("Request was not allowed after refill")
+	}
+
+	// Full buckets are forgotten
+	clock = clock.Add(sweepInterval)
+	l.Allow("c")
+	if len(l.buckets) != 1 {
+		t.Errorf("Got %d buckets, want 1", len(l.buckets))
+	}
+
+	var nilLimiter *Limiter
+	if ok, _ := nilLimiter.Allow("a"); !ok {
+		t.Errorf("Nil limiter didn't allow request")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	var testData = []struct {
+		failures int64
+		expected time.Duration
+	}{
+		{0, 0},
+		{lockoutThreshold - 1, 0},
+		{lockoutThreshold, lockoutBase},
+		{lockoutThreshold + 1, 2 * lockoutBase},
+		{lockoutThreshold + 2, 4 * lockoutBase},
+		{lockoutThreshold + 20, lockoutMax},
+		{lockoutThreshold + 100, lockoutMax},
+	}
+	for i, data := range testData {
+		if d := Lockout(data.failures); d != data.expected {
+			t.Errorf("Got %v, want %v (run %d)", d, data.expected, i)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/vhakulinen/push-server/auth"
+	"github.com/vhakulinen/push-server/db"
+)
+
+type sessionKey struct{}
+
+// session is the logged in user of request authenticated with access token
+type session struct {
+	user *db.User
+	s    *db.Session
+}
+
+// withSession wraps device registration handler h so that it can be
+// authenticated with "Authorization: Bearer <access token>" instead of the
+// token. Requests without the header are passed to h as they are, for
+// clients which only know the token.
+func withSession(h http.HandlerFunc) http.HandlerFunc {
+	return sessionHandler(h, false)
+}
+
+// requireSession wraps management handler h so that requests must be
+// authenticated with access token. The token, or email and password, are
+// not enough for these.
+func requireSession(h http.HandlerFunc) http.HandlerFunc {
+	return sessionHandler(h, true)
+}
+
+func sessionHandler(h http.HandlerFunc, required bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" && !required {
+			h(w, r)
+			return
+		}
+		var e *apiError
+		if header == "" {
+			e = newAPIError(http.StatusUnauthorized, codeInvalidAccessToken, "Access token required")
+		} else if !strings.HasPrefix(header, "Bearer ") {
+			e = newAPIError(http.StatusUnauthorized, codeInvalidAccessToken, "Authorization must be Bearer token")
+		} else if u, s, err := auth.Verify(strings.TrimPrefix(header, "Bearer ")); err != nil {
+			e = newAPIError(http.StatusUnauthorized, codeInvalidAccessToken, "%v", err)
+		} else {
+			h(w, r.WithContext(context.WithValue(r.Context(), sessionKey{}, &session{u, s})))
+			return
+		}
+		defer r.Body.Close()
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeJSONError(w, e)
+			return
+		}
+		w.WriteHeader(e.Status)
+		w.Write([]byte(http.StatusText(e.Status)))
+	}
+}
+
+// sessionOf returns session of request authenticated by withSession or
+// requireSession, nil if the request didn't have access token.
+func sessionOf(r *http.Request) *session {
+	s, _ := r.Context().Value(sessionKey{}).(*session)
+	return s
+}
+
+// tokenFromRequest returns token of the logged in user of r, or token if r
+// didn't have access token.
+func tokenFromRequest(r *http.Request, token string) string {
+	if s := sessionOf(r); s != nil {
+		return s.user.Token
+	}
+	return token
+}
@@ -0,0 +1,95 @@
+package sse
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/vhakulinen/push-server/db"
+	"github.com/vhakulinen/push-server/tcp"
+)
+
+const (
+	// Seconds between keep-alive comments sent to idle client
+	keepAliveInterval = 120
+
+	chanBufferSize = 100
+)
+
+// HandleSSEClient streams pushes to client as Server-Sent Events. Client
+// is added to the same pool as TCP clients, so pushHandler delivers to
+// it exactly like it would to a TCP client. Streamed pushes are marked
+// delivered to the device client specifies, or to the default device.
+func HandleSSEClient(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Streaming not supported"))
+		return
+	}
+
+	token, key, old, err := db.ResolveCredential(r.FormValue("token"), db.ScopeRead)
+	switch err {
+	case nil:
+	case db.ErrTokenNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Token not found!"))
+		return
+	default:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("%v", err)))
+		return
+	}
+
+	name := r.FormValue("device")
+	if name == "" {
+		name = db.DefaultDeviceName
+	}
+	device, err := db.RegisterDevice(name, token)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("%v", err)))
+		return
+	}
+
+	var sendChan = make(chan *db.PushData, chanBufferSize)
+	poolID, kicked := tcp.AddToPool(token, key, old, sendChan)
+	defer tcp.RemoveFromPool(token, poolID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	c := time.After(time.Second * keepAliveInterval)
+	for {
+		select {
+		case p := <-sendChan:
+			data, err := p.ToJSON()
+			if err != nil {
+				log.Printf("%v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: push\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+			p.SetDelivered(device)
+		case <-c:
+			// Comment lines are ignored by clients, but they keep proxies
+			// from closing idle connection and let us notice dead clients
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+			c = time.After(time.Second * keepAliveInterval)
+		case <-r.Context().Done():
+			return
+		case <-kicked:
+			return
+		}
+	}
+}
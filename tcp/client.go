@@ -1,11 +1,13 @@
 package tcp
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/vhakulinen/push-server/db"
@@ -22,61 +24,31 @@ const (
 	pingInterval = 120
 
 	chanBufferSize = 100
-)
-
-type tcpPool struct {
-	m  map[string]chan<- string
-	mu sync.RWMutex // protects m
-}
-
-func (t *tcpPool) Get(token string) (chan<- string, bool) {
-	t.mu.RLock()
-	c, ok := t.m[token]
-	t.mu.RUnlock()
-	return c, ok
-}
-
-func (t *tcpPool) Set(token string, c chan<- string) error {
-	// Check whether token is already in pool
-	_, ok := t.Get(token)
-	if ok {
-		return fmt.Errorf("Token already in map")
-	}
-
-	t.mu.Lock()
-	t.m[token] = c
-	t.mu.Unlock()
-	return nil
-}
-
-func (t *tcpPool) Remove(token string) error {
-	if _, ok := t.Get(token); ok {
-		t.mu.Lock()
-		delete(t.m, token)
-		t.mu.Unlock()
-		return nil
-	}
-	return fmt.Errorf("Token not in map")
-}
-
-var peers tcpPool
 
-// ClientFromPool is link to map where TCP client send channels are kept
-var ClientFromPool = func(token string) (chan<- string, bool) {
-	c, ok := peers.Get(token)
-	return c, ok
-}
+	// deviceCommand is sent by client to tell which device it is. Pushes
+	// which were sent to the device earlier but weren't acknowledged are
+	// sent again, and pushes sent from now on are tracked until they are
+	// acknowledged.
+	deviceCommand = ":DEVICE "
+	// ackCommand is sent by client to acknowledge push with the ID
+	ackCommand = ":ACK "
+	// sinceCommand is sent by client to receive stored pushes it has missed.
+	// The cursor is either the ID of the last push client has seen or unix
+	// timestamp prefixed with '@'.
+	sinceCommand = ":SINCE "
+)
 
 // HandleTCPClient handles new TCP client connections
 func HandleTCPClient(conn net.Conn) {
 	var token string
-	var sendChan = make(chan string, chanBufferSize)
+	var poolID int64
+	var kicked <-chan struct{}
+	var sendChan = make(chan *db.PushData, chanBufferSize)
 	defer func() {
 		conn.Close()
 		if token != "" {
-			peers.Remove(token)
+			peers.Remove(token, poolID)
 		}
-		close(sendChan)
 	}()
 	// Dont wait forever for the first message
 	conn.SetReadDeadline(time.Now().Add(time.Second * tokenReadDeadLine))
@@ -91,26 +63,129 @@ func HandleTCPClient(conn net.Conn) {
 		return
 	}
 
-	if !db.TokenExists(fmt.Sprintf("%s", string(buf))) {
-		conn.Write([]byte("Token not found!\n"))
+	// Clients can authenticate with API key which has read scope as well
+	resolved, key, old, err := db.ResolveCredential(string(buf), db.ScopeRead)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("%v!\n", err)))
 		return
 	}
-	if err = peers.Set(string(buf), sendChan); err != nil {
-		conn.Write([]byte("Client already listening for this token\n"))
-		return
+	token = resolved
+	// Pings take care of dead clients from now on
+	conn.SetReadDeadline(time.Time{})
+
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go readLines(conn, lines, done)
+
+	poolID, kicked = peers.Add(token, key, old, sendChan)
+
+	// Sends are only tracked for clients which tell their device or ask for
+	// missed pushes, since older clients never acknowledge anything and
+	// would get every push again on each connect
+	var device *db.Device
+	// send writes push to the client, which will have to acknowledge it
+	send := func(p *db.PushData) error {
+		data, err := p.ToJSON()
+		if err != nil {
+			log.Printf("%v", err)
+			return nil
+		}
+		if _, err = conn.Write(append(data, '\n')); err != nil {
+			return err
+		}
+		if device != nil {
+			p.SetSent(device)
+		}
+		return nil
+	}
+	// defaultDevice returns the client's device, which is the default device
+	// if client hasn't told otherwise
+	defaultDevice := func() (*db.Device, error) {
+		if device != nil {
+			return device, nil
+		}
+		return db.RegisterDevice(db.DefaultDeviceName, token)
 	}
-	token = string(buf)
 
+	// ID of the last replayed push. Live pushes up to this are already sent.
+	var replayed int64
+
+	// Pushes are not sent while we're waiting for pong, so recv is nil then
+	var recv <-chan *db.PushData = sendChan
+	// Expected pong message, empty when we are not waiting for one
+	var pong string
+	var pongTimeout <-chan time.Time
 	c := time.After(time.Second * pingInterval)
 	for {
 		select {
-		case data, ok := <-sendChan:
-			if ok {
-				_, err := conn.Write([]byte(data + "\n"))
+		case p := <-recv:
+			if p.ID <= replayed {
+				continue
+			}
+			if err := send(p); err != nil {
+				return
+			}
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			switch {
+			case pong != "" && line == pong:
+				pong = ""
+				pongTimeout = nil
+				recv = sendChan
+				c = time.After(time.Second * pingInterval)
+			case strings.HasPrefix(line, deviceCommand):
+				device, err = db.RegisterDevice(strings.TrimPrefix(line, deviceCommand), token)
+				if err != nil {
+					conn.Write([]byte(fmt.Sprintf("%v\n", err)))
+					return
+				}
+				for _, p := range device.UnackedPushes() {
+					if err := send(&p); err != nil {
+						return
+					}
+				}
+			case strings.HasPrefix(line, sinceCommand):
+				pushes, err := pushesSince(token, strings.TrimPrefix(line, sinceCommand))
+				if err != nil {
+					conn.Write([]byte(fmt.Sprintf("%v\n", err)))
+					return
+				}
+				if device, err = defaultDevice(); err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				// Pushes arriving meanwhile wait in sendChan and are sent
+				// after these
+				for _, p := range pushes {
+					if p.Priority == 3 {
+						continue
+					}
+					if err := send(&p); err != nil {
+						return
+					}
+					replayed = p.ID
+				}
+			case strings.HasPrefix(line, ackCommand):
+				id, err := strconv.ParseInt(strings.TrimPrefix(line, ackCommand), 10, 64)
 				if err != nil {
+					conn.Write([]byte("Invalid ACK\n"))
 					return
 				}
-			} else {
+				p, err := db.GetPushData(id, token)
+				if err != nil {
+					// Push might have been deleted, nothing to acknowledge
+					continue
+				}
+				d, err := defaultDevice()
+				if err != nil {
+					log.Printf("%v", err)
+					return
+				}
+				p.SetDelivered(d)
+			default:
 				return
 			}
 		case <-c:
@@ -121,23 +196,45 @@ func HandleTCPClient(conn net.Conn) {
 				log.Printf("%v", err)
 				return
 			}
+			pong = fmt.Sprintf(":PONG %s", msg)
+			pongTimeout = time.After(time.Second * pingTimeout)
+			recv = nil
+		case <-pongTimeout:
+			return
+		case <-kicked:
+			conn.Write([]byte("Token revoked\n"))
+			return
+		}
+	}
+}
 
-			// Read pong
-			conn.SetReadDeadline(time.Now().Add(time.Second * pingTimeout))
-			buf := make([]byte, 12)
-			i, err = conn.Read(buf)
-
-			// Check it
-			if i != 12 || err != nil || string(buf) != fmt.Sprintf(":PONG %s\n", msg) {
-				return
-			}
-			c = time.After(time.Second * pingInterval)
+// readLines reads lines sent by the client and passes them to lines without
+// the line ending. lines is closed when the connection dies.
+func readLines(conn net.Conn, lines chan<- string, done <-chan struct{}) {
+	defer close(lines)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		select {
+		case lines <- scanner.Text():
+		case <-done:
+			return
 		}
 	}
 }
 
-func init() {
-	peers = tcpPool{
-		m: make(map[string]chan<- string),
+// pushesSince returns token's pushes after cursor, which is either push ID or
+// unix timestamp prefixed with '@'.
+func pushesSince(token, cursor string) ([]db.PushData, error) {
+	if strings.HasPrefix(cursor, "@") {
+		ts, err := strconv.ParseInt(strings.TrimPrefix(cursor, "@"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SINCE timestamp")
+		}
+		return db.GetPushesSinceTime(token, time.Unix(ts, 0)), nil
+	}
+	id, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SINCE ID")
 	}
+	return db.GetPushesSinceID(token, id), nil
 }
@@ -0,0 +1,155 @@
+package tcp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/vhakulinen/push-server/db"
+)
+
+// poolClient is live client in the pool. kick is closed when the client
+// should disconnect. keyID is the API key the client authenticated with,
+// zero if it used the token. oldToken is the rotated token the client
+// authenticated with, empty if it used the current token.
+type poolClient struct {
+	c        chan<- *db.PushData
+	kick     chan struct{}
+	keyID    int64
+	oldToken string
+	expire   *time.Timer // kicks the client when its API key or old token expires
+}
+
+// tcpPool keeps send channels of live clients. Token can have any number of
+// clients listening at the same time, each of which is identified by an ID
+// given when the client is added to the pool.
+type tcpPool struct {
+	m      map[string]map[int64]poolClient
+	nextID int64
+	mu     sync.RWMutex // protects m and nextID
+}
+
+func (t *tcpPool) Get(token string) []chan<- *db.PushData {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	clients := make([]chan<- *db.PushData, 0, len(t.m[token]))
+	for _, c := range t.m[token] {
+		clients = append(clients, c.c)
+	}
+	return clients
+}
+
+func (t *tcpPool) Add(token string, key *db.APIKey, old *db.OldToken, c chan<- *db.PushData) (int64, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	if _, ok := t.m[token]; !ok {
+		t.m[token] = make(map[int64]poolClient)
+	}
+	id := t.nextID
+	client := poolClient{c: c, kick: make(chan struct{})}
+	var expiresAt time.Time
+	if key != nil {
+		client.keyID = key.ID
+		expiresAt = key.ExpiresAt
+	}
+	if old != nil {
+		client.oldToken = old.Token
+		expiresAt = old.ExpiresAt
+	}
+	if !expiresAt.IsZero() {
+		client.expire = time.AfterFunc(expiresAt.Sub(time.Now()), func() {
+			t.kick(token, func(cid int64, _ poolClient) bool { return cid == id })
+		})
+	}
+	t.m[token][id] = client
+	return id, client.kick
+}
+
+func (t *tcpPool) Remove(token string, id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.m[token][id]; ok && c.expire != nil {
+		c.expire.Stop()
+	}
+	delete(t.m[token], id)
+	if len(t.m[token]) == 0 {
+		delete(t.m, token)
+	}
+}
+
+// Kick removes every client of token from the pool and tells them to
+// disconnect. Returns the number of clients kicked.
+func (t *tcpPool) Kick(token string) int {
+	return t.kick(token, func(int64, poolClient) bool { return true })
+}
+
+// KickKey is Kick for clients which authenticated with API key keyID.
+func (t *tcpPool) KickKey(token string, keyID int64) int {
+	return t.kick(token, func(_ int64, c poolClient) bool { return c.keyID == keyID })
+}
+
+// kick kicks token's clients for which match returns true.
+func (t *tcpPool) kick(token string, match func(id int64, c poolClient) bool) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for id, c := range t.m[token] {
+		if !match(id, c) {
+			continue
+		}
+		if c.expire != nil {
+			c.expire.Stop()
+		}
+		close(c.kick)
+		delete(t.m[token], id)
+		n++
+	}
+	if len(t.m[token]) == 0 {
+		delete(t.m, token)
+	}
+	return n
+}
+
+var peers tcpPool
+
+// ClientsFromPool is link to map where live client (TCP, SSE and WebSocket)
+// send channels are kept. It returns send channels of all clients listening
+// for token.
+var ClientsFromPool = func(token string) []chan<- *db.PushData {
+	return peers.Get(token)
+}
+
+// AddToPool adds send channel c to the pool under token. Anything pushed
+// to the token after this is sent to c. key is the API key client
+// authenticated with, or nil if it used the token. old is the rotated token
+// client authenticated with, or nil. Returned ID is used to remove c from
+// the pool, and the returned channel is closed when the client should
+// disconnect (e.g. the token was rotated, the key was revoked or expired,
+// or the old token's grace period ended).
+func AddToPool(token string, key *db.APIKey, old *db.OldToken, c chan<- *db.PushData) (int64, <-chan struct{}) {
+	return peers.Add(token, key, old, c)
+}
+
+// RemoveFromPool removes send channel with id from token's clients.
+func RemoveFromPool(token string, id int64) {
+	peers.Remove(token, id)
+}
+
+// DisconnectFromPool disconnects every live client of token. Returns the
+// number of clients disconnected.
+func DisconnectFromPool(token string) int {
+	return peers.Kick(token)
+}
+
+// DisconnectKeyFromPool disconnects live clients of token which
+// authenticated with API key keyID. Returns the number of clients
+// disconnected.
+func DisconnectKeyFromPool(token string, keyID int64) int {
+	return peers.KickKey(token, keyID)
+}
+
+func init() {
+	peers = tcpPool{
+		m: make(map[string]map[int64]poolClient),
+	}
+}
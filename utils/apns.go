@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/vhakulinen/push-server/config"
+)
+
+const (
+	apnsDefaultURL = "https://api.push.apple.com"
+	// APNs rejects provider tokens older than an hour and doesn't like them
+	// being renewed more often than every 20 minutes
+	apnsTokenLifetime = 50 * time.Minute
+	// Seconds APNs should keep the notification if device is offline
+	apnsExpiration = 24 * 60 * 60
+)
+
+// Errors in APNSResult telling that the device token should be forgotten
+const (
+	// APNSErrorUnregistered means the app was uninstalled from the device
+	APNSErrorUnregistered = "Unregistered"
+	// APNSErrorBadDeviceToken means the device token is invalid
+	APNSErrorBadDeviceToken = "BadDeviceToken"
+	// APNSErrorDeviceTokenNotForTopic means the device token belongs to
+	// another app
+	APNSErrorDeviceTokenNotForTopic = "DeviceTokenNotForTopic"
+
+	apnsErrorExpiredProviderToken = "ExpiredProviderToken"
+)
+
+// APNSNotification is the push data sent to iOS devices.
+type APNSNotification struct {
+	ID    int64
+	Title string
+	Body  string
+	URL   string
+	// Sound tells whether the device should make sound
+	Sound bool
+}
+
+// APNSResult is result of sending notification to one device. Error is
+// empty if the notification was sent. Permanent is set when sending again
+// won't help (APNs rejected the request itself).
+type APNSResult struct {
+	DeviceToken string
+	Error       string
+	Permanent   bool
+}
+
+// apnsSender sends notifications to APNs using token based authentication.
+type apnsSender struct {
+	key    *ecdsa.PrivateKey
+	keyID  string
+	teamID string
+	topic  string
+	url    string
+	client *http.Client
+
+	mu     sync.Mutex // protects token and issued
+	token  string
+	issued time.Time
+}
+
+var apns *apnsSender
+
+// SendAPNS sends notification to iOS devices and returns result for each of
+// them.
+var SendAPNS = func(deviceTokens []string, n APNSNotification) []APNSResult {
+	LoadConfig()
+	if apns == nil {
+		return nil
+	}
+
+	results := make([]APNSResult, 0, len(deviceTokens))
+	for _, t := range deviceTokens {
+		result := APNSResult{DeviceToken: t}
+		if err := apns.send(t, n); err != nil {
+			if e, ok := err.(*apnsError); ok {
+				result.Error = e.Reason
+				result.Permanent = e.permanent()
+			} else {
+				result.Error = err.Error()
+			}
+			log.Printf("Failed to send APNs notification (%v)", err)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func newAPNSSender(p8 []byte, keyID, teamID, topic, url string) (*apnsSender, error) {
+	block, _ := pem.Decode(p8)
+	if block == nil {
+		return nil, fmt.Errorf("APNs key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid APNs key (%v)", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("APNs key is not EC key")
+	}
+	if url == "" {
+		url = apnsDefaultURL
+	}
+	return &apnsSender{
+		key:    ecKey,
+		keyID:  keyID,
+		teamID: teamID,
+		topic:  topic,
+		url:    url,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			// APNs only speaks HTTP/2
+			Transport: &http.Transport{
+				ForceAttemptHTTP2: true,
+				TLSClientConfig:   &tls.Config{},
+			},
+		},
+	}, nil
+}
+
+// providerToken returns the JWT used to authenticate with APNs, creating new
+// one when the old is about to expire.
+func (s *apnsSender) providerToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Since(s.issued) < apnsTokenLifetime {
+		return s.token, nil
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": s.teamID,
+		"iat": now.Unix(),
+	}
+	token, err := signJWT(claims, s.key, map[string]string{"kid": s.keyID})
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+	s.issued = now
+	return token, nil
+}
+
+// apnsError is error response from APNs.
+type apnsError struct {
+	Status int
+	Reason string `json:"reason"`
+}
+
+func (e *apnsError) Error() string {
+	return fmt.Sprintf("APNs replied %d (%s)", e.Status, e.Reason)
+}
+
+// permanent tells whether APNs rejected the request so that sending it
+// again won't help. Throttling and expired provider token (which is renewed
+// on the next send) are worth retrying.
+func (e *apnsError) permanent() bool {
+	if e.Status == http.StatusTooManyRequests || e.Reason == apnsErrorExpiredProviderToken {
+		return false
+	}
+	return e.Status >= 400 && e.Status < 500
+}
+
+func (s *apnsSender) send(deviceToken string, n APNSNotification) error {
+	token, err := s.providerToken()
+	if err != nil {
+		return err
+	}
+
+	aps := map[string]interface{}{
+		"alert": map[string]string{
+			"title": n.Title,
+			"body":  n.Body,
+		},
+	}
+	// Priority 10 delivers right away, 5 lets the device save power when
+	// there's no sound to make anyway
+	priority := "5"
+	if n.Sound {
+		aps["sound"] = "default"
+		priority = "10"
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"aps": aps,
+		"id":  n.ID,
+		"url": n.URL,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/3/device/%s", s.url, url.PathEscape(deviceToken)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", "bearer "+token)
+	req.Header.Set("apns-topic", s.topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", priority)
+	req.Header.Set("apns-expiration", fmt.Sprintf("%d", time.Now().Unix()+apnsExpiration))
+	req.Header.Set("content-type", "application/json")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	e := &apnsError{Status: res.StatusCode}
+	b, _ := ioutil.ReadAll(res.Body)
+	if err := json.Unmarshal(b, e); err != nil {
+		e.Reason = string(b)
+	}
+	if e.Reason == apnsErrorExpiredProviderToken {
+		s.mu.Lock()
+		s.token = ""
+		s.mu.Unlock()
+	}
+	return e
+}
+
+func loadAPNSConfig() {
+	keyPath, err := config.Config.String("apns", "keypath")
+	if err != nil || keyPath == "" {
+		// APNs is optional
+		return
+	}
+	keyID, err := config.Config.String("apns", "keyid")
+	teamID, err := config.Config.String("apns", "teamid")
+	topic, err := config.Config.String("apns", "topic")
+	if err != nil {
+		log.Fatal(err)
+	}
+	url, _ := config.Config.String("apns", "url")
+
+	p8, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		log.Fatalf("Failed to read APNs key file (%v)", err)
+	}
+	apns, err = newAPNSSender(p8, keyID, teamID, topic, url)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
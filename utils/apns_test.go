@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSendAPNS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type request struct {
+		proto    int
+		headers  http.Header
+		path     string
+		sound    interface{}
+		hasSound bool
+	}
+	var requests []request
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Aps map[string]interface{} `json:"aps"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		sound, hasSound := body.Aps["sound"]
+		requests = append(requests, request{r.ProtoMajor, r.Header, r.URL.Path, sound, hasSound})
+		if strings.HasSuffix(r.URL.Path, "/gone") {
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason":"Unregistered","timestamp":1500000000000}`))
+		} else if strings.HasSuffix(r.URL.Path, "/toobig") {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte(`{"reason":"PayloadTooLarge"}`))
+		} else if strings.HasSuffix(r.URL.Path, "/busy") {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"reason":"TooManyRequests"}`))
+		}
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	p8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	s, err := newAPNSSender(p8, "KEYID", "TEAMID", "com.example.push", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.client = ts.Client()
+	oapns := apns
+	apns = s
+	defer func() { apns = oapns }()
+	// There's no configuration to load in tests
+	loadOnce.Do(func() {})
+
+	results := SendAPNS([]string{"device", "gone"}, APNSNotification{ID: 1, Title: "title", Sound: true})
+	if len(results) != 2 || results[0].Error != "" || results[1].Error != APNSErrorUnregistered {
+		t.Errorf("Unexpected results (%v)", results)
+	}
+	SendAPNS([]string{"device"}, APNSNotification{ID: 2, Title: "title", Sound: false})
+
+	if len(requests) != 3 {
+		t.Fatalf("Expected 3 requests but got %d", len(requests))
+	}
+	for _, r := range requests {
+		if r.proto != 2 {
+			t.Errorf("Expected HTTP/2 but got HTTP/%d", r.proto)
+		}
+		if r.headers.Get("apns-topic") != "com.example.push" {
+			t.Errorf("Invalid apns-topic header (%s)", r.headers.Get("apns-topic"))
+		}
+		auth := r.headers.Get("authorization")
+		if !strings.HasPrefix(auth, "bearer ") {
+			t.Fatalf("Invalid authorization header (%s)", auth)
+		}
+		parts := strings.Split(strings.TrimPrefix(auth, "bearer "), ".")
+		if len(parts) != 3 {
+			t.Fatalf("Invalid provider token (%s)", auth)
+		}
+		h, _ := b64.DecodeString(parts[0])
+		var header map[string]string
+		json.Unmarshal(h, &header)
+		if header["alg"] != "ES256" || header["kid"] != "KEYID" {
+			t.Errorf("Invalid provider token header (%v)", header)
+		}
+	}
+	if requests[0].path != "/3/device/device" {
+		t.Errorf("Invalid path (%s)", requests[0].path)
+	}
+	if requests[0].headers.Get("apns-priority") != "10" || requests[0].sound != "default" {
+		t.Errorf("Push with sound should be sent with priority 10 and sound")
+	}
+	if requests[2].headers.Get("apns-priority") != "5" || requests[2].hasSound {
+		t.Errorf("Push without sound should be sent with priority 5 and no sound")
+	}
+
+	// Rejected requests aren't worth retrying, throttled ones are
+	results = SendAPNS([]string{"toobig", "busy"}, APNSNotification{ID: 3, Title: "title"})
+	if len(results) != 2 || !results[0].Permanent || results[1].Permanent {
+		t.Errorf("Unexpected results (%v)", results)
+	}
+}
@@ -0,0 +1,333 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vhakulinen/push-server/config"
+)
+
+const (
+	fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+	// Endpoint of FCM HTTP v1 API, %s is the project ID
+	fcmDefaultEndpoint = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+	// How long the JWT used to get access token is valid for
+	fcmAssertionLifetime = time.Hour
+	// Access token is renewed this long before it expires
+	fcmTokenSlack = time.Minute
+)
+
+// Errors in FCMResult telling that the registration token should be
+// forgotten
+const (
+	// FCMErrorUnregistered means the app was uninstalled or the token expired
+	FCMErrorUnregistered = "UNREGISTERED"
+	// FCMErrorInvalidRegistration means the token is malformed or belongs
+	// to another project
+	FCMErrorInvalidRegistration = "INVALID_REGISTRATION"
+)
+
+// FCMResult is result of sending message to one registration token. Error
+// is empty if the message was sent. RetryAfter is how long FCM asked to wait
+// before sending again, if it told so. Permanent is set when sending again
+// won't help (e.g. the payload or our credentials were rejected).
+//
+// Unlike the legacy GCM API, FCM HTTP v1 doesn't return canonical
+// registration IDs. Stale tokens are reported as FCMErrorUnregistered
+// instead, so there is nothing to replace them with.
+type FCMResult struct {
+	RegistrationID string
+	Error          string
+	RetryAfter     time.Duration
+	Permanent      bool
+}
+
+// fcmServiceAccount is the parts we need from Google service account JSON
+// key file.
+type fcmServiceAccount struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// fcmSender sends messages to FCM HTTP v1 API authenticating with service
+// account.
+type fcmSender struct {
+	account  fcmServiceAccount
+	key      *rsa.PrivateKey
+	endpoint string
+	client   *http.Client
+
+	mu          sync.Mutex // protects accessToken and expires
+	accessToken string
+	expires     time.Time
+}
+
+var fcm *fcmSender
+
+// fcmSendPayload tells whether the push data is sent to clients or only
+// a ping telling them to pool
+var fcmSendPayload = false
+
+// loadOnce makes sure configuration is loaded only once, even when senders
+// are called concurrently before main has loaded it
+var loadOnce sync.Once
+
+// FCMSendsPayload tells whether SendFCM sends the push data itself, instead
+// of ping telling clients to pool.
+var FCMSendsPayload = func() bool {
+	LoadConfig()
+	return fcm != nil && fcmSendPayload
+}
+
+// SendFCM sends data message to FCM clients and returns result for each of
+// them. If sending payload is disabled in configuration, clients only get
+// ping message telling them to pool data. Failed messages aren't retried,
+// that is left to the caller.
+var SendFCM = func(regIds []string, data map[string]string) []FCMResult {
+	LoadConfig()
+	if fcm == nil {
+		return nil
+	}
+
+	collapseKey := ""
+	if !fcmSendPayload {
+		data = map[string]string{"message": "ping"}
+		collapseKey = "ping"
+	}
+	results := make([]FCMResult, 0, len(regIds))
+	for _, id := range regIds {
+		result := FCMResult{RegistrationID: id}
+		retryAfter, err := fcm.send(id, data, collapseKey)
+		if e, ok := err.(*fcmError); ok && e.registration != "" {
+			result.Error = e.registration
+		} else if err != nil {
+			log.Printf("Failed to send FCM message (%v)", err)
+			result.Error = err.Error()
+			if retryAfter > 0 {
+				result.RetryAfter = retryAfter
+			}
+			result.Permanent = retryAfter < 0
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// fcmError is error response from FCM.
+type fcmError struct {
+	status  int
+	message string
+	// registration is either FCMErrorUnregistered or
+	// FCMErrorInvalidRegistration, if the error was caused by the token
+	registration string
+}
+
+func (e *fcmError) Error() string {
+	return fmt.Sprintf("FCM replied %d (%s)", e.status, e.message)
+}
+
+// parseFCMError parses FCM HTTP v1 error response.
+func parseFCMError(res *http.Response) *fcmError {
+	e := &fcmError{status: res.StatusCode}
+	var body struct {
+		Error struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	if err := json.Unmarshal(b, &body); err != nil {
+		e.message = string(b)
+		return e
+	}
+	e.message = body.Error.Message
+	code := body.Error.Status
+	for _, d := range body.Error.Details {
+		if d.ErrorCode != "" {
+			code = d.ErrorCode
+		}
+	}
+	switch {
+	case code == "UNREGISTERED" || res.StatusCode == http.StatusNotFound:
+		e.registration = FCMErrorUnregistered
+	case code == "SENDER_ID_MISMATCH":
+		e.registration = FCMErrorInvalidRegistration
+	case code == "INVALID_ARGUMENT" && strings.Contains(e.message, "registration token"):
+		// INVALID_ARGUMENT is also used for invalid payloads, so only
+		// blame the token when FCM does
+		e.registration = FCMErrorInvalidRegistration
+	}
+	return e
+}
+
+func newFCMSender(accountJSON []byte, endpoint string) (*fcmSender, error) {
+	s := &fcmSender{client: &http.Client{Timeout: 30 * time.Second}}
+	if err := json.Unmarshal(accountJSON, &s.account); err != nil {
+		return nil, fmt.Errorf("Invalid service account JSON (%v)", err)
+	}
+	block, _ := pem.Decode([]byte(s.account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("Service account has no private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid service account private key (%v)", err)
+	}
+	var ok bool
+	if s.key, ok = key.(*rsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("Service account private key is not RSA key")
+	}
+	if endpoint == "" {
+		endpoint = fcmDefaultEndpoint
+	}
+	if strings.Contains(endpoint, "%s") {
+		endpoint = fmt.Sprintf(endpoint, s.account.ProjectID)
+	}
+	s.endpoint = endpoint
+	return s, nil
+}
+
+// token returns OAuth2 access token, requesting new one with JWT bearer
+// grant if the current one has expired.
+func (s *fcmSender) token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.accessToken != "" && time.Now().Before(s.expires) {
+		return s.accessToken, nil
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   s.account.ClientEmail,
+		"scope": fcmScope,
+		"aud":   s.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(fcmAssertionLifetime).Unix(),
+	}
+	assertion, err := signJWT(claims, s.key, map[string]string{"kid": s.account.PrivateKeyID})
+	if err != nil {
+		return "", err
+	}
+	res, err := s.client.PostForm(s.account.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return "", fmt.Errorf("Failed to get access token: %s (%s)", res.Status, body)
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	s.accessToken = t.AccessToken
+	s.expires = now.Add(time.Duration(t.ExpiresIn)*time.Second - fcmTokenSlack)
+	return s.accessToken, nil
+}
+
+// send sends data message to one registration token. If sending can be
+// retried, retryAfter is how long FCM asked us to wait (zero if it didn't
+// say). Negative retryAfter means that retrying won't help.
+func (s *fcmSender) send(regID string, data map[string]string, collapseKey string) (retryAfter time.Duration, err error) {
+	token, err := s.token()
+	if err != nil {
+		return 0, err
+	}
+
+	android := map[string]interface{}{"priority": "high"}
+	if collapseKey != "" {
+		android["collapse_key"] = collapseKey
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":   regID,
+			"data":    data,
+			"android": android,
+		},
+	})
+	if err != nil {
+		return -1, err
+	}
+	req, err := http.NewRequest("POST", s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.client.Do(req)
+	if err != nil {
+		// Network errors are worth retrying
+		return 0, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return 0, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		// Unavailable, internal error or quota exceeded
+		if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(secs) * time.Second
+		}
+		return retryAfter, parseFCMError(res)
+	default:
+		return -1, parseFCMError(res)
+	}
+}
+
+// LoadConfig loads this package configuration from global config.Config
+// object. Only the first call loads it.
+func LoadConfig() {
+	loadOnce.Do(func() {
+		loadFCMConfig()
+		loadAPNSConfig()
+		loadWebPushConfig()
+	})
+}
+
+func loadFCMConfig() {
+	path, err := config.Config.String("fcm", "serviceaccount")
+	if err != nil || path == "" {
+		// FCM is optional
+		return
+	}
+	endpoint, _ := config.Config.String("fcm", "endpoint")
+	tokenURL, _ := config.Config.String("fcm", "tokenurl")
+	fcmSendPayload, _ = config.Config.Bool("fcm", "sendpayload")
+
+	account, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read FCM service account file (%v)", err)
+	}
+	fcm, err = newFCMSender(account, endpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tokenURL != "" {
+		fcm.account.TokenURI = tokenURL
+	}
+}
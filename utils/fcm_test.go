@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestFCMSender returns sender which uses fake token server and sends to
+// endpoint.
+func newTestFCMSender(t *testing.T, endpoint string) (*fcmSender, func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"accesstoken","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	account, _ := json.Marshal(map[string]string{
+		"project_id":   "project",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email": "push@project.iam.gserviceaccount.com",
+		"token_uri":    tokenServer.URL,
+	})
+	s, err := newFCMSender(account, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, tokenServer.Close
+}
+
+func TestSendFCMErrors(t *testing.T) {
+	tries := map[string]int{}
+	fcmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m struct {
+			Message struct {
+				Token string `json:"token"`
+			} `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&m)
+		tries[m.Message.Token]++
+		switch m.Message.Token {
+		case "retry":
+			w.Header().Set("Retry-After", "10")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error":{"code":503,"status":"UNAVAILABLE","message":"Unavailable"}}`))
+			return
+		case "down":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":{"code":500,"status":"INTERNAL","message":"Internal"}}`))
+			return
+		case "unregistered":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":404,"status":"NOT_FOUND","message":"Requested entity was not found.",` +
+				`"details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`))
+			return
+		case "invalid":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"code":400,"status":"INVALID_ARGUMENT",` +
+				`"message":"The registration token is not a valid FCM registration token"}}`))
+			return
+		case "badpayload":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"code":400,"status":"INVALID_ARGUMENT","message":"Invalid data payload"}}`))
+			return
+		}
+		w.Write([]byte(`{"name":"projects/project/messages/1"}`))
+	}))
+	defer fcmServer.Close()
+
+	oFcm := fcm
+	defer func() {
+		fcm = oFcm
+	}()
+	var closeTokenServer func()
+	fcm, closeTokenServer = newTestFCMSender(t, fcmServer.URL)
+	defer closeTokenServer()
+	// There's no configuration to load in tests
+	loadOnce.Do(func() {})
+
+	results := SendFCM([]string{"ok", "retry", "down", "unregistered", "invalid", "badpayload"}, nil)
+	expected := []FCMResult{
+		{"ok", "", 0, false},
+		{"retry", "FCM replied 503 (Unavailable)", 10 * time.Second, false},
+		{"down", "FCM replied 500 (Internal)", 0, false},
+		{"unregistered", FCMErrorUnregistered, 0, false},
+		{"invalid", FCMErrorInvalidRegistration, 0, false},
+		{"badpayload", "FCM replied 400 (Invalid data payload)", 0, true},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("Got %d results, want %d", len(results), len(expected))
+	}
+	for i, want := range expected {
+		if results[i] != want {
+			t.Errorf("Got result %v, want %v", results[i], want)
+		}
+	}
+	// Retrying is left to the caller
+	for id, n := range tries {
+		if n != 1 {
+			t.Errorf("%s was tried %d times", id, n)
+		}
+	}
+}
+
+func TestSendFCM(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenRequests := 0
+	var tokenURL string
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("Got grant_type %q", r.FormValue("grant_type"))
+		}
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) != 3 {
+			t.Fatalf("Invalid assertion %q", r.FormValue("assertion"))
+		}
+		sig, _ := b64.DecodeString(parts[2])
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], sig); err != nil {
+			t.Errorf("Assertion signature doesn't verify (%v)", err)
+		}
+		body, _ := b64.DecodeString(parts[1])
+		claims := map[string]interface{}{}
+		json.Unmarshal(body, &claims)
+		if claims["iss"] != "push@project.iam.gserviceaccount.com" || claims["aud"] != tokenURL ||
+			claims["scope"] != fcmScope {
+			t.Errorf("Unexpected assertion claims (%v)", claims)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"accesstoken","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer tokenServer.Close()
+	tokenURL = tokenServer.URL
+
+	type message struct {
+		Message struct {
+			Token   string            `json:"token"`
+			Data    map[string]string `json:"data"`
+			Android struct {
+				CollapseKey string `json:"collapse_key"`
+			} `json:"android"`
+		} `json:"message"`
+	}
+	var received []message
+	fcmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/project/messages:send" {
+			t.Errorf("Got request to %q", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer accesstoken" {
+			t.Errorf("Got Authorization %q", r.Header.Get("Authorization"))
+		}
+		var m message
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, m)
+		w.Write([]byte(`{"name":"projects/project/messages/1"}`))
+	}))
+	defer fcmServer.Close()
+
+	account, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "project",
+		"private_key_id": "keyid",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   "push@project.iam.gserviceaccount.com",
+		"token_uri":      tokenServer.URL,
+	})
+	oFcm, oSendPayload := fcm, fcmSendPayload
+	defer func() {
+		fcm, fcmSendPayload = oFcm, oSendPayload
+	}()
+	fcm, err = newFCMSender(account, fcmServer.URL+"/v1/projects/%s/messages:send")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// There's no configuration to load in tests
+	loadOnce.Do(func() {})
+
+	data := map[string]string{"title": "title"}
+	fcmSendPayload = true
+	SendFCM([]string{"id1", "id2"}, data)
+	fcmSendPayload = false
+	SendFCM([]string{"id1"}, data)
+
+	if tokenRequests != 1 {
+		t.Errorf("Access token should be requested once, was requested %d times", tokenRequests)
+	}
+	if len(received) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(received))
+	}
+	if received[0].Message.Token != "id1" || received[1].Message.Token != "id2" {
+		t.Errorf("Messages were sent to wrong tokens")
+	}
+	if received[0].Message.Data["title"] != "title" {
+		t.Errorf("Got data %v, want %v", received[0].Message.Data, data)
+	}
+	if received[2].Message.Data["message"] != "ping" || received[2].Message.Android.CollapseKey != "ping" {
+		t.Errorf("Expected ping message, got %v", received[2].Message)
+	}
+}
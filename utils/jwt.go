@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidJWT is returned by VerifyHS256 when token is malformed or its
+// signature doesn't match.
+var ErrInvalidJWT = errors.New("Invalid JWT")
+
+// signJWT returns JWT containing claims signed with key. ES256 is used with
+// *ecdsa.PrivateKey and RS256 with *rsa.PrivateKey. Extra header fields
+// (e.g. "kid") can be given in header.
+func signJWT(claims interface{}, key crypto.Signer, header map[string]string) (string, error) {
+	h := map[string]string{"typ": "JWT"}
+	for k, v := range header {
+		h[k] = v
+	}
+	switch key.(type) {
+	case *ecdsa.PrivateKey:
+		h["alg"] = "ES256"
+	case *rsa.PrivateKey:
+		h["alg"] = "RS256"
+	default:
+		return "", fmt.Errorf("Unsupported JWT signing key %T", key)
+	}
+	hb, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := b64.EncodeToString(hb) + "." + b64.EncodeToString(cb)
+	hash := sha256.Sum256([]byte(unsigned))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS signature is r and s as 32 byte big endian integers
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		if err != nil {
+			return "", err
+		}
+	}
+	return unsigned + "." + b64.EncodeToString(sig), nil
+}
+
+// SignHS256 returns JWT containing claims signed with secret using HS256.
+func SignHS256(claims interface{}, secret []byte) (string, error) {
+	hb, err := json.Marshal(map[string]string{"typ": "JWT", "alg": "HS256"})
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := b64.EncodeToString(hb) + "." + b64.EncodeToString(cb)
+	return unsigned + "." + b64.EncodeToString(hs256(unsigned, secret)), nil
+}
+
+// VerifyHS256 checks that token is HS256 JWT signed with secret and decodes
+// its claims to claims. Claims (e.g. exp) are not validated.
+func VerifyHS256(token string, secret []byte, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidJWT
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, hs256(parts[0]+"."+parts[1], secret)) {
+		return ErrInvalidJWT
+	}
+	// Signature is checked first, but alg must still be the one we signed
+	// with
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	hb, err := b64.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(hb, &h) != nil || h.Alg != "HS256" {
+		return ErrInvalidJWT
+	}
+	cb, err := b64.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(cb, claims) != nil {
+		return ErrInvalidJWT
+	}
+	return nil
+}
+
+func hs256(unsigned string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
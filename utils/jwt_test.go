@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHS256(t *testing.T) {
+	type claims struct {
+		Sub int64 `json:"sub"`
+	}
+	secret := []byte("secret")
+	token, err := SignHS256(claims{42}, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c claims
+	if err = VerifyHS256(token, secret, &c); err != nil {
+		t.Fatalf("Failed to verify token (%v)", err)
+	}
+	if c.Sub != 42 {
+		t.Errorf("Got sub %d, want %d", c.Sub, 42)
+	}
+
+	parts := strings.Split(token, ".")
+	// alg "none" with the original signature
+	none := b64.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	tampered := b64.EncodeToString([]byte(`{"sub":1}`))
+	var testData = []struct {
+		token  string
+		secret []byte
+	}{
+		{token, []byte("wrong")},
+		{parts[0] + "." + tampered + "." + parts[2], secret},
+		{none + "." + parts[1] + "." + parts[2], secret},
+		{none + "." + parts[1] + ".", secret},
+		{parts[0] + "." + parts[1], secret},
+		{"", secret},
+	}
+	for i, data := range testData {
+		if err := VerifyHS256(data.token, data.secret, &c); err != ErrInvalidJWT {
+			t.Errorf("Got %v, want %v (run %d)", err, ErrInvalidJWT, i)
+		}
+	}
+}
@@ -1,24 +1,36 @@
 package utils
 
 import (
-	"math/rand"
-	"time"
+	"crypto/rand"
+	"math/big"
 )
 
-func init() {
-	rand.Seed(time.Now().UTC().UnixNano())
-}
+const (
+	// Uppercase contains the letters A-Z
+	Uppercase = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	// Alphanumeric contains the letters A-Z, a-z and digits 0-9. Strings made
+	// of these are safe to use in URLs as is.
+	Alphanumeric = Uppercase + "abcdefghijklmnopqrstuvwxyz0123456789"
+)
 
-// RandomString returns new random string. l specifies the length of the
-// string to reutrn
+// RandomString returns new random string of uppercase letters. l specifies
+// the length of the string to return
 func RandomString(l int) string {
+	return RandomStringFrom(Uppercase, l)
+}
+
+// RandomStringFrom returns new random string of length l with characters
+// picked from alphabet. Uses crypto/rand, so the result is safe to use for
+// secrets. Panics if the system's secure random source fails.
+func RandomStringFrom(alphabet string, l int) string {
+	max := big.NewInt(int64(len(alphabet)))
 	bytes := make([]byte, l)
 	for i := 0; i < l; i++ {
-		bytes[i] = byte(randInt(65, 90))
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		bytes[i] = alphabet[n.Int64()]
 	}
 	return string(bytes)
 }
-
-func randInt(min int, max int) int {
-	return min + rand.Intn(max-min)
-}
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRandomStringFrom(t *testing.T) {
+	var testData = []struct {
+		alphabet string
+		length   int
+	}{
+		{Uppercase, 5},
+		{Alphanumeric, 32},
+		{"ab", 100},
+		{Alphanumeric, 0},
+	}
+	for i, data := range testData {
+		s := RandomStringFrom(data.alphabet, data.length)
+		if len(s) != data.length {
+			t.Errorf("Got length %d, want %d (run %d)", len(s), data.length, i)
+		}
+		for _, c := range s {
+			if !strings.ContainsRune(data.alphabet, c) {
+				t.Errorf("Got %q which is not in %q (run %d)", c, data.alphabet, i)
+			}
+		}
+	}
+	if RandomStringFrom(Alphanumeric, 32) == RandomStringFrom(Alphanumeric, 32) {
+		t.Errorf("Got same string twice")
+	}
+}
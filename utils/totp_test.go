@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// Test vectors from RFC 6238 appendix B (SHA1), last 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	var testData = []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for i, data := range testData {
+		code, err := TOTP(secret, TOTPStep(time.Unix(data.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != data.code {
+			t.Errorf("Got %s, want %s (run %d)", code, data.code, i)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	code, _ := TOTP(secret, TOTPStep(now))
+	previous, _ := TOTP(secret, TOTPStep(now)-1)
+	old, _ := TOTP(secret, TOTPStep(now)-2)
+
+	var testData = []struct {
+		code     string
+		expected bool
+	}{
+		{code, true},
+		// One period of clock drift is allowed
+		{previous, true},
+		{old, false},
+		{"", false},
+		{"12345", false},
+	}
+	for i, data := range testData {
+		if _, ok := ValidateTOTP(secret, data.code, now); ok != data.expected {
+			t.Errorf("Got %v, want %v (run %d)", ok, data.expected, i)
+		}
+	}
+	if step, _ := ValidateTOTP(secret, code, now); step != TOTPStep(now) {
+		t.Errorf("Got step %d, want %d", step, TOTPStep(now))
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("JBSWY3DPEHPK3PXP", "user@domain.com", "push-serv")
+	if !strings.HasPrefix(uri, "otpauth://totp/push-serv:user@domain.com?") {
+		t.Errorf("Unexpected URI %s", uri)
+	}
+	for _, param := range []string{"secret=JBSWY3DPEHPK3PXP", "issuer=push-serv", "digits=6", "period=30"} {
+		if !strings.Contains(uri, param) {
+			t.Errorf("URI %s doesn't have %s", uri, param)
+		}
+	}
+}
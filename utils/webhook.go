@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// WebhookSignatureHeader is the header carrying HMAC-SHA256 signature of the
+// webhook request body, in form "sha256=<hex>".
+const WebhookSignatureHeader = "X-Push-Signature"
+
+// WebhookAllowPrivate allows webhooks and web pushes to loopback, private,
+// link-local and other special purpose addresses. Off by default, since otherwise anyone with a
+// token could make the server send requests to services in its internal
+// network.
+var WebhookAllowPrivate = false
+
+// ErrWebhookAddress is returned when webhook's host is not public address
+var ErrWebhookAddress = errors.New("Webhook address is not public")
+
+var webhookClient = publicClient(10*time.Second, ErrWebhookAddress)
+
+// publicClient returns HTTP client which only connects to addresses allowed
+// by WebhookIPAllowed, and fails with errAddress otherwise. Addresses are
+// checked when connecting, after the host has been resolved, so that DNS
+// can't point the host elsewhere after it's registered. This covers
+// redirects too.
+func publicClient(timeout time.Duration, errAddress error) *http.Client {
+	control := func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if !WebhookIPAllowed(net.ParseIP(host)) {
+			return errAddress
+		}
+		return nil
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 10 * time.Second,
+				Control: control,
+			}).DialContext,
+		},
+	}
+}
+
+// WebhookHostAllowed tells if host of URL can be registered as webhook or web
+// push endpoint. Only IP addresses and localhost are checked, other host
+// names are checked once resolved, when connecting.
+func WebhookHostAllowed(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return WebhookIPAllowed(ip)
+	}
+	return host != "localhost" || WebhookAllowPrivate
+}
+
+// webhookBlockedNets are special purpose ranges which aren't covered by the
+// net.IP checks in WebhookIPAllowed.
+var webhookBlockedNets = parseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"100.64.0.0/10",  // carrier-grade NAT
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved and broadcast
+	"64:ff9b:1::/48", // local-use NAT64
+)
+
+// webhookEmbeddingNets are IPv6 ranges which carry IPv4 address that the
+// traffic ends up at, with the offset of the IPv4 address.
+var webhookEmbeddingNets = []struct {
+	net    *net.IPNet
+	offset int
+}{
+	{parseCIDRs("::/96")[0], 12},        // IPv4-compatible
+	{parseCIDRs("64:ff9b::/96")[0], 12}, // NAT64
+	{parseCIDRs("2002::/16")[0], 2},     // 6to4
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// WebhookIPAllowed tells if webhooks can be sent to ip. IPv4 addresses
+// embedded in IPv6 addresses (IPv4-mapped, NAT64, 6to4) are checked too.
+func WebhookIPAllowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if WebhookAllowPrivate {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		for _, e := range webhookEmbeddingNets {
+			if e.net.Contains(ip) && !WebhookIPAllowed(ip[e.offset:e.offset+net.IPv4len]) {
+				return false
+			}
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range webhookBlockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// SignWebhook returns signature of payload with secret as it's sent in
+// WebhookSignatureHeader.
+func SignWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SendWebhook POSTs signed JSON payload to url. Returns the response status
+// code (zero if there was no response) and error unless status was 2xx.
+var SendWebhook = func(url, secret string, payload []byte) (int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(secret, payload))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("Webhook replied %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
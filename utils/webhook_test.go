@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookIPAllowed(t *testing.T) {
+	var testData = []struct {
+		ip       string
+		expected bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		{"192.0.0.170", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.1.2.3", false},
+		{"::ffff:100.64.0.1", false},
+		{"::ffff:93.184.216.34", true},
+		{"::10.1.2.3", false},
+		{"64:ff9b::a01:203", false},
+		{"64:ff9b::5db8:d822", true},
+		{"2002:a01:203::1", false},
+		{"2002:5db8:d822::1", true},
+	}
+	for i, data := range testData {
+		if got := WebhookIPAllowed(net.ParseIP(data.ip)); got != data.expected {
+			t.Errorf("Got %v, want %v for %s (run %d)", got, data.expected, data.ip, i)
+		}
+	}
+}
+
+func TestSendWebhookPrivate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	// Host name is resolved before checking
+	url := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+	if _, err := SendWebhook(url, "secret", []byte("{}")); err == nil || !strings.Contains(err.Error(), ErrWebhookAddress.Error()) {
+		t.Errorf("Got error %v, want %v", err, ErrWebhookAddress)
+	}
+
+	WebhookAllowPrivate = true
+	defer func() { WebhookAllowPrivate = false }()
+	if _, err := SendWebhook(url, "secret", []byte("{}")); err != nil {
+		t.Errorf("Didn't expect error and got one! (%v)", err)
+	}
+}
@@ -0,0 +1,262 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/vhakulinen/push-server/config"
+)
+
+const (
+	// Seconds push service should keep the message if browser is offline
+	webPushTTL = 24 * 60 * 60
+	// How long the VAPID JWT is valid for (max allowed is 24 hours)
+	vapidExpiration = 12 * time.Hour
+	// Record size used in the encrypted content, we only use one record
+	webPushRecordSize = 4096
+	// Size of the aes128gcm header: 16 byte salt, 4 byte record size, 1 byte
+	// key ID length and 65 byte uncompressed public key as the key ID
+	webPushHeaderSize = 16 + 4 + 1 + 65
+	// Max size of payload we can fit in one record, so that the whole body
+	// is within the 4096 bytes push services must accept (header, 16 byte
+	// GCM tag and 1 byte padding delimiter taken off)
+	webPushMaxPayload = webPushRecordSize - webPushHeaderSize - 16 - 1
+)
+
+// ErrWebPushGone is returned when push service tells that the subscription
+// doesn't exist anymore. Subscription should be deleted.
+var ErrWebPushGone = errors.New("Web push subscription is gone")
+
+// ErrWebPushAddress is returned when subscription's endpoint is not public
+// address. See WebhookAllowPrivate.
+var ErrWebPushAddress = errors.New("Web push endpoint address is not public")
+
+// webPushRejectedError is error which sending again won't fix, e.g. the push
+// service rejected the request or the payload can't be encrypted.
+type webPushRejectedError struct {
+	error
+}
+
+// WebPushRejected tells if err returned by SendWebPush means that the push
+// can't be sent to the subscription, so it shouldn't be retried.
+func WebPushRejected(err error) bool {
+	_, ok := err.(webPushRejectedError)
+	return ok
+}
+
+// WebPushSubscription is the browser's push subscription (the contents of
+// PushSubscription.toJSON() in browser)
+type WebPushSubscription struct {
+	Endpoint string
+	// P256dh is the browser's public key, base64url encoded
+	P256dh string
+	// Auth is the authentication secret, base64url encoded
+	Auth string
+}
+
+var (
+	vapidPrivateKey *ecdsa.PrivateKey
+	// VAPID public key, base64url encoded uncompressed point
+	vapidPublicKey string
+	vapidSubject   string
+
+	webPushClient = publicClient(30*time.Second, ErrWebPushAddress)
+)
+
+var b64 = base64.RawURLEncoding
+
+// VAPIDPublicKey returns the application server key browsers need when
+// subscribing.
+func VAPIDPublicKey() string {
+	return vapidPublicKey
+}
+
+// SendWebPush encrypts payload and sends it to the subscription's push service.
+// Errors which retrying won't fix are reported by WebPushRejected.
+var SendWebPush = func(sub WebPushSubscription, payload []byte) error {
+	if vapidPrivateKey == nil {
+		return fmt.Errorf("VAPID keys not configured")
+	}
+	body, err := encryptWebPush(sub, payload)
+	if err != nil {
+		return webPushRejectedError{err}
+	}
+	auth, err := vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprintf("%d", webPushTTL))
+
+	res, err := webPushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		return ErrWebPushGone
+	case res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests:
+		return webPushRejectedError{fmt.Errorf("Push service replied %s", res.Status)}
+	case res.StatusCode >= 300:
+		return fmt.Errorf("Push service replied %s", res.Status)
+	}
+	return nil
+}
+
+// encryptWebPush encrypts payload for the subscription as specified in
+// RFC 8291 and returns the request body (aes128gcm content coding, RFC 8188).
+func encryptWebPush(sub WebPushSubscription, payload []byte) ([]byte, error) {
+	// Every message is encrypted with new key pair and salt
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptWebPushWith(sub, payload, asPrivate, salt)
+}
+
+// encryptWebPushWith is encryptWebPush with given application server key
+// pair and salt.
+func encryptWebPushWith(sub WebPushSubscription, payload []byte, asPrivate *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	if len(payload) > webPushMaxPayload {
+		return nil, fmt.Errorf("Web push payload is too large (%d bytes)", len(payload))
+	}
+	uaPublicBytes, err := b64.DecodeString(sub.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid p256dh key (%v)", err)
+	}
+	authSecret, err := b64.DecodeString(sub.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid auth secret (%v)", err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid p256dh key (%v)", err)
+	}
+
+	asPublicBytes := asPrivate.PublicKey().Bytes()
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 0x02 marks the last (and only) record
+	plaintext := append(append([]byte{}, payload...), 0x02)
+
+	header := make([]byte, 0, webPushHeaderSize)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublicBytes)))
+	header = append(header, asPublicBytes...)
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// hkdf derives length bytes (max 32) of key material with HKDF-SHA-256.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{0x01})
+	return expand.Sum(nil)[:length]
+}
+
+// vapidAuthorization returns value for Authorization header as specified in
+// RFC 8292.
+func vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	claims := map[string]interface{}{
+		"aud": fmt.Sprintf("%s://%s", u.Scheme, u.Host),
+		"exp": time.Now().Add(vapidExpiration).Unix(),
+		"sub": vapidSubject,
+	}
+	token, err := signJWT(claims, vapidPrivateKey, nil)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("vapid t=%s, k=%s", token, vapidPublicKey), nil
+}
+
+// setVAPIDKey sets VAPID key pair from base64url encoded private key.
+func setVAPIDKey(private string) error {
+	d, err := b64.DecodeString(private)
+	if err != nil {
+		return err
+	}
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return err
+	}
+	public := key.PublicKey().Bytes()
+	vapidPrivateKey = &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:]),
+		},
+		D: new(big.Int).SetBytes(d),
+	}
+	vapidPublicKey = b64.EncodeToString(public)
+	return nil
+}
+
+func loadWebPushConfig() {
+	private, err := config.Config.String("webpush", "privatekey")
+	if err != nil || private == "" {
+		// Web push is optional
+		return
+	}
+	if err = setVAPIDKey(private); err != nil {
+		log.Fatalf("Invalid VAPID private key (%v)", err)
+	}
+	vapidSubject, err = config.Config.String("webpush", "subject")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
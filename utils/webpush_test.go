@@ -0,0 +1,254 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Private key from RFC 8292 example
+const testVAPIDKey = "IQ9Ur0ykXoHS9gzfYX0aBjy9lvdrjx_PFUXmie9YRcY"
+
+// decryptWebPush decrypts aes128gcm body as the browser would.
+func decryptWebPush(t *testing.T, uaPrivate *ecdh.PrivateKey, authSecret, body []byte) []byte {
+	salt := body[:16]
+	rs := binary.BigEndian.Uint32(body[16:20])
+	if rs != webPushRecordSize {
+		t.Errorf("Got record size %d, want %d", rs, webPushRecordSize)
+	}
+	idlen := int(body[20])
+	asPublicBytes := body[21 : 21+idlen]
+	ciphertext := body[21+idlen:]
+
+	asPublic, err := ecdh.P256().NewPublicKey(asPublicBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdhSecret, err := uaPrivate.ECDH(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyInfo := append([]byte("WebPush: info\x00"), uaPrivate.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("Failed to decrypt payload (%v)", err)
+	}
+	if plaintext[len(plaintext)-1] != 0x02 {
+		t.Errorf("Payload doesn't end with last record delimiter")
+	}
+	return plaintext[:len(plaintext)-1]
+}
+
+// verifyVAPID checks that Authorization header is valid VAPID header for aud.
+func verifyVAPID(t *testing.T, header, aud string) {
+	if !strings.HasPrefix(header, "vapid t=") {
+		t.Fatalf("Invalid Authorization header %q", header)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(header, "vapid t="), ", k=", 2)
+	if len(parts) != 2 || parts[1] != vapidPublicKey {
+		t.Fatalf("Invalid Authorization header %q", header)
+	}
+	jwt := strings.Split(parts[0], ".")
+	if len(jwt) != 3 {
+		t.Fatalf("Invalid JWT %q", parts[0])
+	}
+	sig, err := b64.DecodeString(jwt[2])
+	if err != nil || len(sig) != 64 {
+		t.Fatalf("Invalid JWT signature (%v)", err)
+	}
+	hash := sha256.Sum256([]byte(jwt[0] + "." + jwt[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&vapidPrivateKey.PublicKey, hash[:], r, s) {
+		t.Errorf("JWT signature doesn't verify")
+	}
+	body, err := b64.DecodeString(jwt[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{}
+	if err = json.Unmarshal(body, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims["aud"] != aud {
+		t.Errorf("Got aud %v, want %v", claims["aud"], aud)
+	}
+	if claims["sub"] != vapidSubject {
+		t.Errorf("Got sub %v, want %v", claims["sub"], vapidSubject)
+	}
+}
+
+func TestEncryptWebPush(t *testing.T) {
+	// Example from RFC 8291 section 5
+	sub := WebPushSubscription{
+		P256dh: "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4",
+		Auth:   "BTBZMqHH6r4Tts7J_aSIgg",
+	}
+	asPrivateBytes, _ := b64.DecodeString("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw")
+	asPrivate, err := ecdh.P256().NewPrivateKey(asPrivateBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, _ := b64.DecodeString("DGv6ra1nlYgDCS1FRnbzlw")
+	expected := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+
+	body, err := encryptWebPushWith(sub, []byte("When I grow up, I want to be a watermelon"), asPrivate, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b64.EncodeToString(body); got != expected {
+		t.Errorf("Got %v, want %v", got, expected)
+	}
+}
+
+func TestWebPushMaxPayload(t *testing.T) {
+	sub := WebPushSubscription{
+		P256dh: "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4",
+		Auth:   "BTBZMqHH6r4Tts7J_aSIgg",
+	}
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := make([]byte, 16)
+
+	body, err := encryptWebPushWith(sub, make([]byte, webPushMaxPayload), asPrivate, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Push services must accept bodies up to 4096 bytes
+	if len(body) != 4096 {
+		t.Errorf("Got body of %d bytes, want %d", len(body), 4096)
+	}
+	if _, err = encryptWebPushWith(sub, make([]byte, webPushMaxPayload+1), asPrivate, salt); err == nil {
+		t.Errorf("Expected error with too large payload")
+	}
+}
+
+func TestSendWebPush(t *testing.T) {
+	if err := setVAPIDKey(testVAPIDKey); err != nil {
+		t.Fatal(err)
+	}
+	vapidSubject = "mailto:test@domain.com"
+	// Test server is on loopback
+	WebhookAllowPrivate = true
+	defer func() { WebhookAllowPrivate = false }()
+
+	uaPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+	payload := []byte(`{"Title":"title"}`)
+
+	status := http.StatusCreated
+	received := false
+	var serverURL string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = true
+		if r.Header.Get("Content-Encoding") != "aes128gcm" {
+			t.Errorf("Got Content-Encoding %q", r.Header.Get("Content-Encoding"))
+		}
+		if r.Header.Get("TTL") == "" {
+			t.Errorf("TTL header missing")
+		}
+		verifyVAPID(t, r.Header.Get("Authorization"), serverURL)
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decryptWebPush(t, uaPrivate, authSecret, body); string(got) != string(payload) {
+			t.Errorf("Got payload %q, want %q", got, payload)
+		}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	serverURL = ts.URL
+
+	sub := WebPushSubscription{
+		Endpoint: ts.URL + "/push/abc",
+		P256dh:   b64.EncodeToString(uaPrivate.PublicKey().Bytes()),
+		Auth:     b64.EncodeToString(authSecret),
+	}
+	if err = SendWebPush(sub, payload); err != nil {
+		t.Errorf("Didn't expect error and got one! (%v)", err)
+	}
+	if !received {
+		t.Errorf("Push service didn't receive the push")
+	}
+
+	status = http.StatusGone
+	if err = SendWebPush(sub, payload); err != ErrWebPushGone {
+		t.Errorf("Expected ErrWebPushGone, got %v", err)
+	}
+
+	// Client errors are not worth retrying, throttling and server errors are
+	for code, rejected := range map[int]bool{
+		http.StatusBadRequest:            true,
+		http.StatusRequestEntityTooLarge: true,
+		http.StatusTooManyRequests:       false,
+		http.StatusServiceUnavailable:    false,
+	} {
+		status = code
+		if err = SendWebPush(sub, payload); err == nil || WebPushRejected(err) != rejected {
+			t.Errorf("Status %d: got error %v, want rejected %v", code, err, rejected)
+		}
+	}
+
+	if err = SendWebPush(sub, make([]byte, webPushMaxPayload+1)); err == nil || !WebPushRejected(err) {
+		t.Errorf("Expected rejected error with too large payload (%v)", err)
+	}
+}
+
+func TestSendWebPushPrivate(t *testing.T) {
+	if err := setVAPIDKey(testVAPIDKey); err != nil {
+		t.Fatal(err)
+	}
+	received := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = true
+	}))
+	defer ts.Close()
+
+	uaPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := WebPushSubscription{
+		// Host name is resolved before checking
+		Endpoint: strings.Replace(ts.URL, "127.0.0.1", "localhost", 1) + "/push/abc",
+		P256dh:   b64.EncodeToString(uaPrivate.PublicKey().Bytes()),
+		Auth:     b64.EncodeToString(make([]byte, 16)),
+	}
+	if err = SendWebPush(sub, []byte("{}")); err == nil || !strings.Contains(err.Error(), ErrWebPushAddress.Error()) {
+		t.Errorf("Got error %v, want %v", err, ErrWebPushAddress)
+	}
+	if received {
+		t.Errorf("Push was sent to loopback address")
+	}
+}
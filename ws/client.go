@@ -0,0 +1,204 @@
+package ws
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vhakulinen/push-server/config"
+	"github.com/vhakulinen/push-server/db"
+	"github.com/vhakulinen/push-server/tcp"
+)
+
+const (
+	pingTimeout  = 20
+	pingInterval = 120
+
+	// Seconds client has to acknowledge a push
+	ackTimeout = 30
+	// ackMessage is the frame client sends back for every push it receives
+	ackMessage = "ACK"
+
+	chanBufferSize = 100
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
+}
+
+// allowedOrigins are the origins (e.g. "https://example.com") of web pages
+// allowed to connect in addition to the server's own
+var allowedOrigins []string
+
+// LoadConfig loads this package configuration from global config.Config object
+func LoadConfig() {
+	allowedOrigins = nil
+	origins, _ := config.Config.String("websocket", "origins")
+	for _, o := range strings.Split(origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			allowedOrigins = append(allowedOrigins, o)
+		}
+	}
+}
+
+// checkOrigin allows clients which don't send Origin header (i.e. aren't
+// browsers), pages served from the same host and configured origins. Token
+// in the query string isn't enough, since any page which learns it could
+// otherwise open socket in the user's browser and consume the pushes.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range allowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleWSClient handles new WebSocket client connections. Pushes are
+// sent as text frames containing the same JSON as sent to TCP clients and
+// client must acknowledge each of them (in order) with "ACK" text frame.
+// Client is added to the same pool as TCP clients. Acknowledged pushes are
+// marked delivered to the device client specifies, or to the default device.
+func HandleWSClient(w http.ResponseWriter, r *http.Request) {
+	token, key, old, err := db.ResolveCredential(r.FormValue("token"), db.ScopeRead)
+	switch err {
+	case nil:
+	case db.ErrTokenNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Token not found!"))
+		return
+	default:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("%v", err)))
+		return
+	}
+
+	name := r.FormValue("device")
+	if name == "" {
+		name = db.DefaultDeviceName
+	}
+	device, err := db.RegisterDevice(name, token)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("%v", err)))
+		return
+	}
+
+	var sendChan = make(chan *db.PushData, chanBufferSize)
+	poolID, kicked := tcp.AddToPool(token, key, old, sendChan)
+	defer tcp.RemoveFromPool(token, poolID)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied to the client
+		log.Printf("Failed to upgrade WebSocket connection (%v)", err)
+		return
+	}
+	defer conn.Close()
+
+	acks := make(chan struct{}, chanBufferSize)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go readLoop(conn, acks, readErr, done)
+
+	pings := time.NewTicker(time.Second * pingInterval)
+	defer pings.Stop()
+
+	// Pushes sent but not yet acknowledged
+	var pending []*db.PushData
+	var ackDeadline <-chan time.Time
+	for {
+		select {
+		case p := <-sendChan:
+			data, err := p.ToJSON()
+			if err != nil {
+				log.Printf("%v", err)
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(time.Second * pingTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+			if len(pending) == 0 {
+				ackDeadline = time.After(time.Second * ackTimeout)
+			}
+			pending = append(pending, p)
+		case <-acks:
+			if len(pending) == 0 {
+				closeWith(conn, websocket.ClosePolicyViolation, "Unexpected ACK")
+				return
+			}
+			pending[0].SetDelivered(device)
+			pending = pending[1:]
+			if len(pending) == 0 {
+				ackDeadline = nil
+			} else {
+				ackDeadline = time.After(time.Second * ackTimeout)
+			}
+		case <-ackDeadline:
+			closeWith(conn, websocket.ClosePolicyViolation, "ACK timeout")
+			return
+		case <-pings.C:
+			deadline := time.Now().Add(time.Second * pingTimeout)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		case <-readErr:
+			return
+		case <-kicked:
+			closeWith(conn, websocket.ClosePolicyViolation, "Token revoked")
+			return
+		}
+	}
+}
+
+// readLoop reads frames sent by the client until the connection dies.
+// Client has to answer to our pings within pingTimeout.
+func readLoop(conn *websocket.Conn, acks chan<- struct{}, readErr chan<- error, done <-chan struct{}) {
+	conn.SetReadDeadline(time.Now().Add(time.Second * (pingInterval + pingTimeout)))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(time.Second * (pingInterval + pingTimeout)))
+		return nil
+	})
+
+	for {
+		t, msg, err := conn.ReadMessage()
+		if err != nil {
+			readErr <- err
+			return
+		}
+		if t != websocket.TextMessage || string(msg) != ackMessage {
+			closeWith(conn, websocket.CloseUnsupportedData, "Only ACK frames are accepted")
+			readErr <- nil
+			return
+		}
+		select {
+		case acks <- struct{}{}:
+		case <-done:
+			return
+		}
+	}
+}
+
+func closeWith(conn *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second*pingTimeout))
+}